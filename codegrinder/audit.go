@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// The audit log is append-only: entries are never updated or deleted,
+// and they do not reference other tables so they outlive the users and
+// objects they describe.
+
+const auditLogLimit = 1000
+
+// recordAudit adds an entry to the audit log. Pass the database handle
+// rather than the request transaction when the entry should be kept even
+// if the request fails.
+func recordAudit(db meddler.DB, entry *AuditEntry) error {
+	entry.ID = 0
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	if err := meddler.Insert(db, "audit_log", entry); err != nil {
+		return loggedErrorf("error recording audit entry %s %s by user %d: %v", entry.Action, entry.Target, entry.ActorID, err)
+	}
+	return nil
+}
+
+// auditor records the actions of the user making a request. It is mapped
+// by withCurrentUser and always names the real user as the actor, even
+// when an administrator is impersonating someone else.
+type auditor struct {
+	actorID         int64
+	userID          int64
+	impersonationID int64
+}
+
+func newAuditor(actor *User, imp *Impersonation) *auditor {
+	a := &auditor{actorID: actor.ID}
+	if imp != nil {
+		a.userID = imp.UserID
+		a.impersonationID = imp.ID
+	}
+	return a
+}
+
+// record adds an entry to the audit log in the request transaction,
+// so the entry is kept only if the action it describes is.
+func (a *auditor) record(tx *sql.Tx, entry *AuditEntry) error {
+	entry.ActorID = a.actorID
+	entry.UserID = a.userID
+	entry.ImpersonationID = a.impersonationID
+	return recordAudit(tx, entry)
+}
+
+// auditCommitSummary describes a commit for the audit log without
+// the contents of its files or its transcript.
+func auditCommitSummary(commit *Commit) map[string]interface{} {
+	var names []string
+	for name := range commit.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return map[string]interface{}{
+		"id":           commit.ID,
+		"assignmentID": commit.AssignmentID,
+		"problemID":    commit.ProblemID,
+		"step":         commit.Step,
+		"action":       commit.Action,
+		"note":         commit.Note,
+		"files":        names,
+		"score":        commit.Score,
+		"createdAt":    commit.CreatedAt,
+		"updatedAt":    commit.UpdatedAt,
+	}
+}
+
+// auditProblemSummary describes a problem for the audit log without
+// the contents of its steps.
+func auditProblemSummary(problem *Problem, steps int) map[string]interface{} {
+	return map[string]interface{}{
+		"problem": problem,
+		"steps":   steps,
+	}
+}
+
+// auditGradeSummary describes an assignment's scores for the audit log.
+// Only the scores for the given problem are included.
+func auditGradeSummary(asst *Assignment, unique string) map[string]interface{} {
+	return map[string]interface{}{
+		"score":      asst.Score,
+		"rawScores":  append([]float64{}, asst.RawScores[unique]...),
+		"stepScores": append([]float64{}, asst.StepScores[unique]...),
+	}
+}
+
+// GetAuditLog handles requests to /v2/audit_log,
+// returning audit log entries, most recent first.
+//
+// If parameter user_id=<...> present, results will be filtered to actions taken by, as, or on the given user.
+// If parameter course_id=<...> present, results will be filtered to actions in the given course.
+// If parameter object_type=<...> present, results will be filtered to actions on objects of the given type.
+// If parameter object_id=<...> present, results will be filtered to actions on the object with the given ID.
+// If parameter action=<...> present, results will be filtered by prefix match on Action field.
+// If parameter since=<...> present (RFC 3339), results will be filtered to entries at or after the given time.
+// At most 1000 entries are returned; use before_id=<...> to page through older entries.
+func GetAuditLog(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := []string{}
+	args := []interface{}{}
+	addArg := func(arg interface{}) string {
+		args = append(args, arg)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	for _, name := range []string{"user_id", "course_id", "object_id", "before_id"} {
+		s := r.FormValue(name)
+		if s == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id < 1 {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s: %q is not a valid ID", name, s)
+			return
+		}
+		switch name {
+		case "user_id":
+			n := addArg(id)
+			where = append(where, `(actor_id = `+n+` OR user_id = `+n+` OR (object_type = 'user' AND object_id = `+n+`))`)
+		case "course_id":
+			where = append(where, `course_id = `+addArg(id))
+		case "object_id":
+			where = append(where, `object_id = `+addArg(id))
+		case "before_id":
+			where = append(where, `id < `+addArg(id))
+		}
+	}
+	if objectType := r.FormValue("object_type"); objectType != "" {
+		where = append(where, `object_type = `+addArg(objectType))
+	}
+	if action := r.FormValue("action"); action != "" {
+		where = append(where, `action LIKE `+addArg(strings.Replace(action, "%", `\%`, -1)+"%"))
+	}
+	if since := r.FormValue("since"); since != "" {
+		when, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing since: %v", err)
+			return
+		}
+		where = append(where, `created_at >= `+addArg(when))
+	}
+
+	query := `SELECT * FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY id DESC LIMIT ` + strconv.Itoa(auditLogLimit)
+
+	entries := []*AuditEntry{}
+	if err := meddler.QueryAll(tx, &entries, query, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// getLTISecret returns the shared secret for the given consumer key.
+// Keys in the lti_consumers table take precedence; a key that is not
+// found there falls back to the global ltiSecret from the config file,
+// if one is set.
+func getLTISecret(db meddler.DB, consumerKey string) (string, error) {
+	consumer := new(LTIConsumer)
+	err := meddler.QueryRow(db, consumer, `SELECT * FROM lti_consumers WHERE consumer_key = $1`, consumerKey)
+	if err == sql.ErrNoRows {
+		if Config.LTISecret == "" {
+			return "", loggedErrorf("unknown LTI consumer key %q", consumerKey)
+		}
+		return Config.LTISecret, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !consumer.Enabled {
+		return "", loggedErrorf("LTI consumer key %q (%s) is disabled", consumerKey, consumer.Institution)
+	}
+	return consumer.Secret, nil
+}
+
+// newLTISecret generates a random shared secret.
+func newLTISecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// GetLTIConsumers handles requests to /v2/lti_consumers,
+// returning a list of all consumer keys (without their secrets).
+func GetLTIConsumers(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	consumers := []*LTIConsumer{}
+	if err := meddler.QueryAll(tx, &consumers, `SELECT * FROM lti_consumers ORDER BY consumer_key`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	for _, consumer := range consumers {
+		consumer.Secret = ""
+	}
+	render.JSON(http.StatusOK, consumers)
+}
+
+// PostLTIConsumer handles requests to /v2/lti_consumers,
+// creating a new consumer key with a random secret.
+// The response is the only time the secret is revealed.
+func PostLTIConsumer(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, consumer LTIConsumer, render render.Render) {
+	if consumer.ConsumerKey == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "consumer key must not be empty")
+		return
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM lti_consumers WHERE consumer_key = $1`, consumer.ConsumerKey).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count > 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "consumer key %q already exists", consumer.ConsumerKey)
+		return
+	}
+
+	secret, err := newLTISecret()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating secret: %v", err)
+		return
+	}
+	now := time.Now()
+	consumer.ID = 0
+	consumer.Secret = secret
+	consumer.Enabled = true
+	consumer.CreatedAt = now
+	consumer.RotatedAt = now
+	consumer.UpdatedAt = now
+	if err := meddler.Insert(tx, "lti_consumers", &consumer); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) created LTI consumer key %q (%s)", currentUser.ID, currentUser.Email, consumer.ConsumerKey, consumer.Institution)
+	if err := auditLTIConsumer(tx, audit, "lti_consumer.create", &consumer); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, &consumer)
+}
+
+// PostLTIConsumerRotate handles requests to /v2/lti_consumers/:lti_consumer_id/rotate,
+// replacing the secret of a consumer key with a new random secret.
+// The old secret stops working immediately.
+func PostLTIConsumerRotate(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, render render.Render) {
+	consumer := loadLTIConsumer(w, tx, params)
+	if consumer == nil {
+		return
+	}
+
+	secret, err := newLTISecret()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating secret: %v", err)
+		return
+	}
+	now := time.Now()
+	consumer.Secret = secret
+	consumer.RotatedAt = now
+	consumer.UpdatedAt = now
+	if err := meddler.Update(tx, "lti_consumers", consumer); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) rotated the secret for LTI consumer key %q", currentUser.ID, currentUser.Email, consumer.ConsumerKey)
+	if err := auditLTIConsumer(tx, audit, "lti_consumer.rotate", consumer); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, consumer)
+}
+
+// PostLTIConsumerDisable handles requests to /v2/lti_consumers/:lti_consumer_id/disable,
+// rejecting all further launches and grade posts that use the consumer key.
+func PostLTIConsumerDisable(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, render render.Render) {
+	setLTIConsumerEnabled(w, tx, params, currentUser, audit, render, false)
+}
+
+// PostLTIConsumerEnable handles requests to /v2/lti_consumers/:lti_consumer_id/enable,
+// accepting the consumer key again after it was disabled.
+func PostLTIConsumerEnable(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, render render.Render) {
+	setLTIConsumerEnabled(w, tx, params, currentUser, audit, render, true)
+}
+
+func setLTIConsumerEnabled(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, render render.Render, enabled bool) {
+	consumer := loadLTIConsumer(w, tx, params)
+	if consumer == nil {
+		return
+	}
+
+	consumer.Enabled = enabled
+	consumer.UpdatedAt = time.Now()
+	if err := meddler.Update(tx, "lti_consumers", consumer); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) set enabled=%v for LTI consumer key %q", currentUser.ID, currentUser.Email, enabled, consumer.ConsumerKey)
+	action := "lti_consumer.disable"
+	if enabled {
+		action = "lti_consumer.enable"
+	}
+	if err := auditLTIConsumer(tx, audit, action, consumer); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	consumer.Secret = ""
+	render.JSON(http.StatusOK, consumer)
+}
+
+// auditLTIConsumer records a change to a consumer key, leaving out the secret.
+func auditLTIConsumer(tx *sql.Tx, audit *auditor, action string, consumer *LTIConsumer) error {
+	after := *consumer
+	after.Secret = ""
+	return audit.record(tx, &AuditEntry{
+		Action:     action,
+		ObjectType: "lti_consumer",
+		ObjectID:   consumer.ID,
+		Target:     consumer.ConsumerKey,
+		After:      &after,
+	})
+}
+
+func loadLTIConsumer(w http.ResponseWriter, tx *sql.Tx, params martini.Params) *LTIConsumer {
+	consumerID, err := parseID(w, "lti_consumer_id", params["lti_consumer_id"])
+	if err != nil {
+		return nil
+	}
+	consumer := new(LTIConsumer)
+	if err := meddler.Load(tx, "lti_consumers", consumer, consumerID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil
+	}
+	return consumer
+}
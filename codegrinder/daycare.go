@@ -1,28 +1,22 @@
 package main
 
 import (
-	"archive/tar"
 	"bytes"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net/http"
-	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/fsouza/go-dockerclient"
 	"github.com/go-martini/martini"
 	"github.com/gorilla/websocket"
 	. "github.com/russross/codegrinder/common"
 )
 
-var dockerClient *docker.Client
-
 type limits struct {
 	maxCPU      int64
 	maxSession  int64
@@ -31,6 +25,9 @@ type limits struct {
 	maxFileSize int64
 	maxMemory   int64
 	maxThreads  int64
+
+	// extra seconds a pooled sandbox may wait before it is used
+	maxIdle int64
 }
 
 func newLimits(t *ProblemTypeAction) *limits {
@@ -175,6 +172,12 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		log.Printf("args: %v", args)
 	}
 
+	// recover any hidden files before checking signatures
+	if err := unsealHiddenFiles(req.CommitBundle.ProblemSteps); err != nil {
+		logAndTransmitErrorf("%v", err)
+		return
+	}
+
 	// check signatures
 	problemType := req.CommitBundle.ProblemType
 	typeSig := problemType.ComputeSignature(Config.DaycareSecret)
@@ -236,6 +239,11 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	for name, contents := range commit.Files {
 		files[name] = contents
 	}
+	if commit.Action == "grade" {
+		for name, contents := range step.HiddenFiles {
+			files[name] = contents
+		}
+	}
 	for name, contents := range req.CommitBundle.ProblemType.Files {
 		files[name] = contents
 	}
@@ -247,6 +255,18 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		}
 	}
 
+	// wait for a turn
+	ticket, err := daycareQueue.Enter()
+	if err != nil {
+		logAndTransmitErrorf("%v", err)
+		return
+	}
+	defer daycareQueue.Leave(ticket)
+	if err := waitForTurn(socket, ticket); err != nil {
+		log.Printf("client gave up while waiting in queue: %v", err)
+		return
+	}
+
 	// launch a nanny process
 	nannyName := fmt.Sprintf("nanny-%d", req.CommitBundle.UserID)
 	log.Printf("launching container for %s", nannyName)
@@ -277,6 +297,9 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 					alive = nil
 				}
 			case <-t.C:
+				n.closedLock.Lock()
+				n.TimedOut = true
+				n.closedLock.Unlock()
 				if err := n.Shutdown("timeout"); err != nil {
 					log.Printf("error shutting down container: %v", err)
 				}
@@ -326,9 +349,21 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	}()
 
 	// relay container events to the socket
+	// output from grading with hidden files is held back, since test
+	// frameworks print the source of failed assertions
+	hideOutput := commit.Action == "grade" && len(step.HiddenFiles) > 0
 	eventListenerClosed := make(chan struct{})
 	go func() {
+		first := true
 		for event := range n.Events {
+			if first {
+				first = false
+				recordFirstEvent(time.Since(now))
+			}
+			if hideOutput && (event.Event == "stdout" || event.Event == "stderr") {
+				continue
+			}
+
 			// record the event
 			commit.Transcript = append(commit.Transcript, event)
 
@@ -362,13 +397,22 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 		return
 	}
 
-	// run the problem-type specific handler
+	// run the problem-type specific handler, or the I/O grader if the problem asks for it
 	handler, ok := action.Handler.(nannyHandler)
-	if ok {
+	ioOpts, ioErr := parseIOOptions(problem.Options)
+	if commit.Action == "grade" && ioErr != nil {
+		n.ReportCard.LogAndFailf("%v", ioErr)
+	} else if commit.Action == "grade" && ioOpts != nil {
+		runAndCompareIO(n, ioOpts, files)
+	} else if ok {
 		handler(n, args, problem.Options, files, rw)
 	} else {
 		logAndTransmitErrorf("handler for action %s is of wrong type", commit.Action)
 	}
+	n.ReportCard.ApplyTestCases(problem.TestCases)
+	if commit.Action == "grade" {
+		redactHiddenResults(n.ReportCard, step.HiddenFiles)
+	}
 	commit.ReportCard = n.ReportCard
 
 	// download any files?
@@ -394,30 +438,35 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	close(n.Events)
 	<-eventListenerClosed
 
+	// in place of the hidden output, report the redacted results
+	if hideOutput {
+		event := &EventMessage{
+			Time:       time.Now(),
+			Event:      "stdout",
+			StreamData: hiddenOutputNotice + summarizeReportCard(n.ReportCard),
+		}
+		commit.Transcript = append(commit.Transcript, event)
+		if err := socket.WriteJSON(&DaycareResponse{Event: event}); err != nil {
+			log.Printf("error writing grading summary: %v", err)
+		}
+	}
+
 	if commit.Action == "grade" {
 		// send the final commit back to the client
 		commit.Compress()
 
 		// compute the score for this step on a scale of 0.0 to 1.0
-		if commit.ReportCard.Passed {
-			// award full credit for this step
-			commit.Score = 1.0
-		} else if len(commit.ReportCard.Results) == 0 {
-			// no results? fail...
-			commit.Score = 0.0
-		} else {
-			// compute partial credit for this step
-			passed := 0
-			for _, elt := range commit.ReportCard.Results {
-				if elt.Outcome == "passed" {
-					passed++
-				}
-			}
-			commit.Score = float64(passed) / float64(len(commit.ReportCard.Results))
-		}
+		commit.Score = commit.ReportCard.ComputeScore()
 		commit.UpdatedAt = now
 		req.CommitBundle.CommitSignature = commit.ComputeSignature(Config.DaycareSecret, req.CommitBundle.ProblemTypeSignature, req.CommitBundle.ProblemSignature, req.CommitBundle.Hostname, req.CommitBundle.UserID)
 
+		// do not send back hidden files that arrived sealed
+		for _, elt := range req.CommitBundle.ProblemSteps {
+			if elt.SealedFiles != "" {
+				elt.HiddenFiles = nil
+			}
+		}
+
 		res := &DaycareResponse{CommitBundle: req.CommitBundle}
 		if err := socket.WriteJSON(res); err != nil {
 			logAndTransmitErrorf("error writing final commit JSON: %v", err)
@@ -427,141 +476,45 @@ func SocketProblemTypeAction(w http.ResponseWriter, r *http.Request, params mart
 	log.Printf("handler for %s finished", nannyName)
 }
 
+// recordFirstEvent tracks how long students wait to see the first event from a request.
+func recordFirstEvent(elapsed time.Duration) {
+	firstEventMutex.Lock()
+	defer firstEventMutex.Unlock()
+	firstEvents++
+	firstEventSeconds += elapsed.Seconds()
+	averageFirstEventSecondsCounter.Set(firstEventSeconds / float64(firstEvents))
+}
+
 type Nanny struct {
 	Name       string
 	Start      time.Time
-	Container  *docker.Container
-	UID        int64
+	Sandbox    Sandbox
+	Limits     *limits
 	ReportCard *ReportCard
 	Input      chan string
 	Events     chan *EventMessage
 	Transcript []*EventMessage
+
+	// Shutdown is called from the timeout and stdin goroutines as well as
+	// the main handler, so Closed and TimedOut are protected by closedLock
+	closedLock sync.Mutex
 	Closed     bool
+	TimedOut   bool
 }
 
 type nannyHandler func(nanny *Nanny, args, options []string, files map[string]string, stdin io.Reader)
 
-var getContainerIDRE = regexp.MustCompile(`The name .* is already in use by container (.*)\. You have to delete \(or rename\) that container to be able to reuse that name`)
-
-func getContainerID(msg string) string {
-	groups := getContainerIDRE.FindStringSubmatch(msg)
-	if len(groups) != 2 {
-		return ""
-	}
-	return groups[1]
-}
-
 func NewNanny(problemType *ProblemType, problem *Problem, interactive bool, args []string, limits *limits, name string) (*Nanny, error) {
-	// create a container
-	mem := limits.maxMemory * 1024 * 1024
-	disk := limits.maxFileSize * 1024 * 1024
-	uid, err := allocUID()
-	if err != nil {
-		return nil, err
-	}
-
-	timeLimit := limits.maxCPU * 2
-	if interactive {
-		timeLimit = limits.maxSession
-	}
-	config := &docker.Config{
-		Hostname:        name,
-		User:            uidgid(uid),
-		Memory:          int64(mem),
-		MemorySwap:      -1,
-		Cmd:             []string{"/bin/sleep", strconv.FormatInt(timeLimit, 10) + "s"},
-		Env:             []string{"USER=student", "HOME=/home/student"},
-		Image:           problemType.Image,
-		NetworkDisabled: true,
-	}
-	for _, s := range args {
-		if strings.HasPrefix(s, "COLUMNS=") {
-			config.Env = append(config.Env, s)
-		}
-		if strings.HasPrefix(s, "LINES=") {
-			config.Env = append(config.Env, s)
-		}
-		if strings.HasPrefix(s, "TERM=") {
-			config.Env = append(config.Env, s)
-		}
-	}
-
-	hostConfig := &docker.HostConfig{
-		CapDrop: []string{
-			"NET_RAW",
-			"NET_BIND_SERVICE",
-			"AUDIT_READ",
-			"AUDIT_WRITE",
-			"DAC_OVERRIDE",
-			"SETFCAP",
-			"SETPCAP",
-			"SETGID",
-			"SETUID",
-			"MKNOD",
-			"CHOWN",
-			"FOWNER",
-			"FSETID",
-			"KILL",
-			"SYS_CHROOT",
-		},
-		PidsLimit: limits.maxThreads,
-		Ulimits: []docker.ULimit{
-			{Name: "core", Soft: 0, Hard: 0},
-			{Name: "cpu", Soft: limits.maxCPU, Hard: limits.maxCPU},
-			{Name: "data", Soft: mem, Hard: mem},
-			{Name: "fsize", Soft: disk, Hard: disk},
-			{Name: "memlock", Soft: 0, Hard: 0},
-			{Name: "nofile", Soft: limits.maxFD, Hard: limits.maxFD},
-			{Name: "nproc", Soft: limits.maxThreads, Hard: limits.maxThreads},
-			{Name: "stack", Soft: mem, Hard: mem},
-		},
-	}
-
-	container, err := dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: config, HostConfig: hostConfig})
+	sandbox, err := NewPooledSandbox(problemType.Image, interactive, args, limits, name)
 	if err != nil {
-		if err == docker.ErrContainerAlreadyExists {
-			// container already exists with that name--try killing it
-			log.Printf("killing existing container with same name %s", name)
-			err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
-				ID:    name,
-				Force: true,
-			})
-			if err2 != nil {
-				log.Printf("error killing existing container with same name: %v", err2)
-				releaseUID(uid)
-				return nil, err2
-			}
-
-			// try it one more time
-			container, err = dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: config, HostConfig: hostConfig})
-		}
-		if err != nil {
-			log.Printf("CreateContainer: %v", err)
-			releaseUID(uid)
-			return nil, err
-		}
-	}
-
-	// start it
-	err = dockerClient.StartContainer(container.ID, nil)
-	if err != nil {
-		log.Printf("StartContainer: %v", err)
-		releaseUID(uid)
-		err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
-			ID:    container.ID,
-			Force: true,
-		})
-		if err2 != nil {
-			log.Printf("RemoveContainer: %v", err2)
-		}
 		return nil, err
 	}
 
 	return &Nanny{
 		Name:       name,
 		Start:      time.Now(),
-		Container:  container,
-		UID:        uid,
+		Sandbox:    sandbox,
+		Limits:     limits,
 		ReportCard: NewReportCard(),
 		Input:      make(chan string),
 		Events:     make(chan *EventMessage),
@@ -570,175 +523,46 @@ func NewNanny(problemType *ProblemType, problem *Problem, interactive bool, args
 }
 
 func (n *Nanny) Shutdown(msg string) error {
+	n.closedLock.Lock()
 	if n.Closed {
+		n.closedLock.Unlock()
 		return nil
 	}
 	n.Closed = true
+	n.closedLock.Unlock()
 
-	// shut down the container
+	// shut down the sandbox
 	log.Printf("shutting down %s: %s", n.Name, msg)
-	err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
-		ID:    n.Container.ID,
-		Force: true,
-	})
-	releaseUID(n.UID)
-	if err != nil {
+	if err := n.Sandbox.Shutdown(); err != nil {
 		log.Printf("Nanny.Shutdown: %v", err)
 		return err
 	}
 	return nil
 }
 
-// PutFiles copies a set of files to the given container.
-// The container must be running.
-func (n *Nanny) PutFiles(files map[string]string, mode int64) error {
-	// nothing to do?
-	if len(files) == 0 {
-		return nil
-	}
-
-	// tar the files
-	now := time.Now()
-	buf := new(bytes.Buffer)
-	writer := tar.NewWriter(buf)
-	dirs := make(map[string]bool)
-	for name, contents := range files {
-		dir := filepath.Dir(name)
-		if dir != "" && !dirs[dir] {
-			dirs[dir] = true
-			header := &tar.Header{
-				Name:       dir,
-				Mode:       0777,
-				Uid:        int(n.UID),
-				Gid:        int(n.UID),
-				Size:       0,
-				ModTime:    now,
-				Typeflag:   tar.TypeDir,
-				Uname:      strconv.FormatInt(n.UID, 10),
-				Gname:      strconv.FormatInt(n.UID, 10),
-				AccessTime: now,
-				ChangeTime: now,
-			}
-			if err := writer.WriteHeader(header); err != nil {
-				log.Printf("writing tar header for directory: %v", err)
-				return err
-			}
-		}
-		header := &tar.Header{
-			Name:       name,
-			Mode:       mode,
-			Uid:        int(n.UID),
-			Gid:        int(n.UID),
-			Size:       int64(len(contents)),
-			ModTime:    now,
-			Typeflag:   tar.TypeReg,
-			Uname:      strconv.FormatInt(n.UID, 10),
-			Gname:      strconv.FormatInt(n.UID, 10),
-			AccessTime: now,
-			ChangeTime: now,
-		}
-		if err := writer.WriteHeader(header); err != nil {
-			log.Printf("writing tar header: %v", err)
-			return err
-		}
-		if _, err := writer.Write([]byte(contents)); err != nil {
-			log.Printf("writing to tar file: %v", err)
-			return err
-		}
-	}
-	if err := writer.Close(); err != nil {
-		log.Printf("closing tar file: %v", err)
-		return err
-	}
-
-	// upload the archive
-	err := dockerClient.UploadToContainer(n.Container.ID, docker.UploadToContainerOptions{
-		InputStream:          buf,
-		Path:                 "/home/student",
-		NoOverwriteDirNonDir: true,
-	})
+// timedOut returns true if the nanny was shut down by the timeout goroutine.
+func (n *Nanny) timedOut() bool {
+	n.closedLock.Lock()
+	defer n.closedLock.Unlock()
+	return n.TimedOut
+}
 
-	if err != nil {
-		log.Printf("unloading files to container: %v", err)
-		return err
-	}
-	return nil
+// PutFiles copies a set of files to the sandbox.
+// The sandbox must be running.
+func (n *Nanny) PutFiles(files map[string]string, mode int64) error {
+	return n.Sandbox.PutFiles(files, mode)
 }
 
-// GetFiles copies a set of files from the given container.
-// The container must be running.
+// GetFiles copies a set of files from the sandbox.
+// The sandbox must be running.
 func (n *Nanny) GetFiles(filenames []string) (map[string]string, error) {
-	if n.Closed {
-		return nil, nil
-	}
-
-	// nothing to do?
-	if len(filenames) == 0 {
+	n.closedLock.Lock()
+	closed := n.Closed
+	n.closedLock.Unlock()
+	if closed {
 		return nil, nil
 	}
-
-	// exec tar in the container
-	exec, err := dockerClient.CreateExec(docker.CreateExecOptions{
-		AttachStdin:  false,
-		AttachStdout: true,
-		AttachStderr: true,
-		Tty:          false,
-		Cmd:          append([]string{"/bin/tar", "cf", "-"}, filenames...),
-		Container:    n.Container.ID,
-		User:         uidgid(n.UID),
-	})
-	if err != nil {
-		log.Printf("GetFiles: creating exec command: %v", err)
-		return nil, err
-	}
-	tarFile := new(bytes.Buffer)
-	tarErr := new(bytes.Buffer)
-	err = dockerClient.StartExec(exec.ID, docker.StartExecOptions{
-		Detach:       false,
-		Tty:          false,
-		InputStream:  nil,
-		OutputStream: tarFile,
-		ErrorStream:  tarErr,
-		RawTerminal:  false,
-	})
-	if err != nil {
-		log.Printf("GetFiles: starting exec command: %v", err)
-		return nil, err
-	}
-
-	if tarErr.Len() != 0 {
-		log.Printf("GetFiles: tar error output: %q", tarErr.String())
-		return nil, fmt.Errorf("GetFiles: tar gave non-empty error output")
-	}
-
-	// untar the files
-	files := make(map[string]string)
-	reader := tar.NewReader(tarFile)
-	for {
-		header, err := reader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Printf("GetFiles: reading tar file header: %v", err)
-			return nil, err
-		}
-		if header.Typeflag != tar.TypeReg {
-			continue
-		}
-		if header.Size == 0 {
-			files[header.Name] = ""
-			continue
-		}
-		contents := make([]byte, int(header.Size))
-		if _, err = reader.Read(contents); err != nil {
-			log.Printf("GetFiles: reading tar file contents: %v", err)
-			return nil, err
-		}
-		files[header.Name] = string(contents)
-	}
-
-	return files, nil
+	return n.Sandbox.GetFiles(filenames)
 }
 
 type execOutput struct {
@@ -802,53 +626,56 @@ func (n *Nanny) Exec(cmd []string, stdin io.Reader, useTTY bool) (stdout, stderr
 		ExecCommand: cmd,
 	}
 
-	// create
-	exec, err := dockerClient.CreateExec(docker.CreateExecOptions{
-		AttachStdin:  stdin != nil,
-		AttachStdout: true,
-		AttachStderr: true,
-		Tty:          useTTY,
-		Cmd:          cmd,
-		Container:    n.Container.ID,
-		User:         uidgid(n.UID),
-	})
-	if err != nil {
-		return nil, nil, nil, -1, err
-	}
-
 	// gather output
 	var out execOutput
 	out.events = n.Events
 
-	// start
-	err = dockerClient.StartExec(exec.ID, docker.StartExecOptions{
-		Detach:       false,
-		Tty:          useTTY,
-		InputStream:  stdin,
-		OutputStream: (*execStdout)(&out),
-		ErrorStream:  (*execStderr)(&out),
-		RawTerminal:  useTTY,
-	})
-	if err != nil {
-		return nil, nil, nil, -1, err
+	start := time.Now()
+	status, usage, err := n.Sandbox.Exec(cmd, stdin, (*execStdout)(&out), (*execStderr)(&out), useTTY)
+	if usage == nil {
+		usage = new(ResourceUsage)
 	}
-
-	// inspect
-	inspect, err := dockerClient.InspectExec(exec.ID)
+	usage.WallSeconds = time.Since(start).Seconds()
 	if err != nil {
+		if n.timedOut() {
+			usage.LimitHit = "timeout"
+			n.ReportCard.AddResources(usage)
+		}
 		return nil, nil, nil, -1, err
 	}
-	if inspect.Running {
-		return nil, nil, nil, -1, fmt.Errorf("process still running")
-	}
+	usage.LimitHit = n.limitHit(status, usage)
+	n.ReportCard.AddResources(usage)
 
 	n.Events <- &EventMessage{
 		Time:       time.Now(),
 		Event:      "exit",
-		ExitStatus: inspect.ExitCode,
+		ExitStatus: status,
 	}
 
-	return &out.stdout, &out.stderr, &out.script, inspect.ExitCode, nil
+	return &out.stdout, &out.stderr, &out.script, status, nil
+}
+
+// limitHit guesses which limit, if any, stopped a command based on how it exited.
+func (n *Nanny) limitHit(status int, usage *ResourceUsage) string {
+	l := n.Limits
+	switch {
+	case usage.LimitHit != "":
+		return usage.LimitHit
+	case n.timedOut():
+		return "timeout"
+	case status == 128+int(syscall.SIGXCPU):
+		return "cpu"
+	case status == 128+int(syscall.SIGKILL) && l.maxCPU > 0 && usage.CPUSeconds >= float64(l.maxCPU)*0.9:
+		// a hard CPU limit is enforced with SIGKILL
+		return "cpu"
+	case status == 128+int(syscall.SIGXFSZ):
+		return "fileSize"
+	case status == 128+int(syscall.SIGKILL) && l.maxMemory > 0 && usage.PeakMemory >= l.maxMemory*1024*1024*9/10:
+		return "memory"
+	case status != 0 && l.maxThreads > 0 && usage.Processes >= l.maxThreads:
+		return "processes"
+	}
+	return ""
 }
 
 func (n *Nanny) ExecSimple(cmd []string, stdin io.Reader, useTTY bool) error {
@@ -865,36 +692,6 @@ func (n *Nanny) ExecSimple(cmd []string, stdin io.Reader, useTTY bool) error {
 	return nil
 }
 
-var uidsInUse map[int64]bool = make(map[int64]bool)
-var uidsMutex sync.Mutex
-
-func allocUID() (int64, error) {
-	uidsMutex.Lock()
-	defer uidsMutex.Unlock()
-	if len(uidsInUse) > 1000 {
-		err := fmt.Errorf("more than 1000 UIDs in use, cannot create more nanny containers")
-		log.Printf("%v", err)
-		return 0, err
-	}
-	for {
-		uid := rand.Int63n(1000) + 10000
-		if !uidsInUse[uid] {
-			uidsInUse[uid] = true
-			return uid, nil
-		}
-	}
-}
-
-func releaseUID(uid int64) {
-	uidsMutex.Lock()
-	defer uidsMutex.Unlock()
-	delete(uidsInUse, uid)
-}
-
-func uidgid(uid int64) string {
-	return fmt.Sprintf("%d:%d", uid, uid)
-}
-
 type readWritebuffer struct {
 	lock     sync.Mutex
 	notEmpty sync.Cond
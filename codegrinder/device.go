@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// Device logins let grind get an API token without the user copying
+// secrets between the browser and the terminal:
+//
+// 1.  grind asks for a device code and a short user code
+// 2.  the user visits /v2/device in a browser where they are already
+//     signed in (through the LMS) and enters the user code
+// 3.  grind polls with the device code until the login is approved,
+//     and then receives a new API token
+
+const (
+	deviceLoginTimeout  = 15 * time.Minute
+	deviceLoginInterval = 5 * time.Second
+	deviceUserCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+	deviceUserCodeHalf  = 4
+)
+
+type deviceLogin struct {
+	ID             int64     `meddler:"id,pk"`
+	DeviceCodeHash string    `meddler:"device_code_hash"`
+	UserCode       string    `meddler:"user_code"`
+	Status         string    `meddler:"status"`
+	UserID         int64     `meddler:"user_id,zeroisnull"`
+	ExpiresAt      time.Time `meddler:"expires_at,localtime"`
+	CreatedAt      time.Time `meddler:"created_at,localtime"`
+	UpdatedAt      time.Time `meddler:"updated_at,localtime"`
+}
+
+// newUserCode generates a code of the form BCDF-GHJK.
+// The alphabet has no vowels so codes do not spell words.
+func newUserCode() (string, error) {
+	raw := make([]byte, 2*deviceUserCodeHalf)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := make([]byte, 0, len(raw)+1)
+	for i, b := range raw {
+		if i == deviceUserCodeHalf {
+			code = append(code, '-')
+		}
+		code = append(code, deviceUserCodeChars[int(b)%len(deviceUserCodeChars)])
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode accepts user codes typed in lower case or without the hyphen.
+func normalizeUserCode(code string) string {
+	var clean []rune
+	for _, r := range strings.ToUpper(code) {
+		if r >= 'A' && r <= 'Z' {
+			clean = append(clean, r)
+		}
+	}
+	if len(clean) != 2*deviceUserCodeHalf {
+		return string(clean)
+	}
+	return string(clean[:deviceUserCodeHalf]) + "-" + string(clean[deviceUserCodeHalf:])
+}
+
+// deviceFormToken protects the approval form from cross-site requests.
+func deviceFormToken(userID int64) string {
+	mac := hmac.New(sha256.New, []byte(Config.SessionSecret))
+	fmt.Fprintf(mac, "device login %d", userID)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PostDeviceCode handles requests to /v2/device/code,
+// starting a new device login.
+func PostDeviceCode(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	now := time.Now()
+	if _, err := tx.Exec(`DELETE FROM device_logins WHERE expires_at < $1`, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	deviceCode, err := newRandomToken()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating device code: %v", err)
+		return
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating user code: %v", err)
+		return
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM device_logins WHERE user_code = $1`, userCode).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count > 0 {
+		loggedHTTPErrorf(w, http.StatusServiceUnavailable, "user code collision; please try again")
+		return
+	}
+
+	login := &deviceLogin{
+		DeviceCodeHash: hashAPIToken(deviceCode),
+		UserCode:       userCode,
+		Status:         DeviceLoginPending,
+		ExpiresAt:      now.Add(deviceLoginTimeout),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := meddler.Insert(tx, "device_logins", login); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	u := getMyURL(r, false)
+	u.Path = "/v2/device"
+	render.JSON(http.StatusOK, &DeviceCode{
+		DeviceCode:      deviceCode,
+		UserCode:        userCode,
+		VerificationURL: u.String(),
+		ExpiresIn:       int64(deviceLoginTimeout / time.Second),
+		Interval:        int64(deviceLoginInterval / time.Second),
+	})
+}
+
+// PostDeviceToken handles requests to /v2/device/token,
+// where grind polls to see if a device login has been approved.
+// Once it has, a new API token is created and returned, and the
+// device code cannot be used again.
+func PostDeviceToken(w http.ResponseWriter, tx *sql.Tx, code DeviceCode, render render.Render) {
+	login := new(deviceLogin)
+	if err := meddler.QueryRow(tx, login, `SELECT * FROM device_logins WHERE device_code_hash = $1`, hashAPIToken(code.DeviceCode)); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	now := time.Now()
+	status := login.Status
+	if status == DeviceLoginPending && now.After(login.ExpiresAt) {
+		status = DeviceLoginExpired
+	}
+	if status == DeviceLoginPending {
+		render.JSON(http.StatusOK, &DeviceToken{Status: status})
+		return
+	}
+
+	// the login is finished one way or another
+	if _, err := tx.Exec(`DELETE FROM device_logins WHERE id = $1`, login.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	result := &DeviceToken{Status: status}
+	if status == DeviceLoginApproved {
+		scopes := []string{APITokenScopeRead, APITokenScopeWrite}
+		token, err := newAPIToken(tx, login.UserID, "grind", scopes, time.Time{}, now)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		entry := auditAPIToken("token.create", token)
+		entry.ActorID = login.UserID
+		if err := recordAudit(tx, entry); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		result.Token = token
+	}
+	render.JSON(http.StatusOK, result)
+}
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Connect grind</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+input[type=text] { font-size: 1.5em; font-family: monospace; width: 10em; text-transform: uppercase; }
+</style>
+</head>
+<body>
+<h1>Connect grind</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Form}}<form method="POST" action="/v2/device">
+<p>You are signed in as {{.Name}} ({{.Email}}). Enter the code shown by grind:</p>
+<p><input type="text" name="user_code" value="{{.UserCode}}" autofocus></p>
+<input type="hidden" name="form_token" value="{{.FormToken}}">
+<p><button type="submit" name="action" value="approve">Connect</button>
+<button type="submit" name="action" value="deny">Cancel</button></p>
+</form>{{end}}
+</body>
+</html>
+`))
+
+type devicePage struct {
+	Message   string
+	Form      bool
+	Name      string
+	Email     string
+	UserCode  string
+	FormToken string
+}
+
+func renderDevicePage(w http.ResponseWriter, page *devicePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := deviceTemplate.Execute(w, page); err != nil {
+		loggedErrorf("error rendering device login page: %v", err)
+	}
+}
+
+// GetDevice handles requests to /v2/device,
+// showing the form where a signed-in user enters a user code.
+func GetDevice(w http.ResponseWriter, r *http.Request, currentUser *User, currentToken *APIToken) {
+	if currentToken != nil {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "this page must be loaded in a browser, not using an API token")
+		return
+	}
+	renderDevicePage(w, &devicePage{
+		Form:      true,
+		Name:      currentUser.Name,
+		Email:     currentUser.Email,
+		UserCode:  r.URL.Query().Get("user_code"),
+		FormToken: deviceFormToken(currentUser.ID),
+	})
+}
+
+// PostDevice handles requests to /v2/device,
+// approving or denying a device login for the current user.
+func PostDevice(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, currentToken *APIToken, audit *auditor) {
+	if currentToken != nil {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "this page must be loaded in a browser, not using an API token")
+		return
+	}
+	r.ParseForm()
+	if !hmac.Equal([]byte(r.Form.Get("form_token")), []byte(deviceFormToken(currentUser.ID))) {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "device login form token mismatch for user %d", currentUser.ID)
+		return
+	}
+	page := &devicePage{
+		Form:      true,
+		Name:      currentUser.Name,
+		Email:     currentUser.Email,
+		FormToken: deviceFormToken(currentUser.ID),
+	}
+
+	now := time.Now()
+	userCode := normalizeUserCode(r.Form.Get("user_code"))
+	login := new(deviceLogin)
+	if err := meddler.QueryRow(tx, login, `SELECT * FROM device_logins WHERE user_code = $1`, userCode); err != nil {
+		if err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		page.Message = "That code was not found. Check the code shown by grind and try again."
+		renderDevicePage(w, page)
+		return
+	}
+	if login.Status != DeviceLoginPending || now.After(login.ExpiresAt) {
+		page.Message = "That code has expired or was already used. Run grind init again to get a new one."
+		renderDevicePage(w, page)
+		return
+	}
+
+	login.UpdatedAt = now
+	if r.Form.Get("action") == "approve" {
+		login.Status = DeviceLoginApproved
+		login.UserID = currentUser.ID
+		page.Message = "grind is now connected. You can close this window and return to the terminal."
+	} else {
+		login.Status = DeviceLoginDenied
+		page.Message = "The request was cancelled and grind was not connected."
+	}
+	if err := meddler.Save(tx, "device_logins", login); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "device." + login.Status,
+		ObjectType: "device_login",
+		ObjectID:   login.ID,
+		Target:     login.UserCode,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("device login %s %s by user %d (%s)", login.UserCode, login.Status, currentUser.ID, currentUser.Email)
+	page.Form = false
+	renderDevicePage(w, page)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	. "github.com/russross/codegrinder/common"
+)
+
+var dockerClient *docker.Client
+
+func init() {
+	sandboxBackends["docker"] = newDockerSandbox
+}
+
+// setupDocker connects to the local docker daemon.
+func setupDocker() {
+	var err error
+	dockerClient, err = docker.NewVersionedClient("unix:///var/run/docker.sock", "1.23")
+	if err != nil {
+		log.Fatalf("NewVersionedClient: %v", err)
+	}
+	if err = dockerClient.Ping(); err != nil {
+		log.Fatalf("Ping: %v", err)
+	}
+}
+
+// dockerSandbox runs commands in a docker container.
+// The container runs sleep as its main process for the lifetime of the
+// sandbox and commands are launched inside it using exec.
+type dockerSandbox struct {
+	Container *docker.Container
+	UID       int64
+
+	// the most recent resource statistics from docker, which arrive about once per second
+	statsLock sync.Mutex
+	stats     *docker.Stats
+	peakPids  uint64
+	statsDone chan bool
+
+	// Shutdown can be called by several goroutines (timeouts, broken
+	// websockets, and the main handler), but must only run once
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// dockerUsage is a snapshot of the cumulative container counters used to
+// compute the resources used by a single exec.
+type dockerUsage struct {
+	read       time.Time
+	cpu        uint64
+	written    uint64
+	maxMemory  uint64
+	memoryFail uint64
+}
+
+func newDockerSandbox(image string, interactive bool, args []string, limits *limits, name string) (Sandbox, error) {
+	// create a container
+	mem := limits.maxMemory * 1024 * 1024
+	disk := limits.maxFileSize * 1024 * 1024
+	uid, err := allocUID()
+	if err != nil {
+		return nil, err
+	}
+
+	timeLimit := int64(sandboxTimeLimit(interactive, limits)/time.Second) + limits.maxIdle
+	config := &docker.Config{
+		Hostname:        name,
+		User:            uidgid(uid),
+		Memory:          int64(mem),
+		MemorySwap:      -1,
+		Cmd:             []string{"/bin/sleep", strconv.FormatInt(timeLimit, 10) + "s"},
+		Env:             sandboxEnv(args),
+		Image:           image,
+		NetworkDisabled: true,
+	}
+
+	hostConfig := &docker.HostConfig{
+		CapDrop: []string{
+			"NET_RAW",
+			"NET_BIND_SERVICE",
+			"AUDIT_READ",
+			"AUDIT_WRITE",
+			"DAC_OVERRIDE",
+			"SETFCAP",
+			"SETPCAP",
+			"SETGID",
+			"SETUID",
+			"MKNOD",
+			"CHOWN",
+			"FOWNER",
+			"FSETID",
+			"KILL",
+			"SYS_CHROOT",
+		},
+		PidsLimit: limits.maxThreads,
+		Ulimits: []docker.ULimit{
+			{Name: "core", Soft: 0, Hard: 0},
+			{Name: "cpu", Soft: limits.maxCPU, Hard: limits.maxCPU},
+			{Name: "data", Soft: mem, Hard: mem},
+			{Name: "fsize", Soft: disk, Hard: disk},
+			{Name: "memlock", Soft: 0, Hard: 0},
+			{Name: "nofile", Soft: limits.maxFD, Hard: limits.maxFD},
+			{Name: "nproc", Soft: limits.maxThreads, Hard: limits.maxThreads},
+			{Name: "stack", Soft: mem, Hard: mem},
+		},
+	}
+
+	container, err := dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: config, HostConfig: hostConfig})
+	if err != nil {
+		if err == docker.ErrContainerAlreadyExists {
+			// container already exists with that name--try killing it
+			log.Printf("killing existing container with same name %s", name)
+			err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+				ID:    name,
+				Force: true,
+			})
+			if err2 != nil {
+				log.Printf("error killing existing container with same name: %v", err2)
+				releaseUID(uid)
+				return nil, err2
+			}
+
+			// try it one more time
+			container, err = dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: config, HostConfig: hostConfig})
+		}
+		if err != nil {
+			log.Printf("CreateContainer: %v", err)
+			releaseUID(uid)
+			return nil, err
+		}
+	}
+
+	// start it
+	err = dockerClient.StartContainer(container.ID, nil)
+	if err != nil {
+		log.Printf("StartContainer: %v", err)
+		releaseUID(uid)
+		err2 := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    container.ID,
+			Force: true,
+		})
+		if err2 != nil {
+			log.Printf("RemoveContainer: %v", err2)
+		}
+		return nil, err
+	}
+
+	d := &dockerSandbox{
+		Container: container,
+		UID:       uid,
+		statsDone: make(chan bool),
+	}
+	go d.watchStats()
+	return d, nil
+}
+
+// watchStats records resource statistics for the container until it shuts down.
+func (d *dockerSandbox) watchStats() {
+	ch := make(chan *docker.Stats)
+	go func() {
+		err := dockerClient.Stats(docker.StatsOptions{
+			ID:     d.Container.ID,
+			Stats:  ch,
+			Stream: true,
+			Done:   d.statsDone,
+		})
+		if err != nil {
+			log.Printf("dockerSandbox stats: %v", err)
+		}
+	}()
+	for stats := range ch {
+		d.statsLock.Lock()
+		d.stats = stats
+		if stats.PidsStats.Current > d.peakPids {
+			d.peakPids = stats.PidsStats.Current
+		}
+		d.statsLock.Unlock()
+	}
+}
+
+// usage returns the current cumulative counters for the container.
+func (d *dockerSandbox) usage() dockerUsage {
+	d.statsLock.Lock()
+	defer d.statsLock.Unlock()
+
+	var u dockerUsage
+	if d.stats == nil {
+		return u
+	}
+	u.read = d.stats.Read
+	u.cpu = d.stats.CPUStats.CPUUsage.TotalUsage
+	for _, elt := range d.stats.BlkioStats.IOServiceBytesRecursive {
+		if elt.Op == "Write" {
+			u.written += elt.Value
+		}
+	}
+	u.maxMemory = d.stats.MemoryStats.MaxUsage
+	u.memoryFail = d.stats.MemoryStats.Failcnt
+	return u
+}
+
+// waitForStats waits briefly for a stats sample taken after the given time.
+func (d *dockerSandbox) waitForStats(after time.Time) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if d.usage().read.After(after) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (d *dockerSandbox) Shutdown() error {
+	d.shutdownOnce.Do(func() {
+		close(d.statsDone)
+		err := dockerClient.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    d.Container.ID,
+			Force: true,
+		})
+		releaseUID(d.UID)
+		if err != nil {
+			log.Printf("dockerSandbox.Shutdown: %v", err)
+			d.shutdownErr = err
+		}
+	})
+	return d.shutdownErr
+}
+
+// PutFiles copies a set of files to the container.
+// The container must be running.
+func (d *dockerSandbox) PutFiles(files map[string]string, mode int64) error {
+	// nothing to do?
+	if len(files) == 0 {
+		return nil
+	}
+
+	// tar the files
+	now := time.Now()
+	buf := new(bytes.Buffer)
+	writer := tar.NewWriter(buf)
+	dirs := make(map[string]bool)
+	for name, contents := range files {
+		dir := filepath.Dir(name)
+		if dir != "" && !dirs[dir] {
+			dirs[dir] = true
+			header := &tar.Header{
+				Name:       dir,
+				Mode:       0777,
+				Uid:        int(d.UID),
+				Gid:        int(d.UID),
+				Size:       0,
+				ModTime:    now,
+				Typeflag:   tar.TypeDir,
+				Uname:      strconv.FormatInt(d.UID, 10),
+				Gname:      strconv.FormatInt(d.UID, 10),
+				AccessTime: now,
+				ChangeTime: now,
+			}
+			if err := writer.WriteHeader(header); err != nil {
+				log.Printf("writing tar header for directory: %v", err)
+				return err
+			}
+		}
+		header := &tar.Header{
+			Name:       name,
+			Mode:       mode,
+			Uid:        int(d.UID),
+			Gid:        int(d.UID),
+			Size:       int64(len(contents)),
+			ModTime:    now,
+			Typeflag:   tar.TypeReg,
+			Uname:      strconv.FormatInt(d.UID, 10),
+			Gname:      strconv.FormatInt(d.UID, 10),
+			AccessTime: now,
+			ChangeTime: now,
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			log.Printf("writing tar header: %v", err)
+			return err
+		}
+		if _, err := writer.Write([]byte(contents)); err != nil {
+			log.Printf("writing to tar file: %v", err)
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("closing tar file: %v", err)
+		return err
+	}
+
+	// upload the archive
+	err := dockerClient.UploadToContainer(d.Container.ID, docker.UploadToContainerOptions{
+		InputStream:          buf,
+		Path:                 "/home/student",
+		NoOverwriteDirNonDir: true,
+	})
+
+	if err != nil {
+		log.Printf("unloading files to container: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetFiles copies a set of files from the container.
+// The container must be running.
+func (d *dockerSandbox) GetFiles(filenames []string) (map[string]string, error) {
+	// nothing to do?
+	if len(filenames) == 0 {
+		return nil, nil
+	}
+
+	// exec tar in the container
+	exec, err := dockerClient.CreateExec(docker.CreateExecOptions{
+		AttachStdin:  false,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          false,
+		Cmd:          append([]string{"/bin/tar", "cf", "-"}, filenames...),
+		Container:    d.Container.ID,
+		User:         uidgid(d.UID),
+	})
+	if err != nil {
+		log.Printf("GetFiles: creating exec command: %v", err)
+		return nil, err
+	}
+	tarFile := new(bytes.Buffer)
+	tarErr := new(bytes.Buffer)
+	err = dockerClient.StartExec(exec.ID, docker.StartExecOptions{
+		Detach:       false,
+		Tty:          false,
+		InputStream:  nil,
+		OutputStream: tarFile,
+		ErrorStream:  tarErr,
+		RawTerminal:  false,
+	})
+	if err != nil {
+		log.Printf("GetFiles: starting exec command: %v", err)
+		return nil, err
+	}
+
+	if tarErr.Len() != 0 {
+		log.Printf("GetFiles: tar error output: %q", tarErr.String())
+		return nil, fmt.Errorf("GetFiles: tar gave non-empty error output")
+	}
+
+	return untarFiles(tarFile)
+}
+
+// untarFiles extracts the regular files from a tar archive.
+func untarFiles(tarFile io.Reader) (map[string]string, error) {
+	files := make(map[string]string)
+	reader := tar.NewReader(tarFile)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("GetFiles: reading tar file header: %v", err)
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if header.Size == 0 {
+			files[header.Name] = ""
+			continue
+		}
+		contents := make([]byte, int(header.Size))
+		if _, err = io.ReadFull(reader, contents); err != nil {
+			log.Printf("GetFiles: reading tar file contents: %v", err)
+			return nil, err
+		}
+		files[header.Name] = string(contents)
+	}
+
+	return files, nil
+}
+
+// Exec runs a command in the container. Resource usage comes from the docker
+// stats stream, so it is only accurate to about a second. When a command fails
+// we wait for a fresh sample so that limits it hit are reported correctly.
+func (d *dockerSandbox) Exec(cmd []string, stdin io.Reader, stdout, stderr io.Writer, useTTY bool) (int, *ResourceUsage, error) {
+	// create
+	exec, err := dockerClient.CreateExec(docker.CreateExecOptions{
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          useTTY,
+		Cmd:          cmd,
+		Container:    d.Container.ID,
+		User:         uidgid(d.UID),
+	})
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// note the starting counters
+	before := d.usage()
+	d.statsLock.Lock()
+	d.peakPids = 0
+	d.statsLock.Unlock()
+
+	// start
+	err = dockerClient.StartExec(exec.ID, docker.StartExecOptions{
+		Detach:       false,
+		Tty:          useTTY,
+		InputStream:  stdin,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		RawTerminal:  useTTY,
+	})
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// inspect
+	inspect, err := dockerClient.InspectExec(exec.ID)
+	if err != nil {
+		return -1, nil, err
+	}
+	if inspect.Running {
+		return -1, nil, fmt.Errorf("process still running")
+	}
+
+	// gather resource usage
+	if inspect.ExitCode != 0 {
+		d.waitForStats(time.Now())
+	}
+	after := d.usage()
+	d.statsLock.Lock()
+	pids := d.peakPids
+	d.statsLock.Unlock()
+	usage := &ResourceUsage{
+		PeakMemory: int64(after.maxMemory),
+		Processes:  int64(pids),
+	}
+	if after.cpu > before.cpu {
+		usage.CPUSeconds = float64(after.cpu-before.cpu) / float64(time.Second)
+	}
+	if after.written > before.written {
+		usage.BytesWritten = int64(after.written - before.written)
+	}
+	if inspect.ExitCode != 0 && after.memoryFail > before.memoryFail {
+		usage.LimitHit = "memory"
+	}
+
+	return inspect.ExitCode, usage, nil
+}
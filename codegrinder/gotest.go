@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+// GoTestEvent is one line of output from go test -json
+type GoTestEvent struct {
+	Time    time.Time `json:"Time"`
+	Action  string    `json:"Action"`
+	Package string    `json:"Package"`
+	Test    string    `json:"Test"`
+	Elapsed float64   `json:"Elapsed"`
+	Output  string    `json:"Output"`
+}
+
+var testFailureContextGo = regexp.MustCompile(`(?m)^\s+([^\s:/]+\.go:\d+):`)
+
+func parseGoTestJSON(n *Nanny, contents string) {
+	type goTestResult struct {
+		outcome string
+		output  []string
+	}
+	results := make(map[string]*goTestResult)
+	var order []string
+	var packageOutput []string
+
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	scanner.Buffer(make([]byte, 64*1024), MaxDetailsLen)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		event := new(GoTestEvent)
+		if err := json.Unmarshal([]byte(line), event); err != nil {
+			// go test passes build errors through as plain text
+			packageOutput = append(packageOutput, line+"\n")
+			continue
+		}
+		if event.Test == "" {
+			if event.Action == "output" || event.Action == "build-output" {
+				packageOutput = append(packageOutput, event.Output)
+			}
+			continue
+		}
+		result := results[event.Test]
+		if result == nil {
+			result = new(goTestResult)
+			results[event.Test] = result
+			order = append(order, event.Test)
+		}
+		switch event.Action {
+		case "output":
+			// skip the progress lines that go test adds around each test
+			trimmed := strings.TrimSpace(event.Output)
+			if strings.HasPrefix(trimmed, "=== ") || strings.HasPrefix(trimmed, "--- ") {
+				continue
+			}
+			result.output = append(result.output, event.Output)
+		case "pass", "fail", "skip":
+			result.outcome = event.Action
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		n.ReportCard.LogAndFailf("error parsing unit test results: %v", err)
+		return
+	}
+
+	// only report on leaf tests; a parent passes or fails with its subtests
+	parents := make(map[string]bool)
+	for _, name := range order {
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			parents[name[:i]] = true
+		}
+	}
+	sort.Strings(order)
+	var leaves []string
+	for _, name := range order {
+		if !parents[name] {
+			leaves = append(leaves, name)
+		}
+	}
+
+	if len(leaves) == 0 {
+		details := strings.Join(packageOutput, "")
+		if len(details) > MaxDetailsLen {
+			details = details[:MaxDetailsLen]
+		}
+		ctx := ""
+		if groups := testFailureContextGo.FindStringSubmatch(details); len(groups) > 1 {
+			ctx = groups[1]
+		}
+		n.ReportCard.AddFailedResult("build", details, ctx)
+		n.ReportCard.Note = "No tests were run; the code may have failed to build"
+		return
+	}
+
+	// form a report card
+	passed, fails := 0, 0
+	for _, name := range leaves {
+		result := results[name]
+		details := strings.Join(result.output, "")
+		if len(details) > MaxDetailsLen {
+			details = details[:MaxDetailsLen]
+		}
+		switch result.outcome {
+		case "pass":
+			passed++
+			n.ReportCard.AddPassedResult(name, "")
+		case "skip":
+			n.ReportCard.Results = append(n.ReportCard.Results, &ReportCardResult{
+				Name:    name,
+				Outcome: "skipped",
+				Details: details,
+			})
+		default:
+			// a test with no outcome was cut off, probably by a panic or timeout
+			fails++
+			ctx := ""
+			if groups := testFailureContextGo.FindStringSubmatch(details); len(groups) > 1 {
+				ctx = groups[1]
+			}
+			n.ReportCard.AddFailedResult(name, details, ctx)
+		}
+	}
+	n.ReportCard.Note = fmt.Sprintf("Passed %d/%d tests in %v",
+		passed, len(leaves), time.Since(n.Start))
+	n.ReportCard.Passed = n.ReportCard.Passed && fails == 0
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+const (
+	gradePostPollInterval = 15 * time.Second
+	gradePostBatchSize    = 25
+	gradePostMinBackoff   = 30 * time.Second
+	gradePostMaxBackoff   = time.Hour
+	gradePostMaxAttempts  = 30
+	gradePostClaimTimeout = 5 * time.Minute
+)
+
+// enqueueGradePost adds a grade post for the given assignment to the outbox.
+// It should be called in the same transaction that updates the score.
+// The worker always sends the current score, so any older posts for the
+// same assignment that are still pending are superseded by this one.
+// A post with no text keeps the text of the post it supersedes, so
+// re-posting a score does not drop the grading report that came with it.
+// Failed posts are kept so they can be found and retried.
+func enqueueGradePost(tx *sql.Tx, asst *Assignment, text string, now time.Time) error {
+	rows, err := tx.Query(`DELETE FROM grade_posts WHERE assignment_id = $1 AND status = $2 RETURNING text`, asst.ID, GradePostPending)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var old string
+		if err := rows.Scan(&old); err != nil {
+			return err
+		}
+		if text == "" {
+			text = old
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	post := &GradePost{
+		AssignmentID:  asst.ID,
+		Text:          text,
+		Status:        GradePostPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	return meddler.Insert(tx, "grade_posts", post)
+}
+
+// gradePostWorker drains the outbox of grade posts forever,
+// retrying failed posts with exponential backoff.
+func gradePostWorker(db *sql.DB) {
+	for {
+		for {
+			n, err := sendGradePosts(db)
+			if err != nil {
+				log.Printf("error sending grade posts: %v", err)
+			}
+			if err != nil || n < gradePostBatchSize {
+				break
+			}
+		}
+		time.Sleep(gradePostPollInterval)
+	}
+}
+
+// sendGradePosts attempts every grade post that is due, returning the
+// number of posts attempted.
+//
+// Posts are claimed before they are sent by pushing their next attempt
+// time into the future, so other TA processes will not send them too.
+// If this process dies before finishing, the claim runs out and the
+// posts are sent again.
+func sendGradePosts(db *sql.DB) (int, error) {
+	now := time.Now()
+	posts := []*GradePost{}
+	if err := meddler.QueryAll(db, &posts, `UPDATE grade_posts SET next_attempt_at = $1 `+
+		`WHERE id IN (SELECT id FROM grade_posts WHERE status = $2 AND next_attempt_at <= $3 ORDER BY next_attempt_at LIMIT $4) `+
+		`AND status = $2 AND next_attempt_at <= $3 RETURNING *`,
+		now.Add(gradePostClaimTimeout), GradePostPending, now, gradePostBatchSize); err != nil {
+		return 0, err
+	}
+
+	for _, post := range posts {
+		err := sendGradePost(db, post)
+		now := time.Now()
+		post.Attempts++
+		post.UpdatedAt = now
+		if err == nil {
+			post.Status = GradePostPosted
+			post.LastError = ""
+			post.PostedAt = now
+		} else {
+			post.LastError = err.Error()
+			if post.Attempts >= gradePostMaxAttempts {
+				log.Printf("giving up on grade post %d for assignment %d after %d attempts", post.ID, post.AssignmentID, post.Attempts)
+				post.Status = GradePostFailed
+			} else {
+				backoff := gradePostMinBackoff
+				for i := 1; i < post.Attempts && backoff < gradePostMaxBackoff; i++ {
+					backoff *= 2
+				}
+				if backoff > gradePostMaxBackoff {
+					backoff = gradePostMaxBackoff
+				}
+				log.Printf("grade post %d for assignment %d failed (attempt %d/%d), will try again in %v",
+					post.ID, post.AssignmentID, post.Attempts, gradePostMaxAttempts, backoff)
+				post.NextAttemptAt = now.Add(backoff)
+			}
+		}
+		if err := meddler.Update(db, "grade_posts", post); err != nil {
+			return len(posts), err
+		}
+	}
+
+	return len(posts), nil
+}
+
+// sendGradePost posts the current score of the assignment to the LMS.
+func sendGradePost(db *sql.DB, post *GradePost) error {
+	asst := new(Assignment)
+	if err := meddler.Load(db, "assignments", asst, post.AssignmentID); err != nil {
+		return err
+	}
+	user := new(User)
+	if err := meddler.Load(db, "users", user, asst.UserID); err != nil {
+		return err
+	}
+	if asst.PlatformID != 0 {
+		return saveGradeAGS(db, asst, user)
+	}
+	secret, err := getLTISecret(db, asst.ConsumerKey)
+	if err != nil {
+		return err
+	}
+	return saveGrade(asst, user, secret, post.Text)
+}
+
+// GetGradePosts handles requests to /v2/grade_posts,
+// returning a list of grade posts in the outbox.
+// If parameter status=<...> is present, results will be filtered by status (pending, posted, or failed).
+// If parameter assignment_id=<...> is present, results will be filtered by assignment.
+func GetGradePosts(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := ""
+	args := []interface{}{}
+
+	if status := r.FormValue("status"); status != "" {
+		where, args = addWhereEq(where, args, "status", status)
+	}
+
+	if assignmentID := r.FormValue("assignment_id"); assignmentID != "" {
+		id, err := parseID(w, "assignment_id", assignmentID)
+		if err != nil {
+			return
+		}
+		where, args = addWhereEq(where, args, "assignment_id", id)
+	}
+
+	posts := []*GradePost{}
+	if err := meddler.QueryAll(tx, &posts, `SELECT * FROM grade_posts`+where+` ORDER BY id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, posts)
+}
+
+// PostGradePostRetry handles requests to /v2/grade_posts/:grade_post_id/retry,
+// putting a failed grade post back in the queue to be sent right away.
+func PostGradePostRetry(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor, render render.Render) {
+	postID, err := parseID(w, "grade_post_id", params["grade_post_id"])
+	if err != nil {
+		return
+	}
+
+	post := new(GradePost)
+	if err := meddler.Load(tx, "grade_posts", post, postID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if post.Status == GradePostPosted {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "grade post %d has already been posted", post.ID)
+		return
+	}
+
+	var courseID int64
+	if err := tx.QueryRow(`SELECT course_id FROM assignments WHERE id = $1`, post.AssignmentID).Scan(&courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	before := *post
+
+	now := time.Now()
+	post.Status = GradePostPending
+	post.Attempts = 0
+	post.NextAttemptAt = now
+	post.UpdatedAt = now
+	if err := meddler.Update(tx, "grade_posts", post); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "grade_post.retry",
+		ObjectType: "grade_post",
+		ObjectID:   post.ID,
+		CourseID:   courseID,
+		Target:     fmt.Sprintf("assignment %d", post.AssignmentID),
+		Before:     &before,
+		After:      post,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, post)
+}
+
+// PostCourseGradePosts handles requests to /v2/courses/:course_id/grade_posts,
+// queuing a new grade post for every student assignment in the course.
+func PostCourseGradePosts(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments WHERE course_id = $1 AND NOT instructor AND (grade_id IS NOT NULL OR line_item_url <> '') ORDER BY id`,
+		courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	now := time.Now()
+	posts := []*GradePost{}
+	for _, asst := range assignments {
+		if err := enqueueGradePost(tx, asst, "", now); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	if err := meddler.QueryAll(tx, &posts, `SELECT grade_posts.* FROM grade_posts JOIN assignments ON grade_posts.assignment_id = assignments.id `+
+		`WHERE assignments.course_id = $1 AND grade_posts.status = $2 ORDER BY grade_posts.id`, courseID, GradePostPending); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) queued %d grade posts for course %d", currentUser.ID, currentUser.Email, len(assignments), courseID)
+	assignmentIDs := []int64{}
+	for _, asst := range assignments {
+		assignmentIDs = append(assignmentIDs, asst.ID)
+	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "grade_post.course",
+		ObjectType: "course",
+		ObjectID:   courseID,
+		CourseID:   courseID,
+		Target:     fmt.Sprintf("%d grade posts", len(assignments)),
+		After:      map[string]interface{}{"assignmentIDs": assignmentIDs},
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, posts)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"path"
+	"regexp"
+	"strings"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+// Hidden files are test files that the daycare adds when grading but that
+// students never see. The TA strips them from problem steps sent to students,
+// and seals them in commit bundles so the daycare can recover them.
+
+// HiddenDetails replaces the details of a failed test that comes from a hidden file.
+const HiddenDetails = "This is a hidden test, so its details are not available."
+
+// hiddenOutputNotice replaces the output of a grading run that used hidden files,
+// since test frameworks print the assertions of failing tests.
+const hiddenOutputNotice = "This step has hidden tests, so the output from grading is not shown.\n"
+
+// sealKey derives the key used to seal hidden files from the daycare secret.
+func sealKey() []byte {
+	mac := hmac.New(sha256.New, []byte(Config.DaycareSecret))
+	mac.Write([]byte("codegrinder sealed hidden files"))
+	return mac.Sum(nil)
+}
+
+// sealHiddenFiles replaces the hidden files in each step with an encrypted copy.
+func sealHiddenFiles(steps []*ProblemStep) error {
+	for _, step := range steps {
+		if len(step.HiddenFiles) == 0 {
+			step.HiddenFiles = nil
+			continue
+		}
+		raw, err := json.Marshal(step.HiddenFiles)
+		if err != nil {
+			return err
+		}
+		block, err := aes.NewCipher(sealKey())
+		if err != nil {
+			return err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		sealed := gcm.Seal(nonce, nonce, raw, nil)
+		step.SealedFiles = base64.StdEncoding.EncodeToString(sealed)
+		step.HiddenFiles = nil
+	}
+	return nil
+}
+
+// unsealHiddenFiles restores the hidden files in each step from their encrypted copy.
+func unsealHiddenFiles(steps []*ProblemStep) error {
+	for _, step := range steps {
+		if step.SealedFiles == "" {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(step.SealedFiles)
+		if err != nil {
+			return fmt.Errorf("decoding sealed files for step %d: %v", step.Step, err)
+		}
+		block, err := aes.NewCipher(sealKey())
+		if err != nil {
+			return err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		if len(sealed) < gcm.NonceSize() {
+			return fmt.Errorf("sealed files for step %d are too short", step.Step)
+		}
+		raw, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+		if err != nil {
+			return fmt.Errorf("unsealing files for step %d: %v", step.Step, err)
+		}
+		files := make(map[string]string)
+		if err := json.Unmarshal(raw, &files); err != nil {
+			return fmt.Errorf("decoding unsealed files for step %d: %v", step.Step, err)
+		}
+		step.HiddenFiles = files
+	}
+	return nil
+}
+
+// stripHiddenFiles removes hidden files from steps that are being sent to a student.
+func stripHiddenFiles(steps []*ProblemStep) {
+	for _, step := range steps {
+		step.HiddenFiles = nil
+		step.SealedFiles = ""
+	}
+}
+
+// redactHiddenResults removes the details of failed tests that mention a
+// hidden file, so the report card does not give away what they test.
+// Tests are matched by the name of the hidden file with its extension removed,
+// which is how most frameworks name the test class or module.
+func redactHiddenResults(card *ReportCard, hidden map[string]string) {
+	if len(hidden) == 0 {
+		return
+	}
+	var stems []string
+	for name := range hidden {
+		base := path.Base(name)
+		stem := strings.TrimSuffix(base, path.Ext(base))
+		if stem != "" {
+			stems = append(stems, stem)
+		}
+	}
+	for _, result := range card.Results {
+		if result.Outcome == "passed" {
+			continue
+		}
+		for _, stem := range stems {
+			if strings.Contains(result.Name, stem) || strings.Contains(result.Details, stem) || strings.Contains(result.Context, stem) {
+				result.Details = HiddenDetails
+				result.Context = ""
+				break
+			}
+		}
+	}
+}
+
+// stepHasHiddenFiles returns true if a step has hidden files, either in
+// the clear or sealed for the daycare.
+func stepHasHiddenFiles(step *ProblemStep) bool {
+	return len(step.HiddenFiles) > 0 || step.SealedFiles != ""
+}
+
+// markup found in test details, such as the diffs from writeDiffHTML
+var (
+	detailsInsert  = regexp.MustCompile(`<ins[^>]*>`)
+	detailsDelete  = regexp.MustCompile(`<del[^>]*>`)
+	detailsHeading = regexp.MustCompile(`</h\d>`)
+	detailsTag     = regexp.MustCompile(`<[^>]*>`)
+)
+
+// detailsText gives the details of a test result as plain text. Details
+// that hold HTML have their tags removed, with insertions and deletions in
+// a diff marked as {+added+} and [-removed-].
+func detailsText(details string) string {
+	if !strings.Contains(details, "<") {
+		return details
+	}
+	details = detailsInsert.ReplaceAllString(details, "{+")
+	details = strings.Replace(details, "</ins>", "+}", -1)
+	details = detailsDelete.ReplaceAllString(details, "[-")
+	details = strings.Replace(details, "</del>", "-]", -1)
+	details = detailsHeading.ReplaceAllString(details, "\n")
+	details = detailsTag.ReplaceAllString(details, "")
+	details = strings.Replace(details, "↩", "", -1)
+	return html.UnescapeString(details)
+}
+
+// summarizeReportCard describes the results in a report card as plain text.
+// It is used in place of the raw output of a grading run wherever that
+// output could reveal hidden tests, so it should only be called after
+// redactHiddenResults.
+func summarizeReportCard(card *ReportCard) string {
+	var out bytes.Buffer
+	if card.Note != "" {
+		fmt.Fprintf(&out, "%s\n", card.Note)
+	}
+	for _, result := range card.Results {
+		fmt.Fprintf(&out, "%s: %s\n", result.Outcome, result.Name)
+		if result.Outcome != "passed" && result.Details != "" {
+			for _, line := range strings.Split(strings.TrimRight(detailsText(result.Details), "\n"), "\n") {
+				fmt.Fprintf(&out, "    %s\n", line)
+			}
+		}
+	}
+	return out.String()
+}
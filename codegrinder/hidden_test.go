@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+func TestSummarizeReportCard(t *testing.T) {
+	var diff bytes.Buffer
+	writeDiffHTML(&diff, "a < b\n", "a > b\n", "Differences for test 1")
+
+	card := NewReportCard()
+	card.AddPassedResult("test 0", "<h1>unused</h1>")
+	card.AddFailedResult("test 1", diff.String(), "")
+	card.AddFailedResult("test 2", "expected 1, got 2\n", "")
+	summary := summarizeReportCard(card)
+
+	for _, tag := range []string{"<pre>", "<span>", "<del", "<ins", "&lt;"} {
+		if strings.Contains(summary, tag) {
+			t.Errorf("summary still contains markup %q:\n%s", tag, summary)
+		}
+	}
+	for _, want := range []string{
+		"passed: test 0\n",
+		"failed: test 1\n    Differences for test 1\n",
+		"a [-<-]{+>+} b",
+		"failed: test 2\n    expected 1, got 2\n",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary does not contain %q:\n%s", want, summary)
+		}
+	}
+	if strings.Contains(summary, "unused") {
+		t.Errorf("summary includes details of a passed test:\n%s", summary)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+const impersonationTimeout = time.Hour
+
+// impersonationForbiddenPaths can never be used while impersonating,
+// so credentials are never issued for an impersonated user.
+var impersonationForbiddenPaths = []string{
+	"/v2/users/me/tokens",
+	"/v2/device",
+	"/v2/impersonations",
+}
+
+// changesRoles reports whether a request would grant or revoke roles,
+// i.e., it is a write to any path with a roles segment
+// (/v2/roles, /v2/courses/:course_id/roles, etc.).
+func changesRoles(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return false
+	}
+	for _, segment := range strings.Split(r.URL.Path, "/") {
+		if segment == "roles" {
+			return true
+		}
+	}
+	return false
+}
+
+// impersonate checks the impersonation named in a request header and
+// loads the impersonated user and their roles in place of the administrator.
+// Every request is recorded in the audit log, including refused ones.
+func impersonate(w http.ResponseWriter, r *http.Request, tx *sql.Tx, db meddler.DB, admin *User, adminRoles *Roles, header string) (*Impersonation, *User, *Roles, bool) {
+	id, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s header: %v", ImpersonationHeader, err)
+		return nil, nil, nil, false
+	}
+	imp := new(Impersonation)
+	if err := meddler.Load(tx, "impersonations", imp, id); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, nil, nil, false
+	}
+	entry := &AuditEntry{
+		ActorID:         admin.ID,
+		UserID:          imp.UserID,
+		ImpersonationID: imp.ID,
+		Action:          "impersonation.request",
+		Target:          r.Method + " " + r.URL.Path,
+	}
+	refuse := func(status int, format string, params ...interface{}) (*Impersonation, *User, *Roles, bool) {
+		entry.Action = "impersonation.refused"
+		recordAudit(db, entry)
+		loggedHTTPErrorf(w, status, format, params...)
+		return nil, nil, nil, false
+	}
+
+	now := time.Now()
+	if imp.AdminID != admin.ID || !adminRoles.Has(RoleAdmin) {
+		return refuse(http.StatusUnauthorized, "user %d (%s) cannot use impersonation %d", admin.ID, admin.Email, imp.ID)
+	}
+	if !imp.EndedAt.IsZero() || now.After(imp.ExpiresAt) {
+		return refuse(http.StatusUnauthorized, "impersonation %d has ended", imp.ID)
+	}
+	for _, path := range impersonationForbiddenPaths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			return refuse(http.StatusForbidden, "%s cannot be used while impersonating", path)
+		}
+	}
+	if changesRoles(r) {
+		return refuse(http.StatusForbidden, "roles cannot be changed while impersonating")
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && !imp.AllowWrites {
+		return refuse(http.StatusForbidden, "impersonation %d is read-only", imp.ID)
+	}
+
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, imp.UserID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return nil, nil, nil, false
+	}
+	roles, err := loadRoles(tx, user)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading roles: %v", err)
+		return nil, nil, nil, false
+	}
+	user.Admin = roles.Global[RoleAdmin]
+	user.Author = roles.Global[RoleAuthor]
+
+	if err := recordAudit(db, entry); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "refusing impersonated request that could not be audited")
+		return nil, nil, nil, false
+	}
+	return imp, user, roles, true
+}
+
+// impersonationNote marks a commit saved during an impersonation.
+func impersonationNote(imp *Impersonation) string {
+	return fmt.Sprintf("[saved by administrator %d while impersonating this user (impersonation %d)]", imp.AdminID, imp.ID)
+}
+
+// GetImpersonations handles requests to /v2/impersonations,
+// returning the impersonations started by the current administrator.
+// If parameter active=true is present, only current impersonations are returned.
+func GetImpersonations(w http.ResponseWriter, r *http.Request, tx *sql.Tx, currentUser *User, render render.Render) {
+	imps := []*Impersonation{}
+	query := `SELECT * FROM impersonations WHERE admin_id = $1`
+	args := []interface{}{currentUser.ID}
+	if active := r.FormValue("active"); active != "" {
+		val, err := strconv.ParseBool(active)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing active value as boolean: %v", err)
+			return
+		}
+		if val {
+			query += ` AND ended_at IS NULL AND expires_at > $2`
+			args = append(args, time.Now())
+		}
+	}
+	if err := meddler.QueryAll(tx, &imps, query+` ORDER BY id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, imps)
+}
+
+// PostImpersonation handles requests to /v2/impersonations,
+// starting an impersonation of another user. If the administrator already
+// has a matching impersonation of the same user in progress, it is returned
+// instead of starting a new one.
+func PostImpersonation(w http.ResponseWriter, tx *sql.Tx, currentUser *User, imp Impersonation, render render.Render) {
+	if imp.UserID == currentUser.ID {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "you cannot impersonate yourself")
+		return
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, imp.UserID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	now := time.Now()
+	existing := new(Impersonation)
+	err := meddler.QueryRow(tx, existing, `SELECT * FROM impersonations `+
+		`WHERE admin_id = $1 AND user_id = $2 AND allow_writes = $3 AND ended_at IS NULL AND expires_at > $4 `+
+		`ORDER BY id DESC LIMIT 1`, currentUser.ID, imp.UserID, imp.AllowWrites, now)
+	if err == nil {
+		render.JSON(http.StatusOK, existing)
+		return
+	}
+	if err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	imp.ID = 0
+	imp.AdminID = currentUser.ID
+	imp.Reason = strings.TrimSpace(imp.Reason)
+	imp.ExpiresAt = now.Add(impersonationTimeout)
+	imp.EndedAt = time.Time{}
+	imp.CreatedAt = now
+	if err := meddler.Insert(tx, "impersonations", &imp); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	mode := "read-only"
+	if imp.AllowWrites {
+		mode = "read-write"
+	}
+	if err := recordAudit(tx, &AuditEntry{
+		ActorID:         currentUser.ID,
+		UserID:          user.ID,
+		ImpersonationID: imp.ID,
+		Action:          "impersonation.start",
+		ObjectType:      "impersonation",
+		ObjectID:        imp.ID,
+		Target:          fmt.Sprintf("user %d (%s), %s: %s", user.ID, user.Email, mode, imp.Reason),
+		CreatedAt:       now,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) started %s impersonation %d of user %d (%s)",
+		currentUser.ID, currentUser.Email, mode, imp.ID, user.ID, user.Email)
+	render.JSON(http.StatusOK, &imp)
+}
+
+// DeleteImpersonation handles requests to /v2/impersonations/:impersonation_id,
+// ending an impersonation before it expires.
+func DeleteImpersonation(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User) {
+	impID, err := parseID(w, "impersonation_id", params["impersonation_id"])
+	if err != nil {
+		return
+	}
+	imp := new(Impersonation)
+	if err := meddler.QueryRow(tx, imp, `SELECT * FROM impersonations WHERE id = $1 AND admin_id = $2`, impID, currentUser.ID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !imp.EndedAt.IsZero() {
+		return
+	}
+	now := time.Now()
+	imp.EndedAt = now
+	if err := meddler.Save(tx, "impersonations", imp); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := recordAudit(tx, &AuditEntry{
+		ActorID:         currentUser.ID,
+		UserID:          imp.UserID,
+		ImpersonationID: imp.ID,
+		Action:          "impersonation.end",
+		ObjectType:      "impersonation",
+		ObjectID:        imp.ID,
+		Target:          fmt.Sprintf("user %d", imp.UserID),
+		CreatedAt:       now,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) ended impersonation %d", currentUser.ID, currentUser.Email, imp.ID)
+}
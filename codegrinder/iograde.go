@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+// I/O grading runs the student program once for each file in the in/
+// directory of a problem step and compares its output to the file with the
+// same name in the out/ directory. It works with any problem type, and is
+// selected by adding these options to a problem:
+//
+//	grader=io             grade using in/ and out/ instead of unit tests
+//	iocommand=./a.out     the command to run for each case (default "make -s iorun")
+//	iocompare=exact       compare output exactly (the default)
+//	iocompare=whitespace  ignore differences in spacing and blank lines
+//	iocompare=numeric     compare numbers using iotolerance
+//	iotolerance=1e-6      largest allowed difference between numbers
+const (
+	ioInputDir         = "in/"
+	ioOutputDir        = "out/"
+	ioDefaultTolerance = 1e-6
+)
+
+// ioDefaultCommand uses a Makefile target that runs the program without
+// prompts or an interactive shell, and -s keeps make from echoing the
+// commands it runs into the output being compared.
+var ioDefaultCommand = []string{"make", "-s", "iorun"}
+
+type ioOptions struct {
+	command   []string
+	compare   string
+	tolerance float64
+}
+
+// parseIOOptions extracts the I/O grading settings from a problem's options.
+// It returns nil if I/O grading was not requested.
+func parseIOOptions(options []string) (*ioOptions, error) {
+	opts := &ioOptions{
+		command:   ioDefaultCommand,
+		compare:   "exact",
+		tolerance: ioDefaultTolerance,
+	}
+	requested := false
+	for _, elt := range options {
+		parts := strings.SplitN(elt, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "grader":
+			requested = val == "io"
+		case "iocommand":
+			opts.command = strings.Fields(val)
+			if len(opts.command) == 0 {
+				return nil, fmt.Errorf("iocommand option cannot be empty")
+			}
+		case "iocompare":
+			switch val {
+			case "exact", "whitespace", "numeric":
+				opts.compare = val
+			default:
+				return nil, fmt.Errorf("unknown iocompare option %q: must be exact, whitespace, or numeric", val)
+			}
+		case "iotolerance":
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil || f < 0 {
+				return nil, fmt.Errorf("invalid iotolerance option %q", val)
+			}
+			opts.tolerance = f
+		}
+	}
+	if !requested {
+		return nil, nil
+	}
+	return opts, nil
+}
+
+// runAndCompareIO runs each I/O test case and records one result per case.
+func runAndCompareIO(n *Nanny, options *ioOptions, files map[string]string) {
+	var names []string
+	for name := range files {
+		if strings.HasPrefix(name, ioInputDir) {
+			names = append(names, name[len(ioInputDir):])
+		}
+	}
+	if len(names) == 0 {
+		n.ReportCard.LogAndFailf("I/O grading requested, but no input files found in %s", ioInputDir)
+		return
+	}
+	sort.Strings(names)
+
+	passed := 0
+	for _, name := range names {
+		expected, present := files[ioOutputDir+name]
+		if !present {
+			n.ReportCard.LogAndFailf("no expected output file %s%s for input file %s%s", ioOutputDir, name, ioInputDir, name)
+			return
+		}
+
+		stdout, stderr, _, status, err := n.Exec(options.command, strings.NewReader(files[ioInputDir+name]), false)
+		if err != nil {
+			n.ReportCard.LogAndFailf("Error running test case %s: %v", name, err)
+			return
+		}
+		switch {
+		case status != 0:
+			details := fmt.Sprintf("%s failed with exit status %d\n\n%s", options.command[0], status, stderr.String())
+			if len(details) > MaxDetailsLen {
+				details = details[:MaxDetailsLen]
+			}
+			n.ReportCard.AddFailedResult(name, details, ioInputDir+name)
+		case !compareIO(options, expected, stdout.String()):
+			var diff bytes.Buffer
+			writeDiffHTML(&diff, expected, stdout.String(), "Differences between expected and actual output for "+name)
+			n.ReportCard.AddFailedResult(name, diff.String(), ioInputDir+name)
+		default:
+			passed++
+			n.ReportCard.AddPassedResult(name, "")
+		}
+	}
+
+	log.Printf("passed %d/%d I/O test cases", passed, len(names))
+	n.ReportCard.Note = fmt.Sprintf("Passed %d/%d tests in %v", passed, len(names), time.Since(n.Start))
+	n.ReportCard.Passed = passed == len(names)
+}
+
+// compareIO checks if actual output matches the expected output.
+func compareIO(options *ioOptions, expected, actual string) bool {
+	switch options.compare {
+	case "whitespace":
+		return strings.Join(strings.Fields(expected), " ") == strings.Join(strings.Fields(actual), " ")
+	case "numeric":
+		want, got := strings.Fields(expected), strings.Fields(actual)
+		if len(want) != len(got) {
+			return false
+		}
+		for i := range want {
+			if want[i] == got[i] {
+				continue
+			}
+			a, aerr := strconv.ParseFloat(want[i], 64)
+			b, berr := strconv.ParseFloat(got[i], 64)
+			if aerr != nil || berr != nil || math.IsNaN(a) || math.IsNaN(b) {
+				return false
+			}
+
+			// accept numbers within the tolerance, either absolute or relative
+			diff := math.Abs(a - b)
+			if diff > options.tolerance && diff > options.tolerance*math.Max(math.Abs(a), math.Abs(b)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return expected == actual
+	}
+}
@@ -0,0 +1,414 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+// The local sandbox runs student code as ordinary processes on the daycare host.
+// Each sandbox gets a private UID and a temporary home directory, and every
+// command is started through a small helper (this binary re-executed with
+// localSandboxHelper as its first argument) that applies rlimits before
+// handing control to the real command.
+//
+// This is much weaker isolation than docker provides: there is no network or
+// filesystem isolation beyond ordinary Unix permissions, no TTY support, and
+// no per-sandbox memory accounting. It is intended for trusted deployments and
+// for exercising the grading pipeline on hosts without a docker daemon.
+// The daycare must run as root so it can switch UIDs.
+
+const localSandboxHelper = "codegrinder-local-sandbox"
+
+// RLIMIT_NPROC is missing from the syscall package
+const rlimitNPROC = 6
+
+// the helper is started by re-executing the running daycare binary
+const selfExe = "/proc/self/exe"
+
+func init() {
+	sandboxBackends["local"] = newLocalSandbox
+
+	if len(os.Args) > 1 && os.Args[1] == localSandboxHelper {
+		localSandboxHelperMain(os.Args[2:])
+	}
+}
+
+type localSandbox struct {
+	sync.Mutex
+	Dir    string
+	UID    int64
+	Env    []string
+	Limits *limits
+	Timer  *time.Timer
+	Closed bool
+}
+
+func newLocalSandbox(image string, interactive bool, args []string, limits *limits, name string) (Sandbox, error) {
+	uid, err := allocUID()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", name+"-")
+	if err != nil {
+		log.Printf("creating local sandbox directory: %v", err)
+		releaseUID(uid)
+		return nil, err
+	}
+	if err = os.Chown(dir, int(uid), int(uid)); err != nil {
+		log.Printf("setting owner of local sandbox directory: %v", err)
+		os.RemoveAll(dir)
+		releaseUID(uid)
+		return nil, err
+	}
+
+	env := []string{"PATH=/usr/local/bin:/usr/bin:/bin"}
+	for _, elt := range sandboxEnv(args) {
+		if strings.HasPrefix(elt, "HOME=") {
+			elt = "HOME=" + dir
+		}
+		env = append(env, elt)
+	}
+
+	s := &localSandbox{
+		Dir:    dir,
+		UID:    uid,
+		Env:    env,
+		Limits: limits,
+	}
+
+	// enforce the overall time limit the same way the docker backend does
+	timeLimit := sandboxTimeLimit(interactive, limits) + time.Duration(limits.maxIdle)*time.Second
+	s.Timer = time.AfterFunc(timeLimit, func() {
+		log.Printf("local sandbox %s timed out", name)
+		s.killAll()
+	})
+
+	return s, nil
+}
+
+// path returns the full path of a file inside the sandbox, making sure that
+// neither the name nor any symlinks in its parent directories escape it.
+func (s *localSandbox) path(name string) (string, error) {
+	clean := filepath.Clean(name)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid file name in local sandbox: %q", name)
+	}
+	full := filepath.Join(s.Dir, clean)
+	parent, err := filepath.EvalSymlinks(filepath.Dir(full))
+	if err != nil {
+		return "", err
+	}
+	if parent != s.Dir && !strings.HasPrefix(parent, s.Dir+"/") {
+		return "", fmt.Errorf("file %q is outside the local sandbox", name)
+	}
+	return filepath.Join(parent, filepath.Base(full)), nil
+}
+
+// PutFiles copies a set of files into the sandbox directory.
+func (s *localSandbox) PutFiles(files map[string]string, mode int64) error {
+	for name, contents := range files {
+		// create the parent directory, one level at a time so each is owned by the sandbox user
+		dir := filepath.Dir(filepath.Clean(name))
+		if dir != "." {
+			parts := strings.Split(dir, "/")
+			for i := range parts {
+				sub, err := s.path(strings.Join(parts[:i+1], "/"))
+				if err != nil {
+					log.Printf("PutFiles: %v", err)
+					return err
+				}
+				if err = os.Mkdir(sub, 0777); err != nil {
+					if os.IsExist(err) {
+						continue
+					}
+					log.Printf("PutFiles: creating directory: %v", err)
+					return err
+				}
+				if err = os.Lchown(sub, int(s.UID), int(s.UID)); err != nil {
+					log.Printf("PutFiles: setting directory owner: %v", err)
+					return err
+				}
+			}
+		}
+
+		full, err := s.path(name)
+		if err != nil {
+			log.Printf("PutFiles: %v", err)
+			return err
+		}
+		fp, err := os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, os.FileMode(mode))
+		if err != nil {
+			log.Printf("PutFiles: creating file: %v", err)
+			return err
+		}
+		if _, err = fp.WriteString(contents); err != nil {
+			fp.Close()
+			log.Printf("PutFiles: writing file: %v", err)
+			return err
+		}
+		if err = fp.Chown(int(s.UID), int(s.UID)); err != nil {
+			fp.Close()
+			log.Printf("PutFiles: setting file owner: %v", err)
+			return err
+		}
+		if err = fp.Close(); err != nil {
+			log.Printf("PutFiles: closing file: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFiles copies a set of files out of the sandbox directory.
+func (s *localSandbox) GetFiles(filenames []string) (map[string]string, error) {
+	if len(filenames) == 0 {
+		return nil, nil
+	}
+
+	files := make(map[string]string)
+	for _, name := range filenames {
+		full, err := s.path(name)
+		if err != nil {
+			log.Printf("GetFiles: %v", err)
+			return nil, err
+		}
+		fp, err := os.OpenFile(full, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			log.Printf("GetFiles: opening file: %v", err)
+			return nil, err
+		}
+		info, err := fp.Stat()
+		if err != nil {
+			fp.Close()
+			log.Printf("GetFiles: stat: %v", err)
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			fp.Close()
+			return nil, fmt.Errorf("GetFiles: %s is not a regular file", name)
+		}
+		contents, err := ioutil.ReadAll(fp)
+		fp.Close()
+		if err != nil {
+			log.Printf("GetFiles: reading file: %v", err)
+			return nil, err
+		}
+		files[filepath.Clean(name)] = string(contents)
+	}
+	return files, nil
+}
+
+// Exec runs a command as the sandbox user. TTY mode is not supported and
+// is silently ignored. Any processes left behind in the command's process
+// group are killed when the command exits.
+func (s *localSandbox) Exec(cmd []string, stdin io.Reader, stdout, stderr io.Writer, useTTY bool) (int, *ResourceUsage, error) {
+	s.Lock()
+	closed := s.Closed
+	s.Unlock()
+	if closed {
+		return -1, nil, fmt.Errorf("local sandbox is shut down")
+	}
+
+	l := s.Limits
+	args := []string{
+		localSandboxHelper, "exec",
+		strconv.FormatInt(l.maxCPU, 10),
+		strconv.FormatInt(l.maxMemory*1024*1024, 10),
+		strconv.FormatInt(l.maxFileSize*1024*1024, 10),
+		strconv.FormatInt(l.maxFD, 10),
+		strconv.FormatInt(l.maxThreads, 10),
+		"--",
+	}
+	c := exec.Command(selfExe, append(args, cmd...)...)
+	c.Dir = s.Dir
+	c.Env = s.Env
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Credential: &syscall.Credential{Uid: uint32(s.UID), Gid: uint32(s.UID)},
+	}
+
+	// use real pipes so that background processes cannot hold up Wait
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return -1, nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return -1, nil, err
+	}
+	c.Stdout, c.Stderr = outW, errW
+	var inW *os.File
+	if stdin != nil {
+		var inR *os.File
+		if inR, inW, err = os.Pipe(); err != nil {
+			outR.Close()
+			outW.Close()
+			errR.Close()
+			errW.Close()
+			return -1, nil, err
+		}
+		defer inR.Close()
+		c.Stdin = inR
+	}
+
+	if err = c.Start(); err != nil {
+		outR.Close()
+		outW.Close()
+		errR.Close()
+		errW.Close()
+		if inW != nil {
+			inW.Close()
+		}
+		return -1, nil, err
+	}
+	outW.Close()
+	errW.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(stdout, outR)
+		outR.Close()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(stderr, errR)
+		errR.Close()
+		wg.Done()
+	}()
+	if inW != nil {
+		go func() {
+			io.Copy(inW, stdin)
+			inW.Close()
+		}()
+	}
+
+	err = c.Wait()
+	syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	if inW != nil {
+		inW.Close()
+	}
+	wg.Wait()
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return -1, nil, err
+		}
+	}
+
+	// gather resource usage
+	usage := new(ResourceUsage)
+	if rusage, ok := c.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		usage.PeakMemory = rusage.Maxrss * 1024
+		usage.CPUSeconds = time.Duration(syscall.TimevalToNsec(rusage.Utime) + syscall.TimevalToNsec(rusage.Stime)).Seconds()
+		usage.BytesWritten = rusage.Oublock * 512
+	}
+
+	status := c.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		// mimic the shell convention used by docker
+		return 128 + int(status.Signal()), usage, nil
+	}
+	return status.ExitStatus(), usage, nil
+}
+
+// killAll kills every process owned by the sandbox user.
+func (s *localSandbox) killAll() {
+	c := exec.Command(selfExe, localSandboxHelper, "kill")
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(s.UID), Gid: uint32(s.UID)},
+	}
+
+	// the helper kills itself along with everything else, so ignore the result
+	c.Run()
+}
+
+func (s *localSandbox) Shutdown() error {
+	s.Lock()
+	if s.Closed {
+		s.Unlock()
+		return nil
+	}
+	s.Closed = true
+	s.Unlock()
+
+	s.Timer.Stop()
+	s.killAll()
+	err := os.RemoveAll(s.Dir)
+	releaseUID(s.UID)
+	if err != nil {
+		log.Printf("localSandbox.Shutdown: %v", err)
+		return err
+	}
+	return nil
+}
+
+// localSandboxHelperMain runs in a child process already switched to the sandbox UID.
+// It either applies rlimits and execs a command, or kills every process that
+// belongs to the UID. It never returns.
+func localSandboxHelperMain(args []string) {
+	if len(args) == 1 && args[0] == "kill" {
+		syscall.Kill(-1, syscall.SIGKILL)
+		os.Exit(0)
+	}
+	if len(args) < 8 || args[0] != "exec" || args[6] != "--" {
+		fmt.Fprintf(os.Stderr, "%s: invalid arguments\n", localSandboxHelper)
+		os.Exit(127)
+	}
+	var vals []uint64
+	for _, elt := range args[1:6] {
+		n, err := strconv.ParseUint(elt, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid limit %q\n", localSandboxHelper, elt)
+			os.Exit(127)
+		}
+		vals = append(vals, n)
+	}
+	cpu, mem, disk, fd, threads := vals[0], vals[1], vals[2], vals[3], vals[4]
+	rlimits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CORE, 0},
+		{syscall.RLIMIT_CPU, cpu},
+		{syscall.RLIMIT_DATA, mem},
+		{syscall.RLIMIT_FSIZE, disk},
+		{syscall.RLIMIT_NOFILE, fd},
+		{rlimitNPROC, threads},
+		{syscall.RLIMIT_STACK, mem},
+	}
+	for _, elt := range rlimits {
+		lim := &syscall.Rlimit{Cur: elt.value, Max: elt.value}
+		if err := syscall.Setrlimit(elt.resource, lim); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: setrlimit: %v\n", localSandboxHelper, err)
+			os.Exit(127)
+		}
+	}
+
+	cmd := args[7:]
+	path, err := exec.LookPath(cmd[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", localSandboxHelper, err)
+		os.Exit(127)
+	}
+	err = syscall.Exec(path, cmd, os.Environ())
+	fmt.Fprintf(os.Stderr, "%s: exec: %v\n", localSandboxHelper, err)
+	os.Exit(127)
+}
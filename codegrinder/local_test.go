@@ -0,0 +1,143 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalSandboxPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-sandbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	s := &localSandbox{Dir: dir}
+
+	good := map[string]string{
+		"main.py":        filepath.Join(dir, "main.py"),
+		"sub/test.py":    filepath.Join(dir, "sub", "test.py"),
+		"./sub/../a.txt": filepath.Join(dir, "a.txt"),
+	}
+	for name, expected := range good {
+		full, err := s.path(name)
+		if err != nil {
+			t.Errorf("path(%q): unexpected error: %v", name, err)
+		} else if full != expected {
+			t.Errorf("path(%q) = %q, expected %q", name, full, expected)
+		}
+	}
+
+	bad := []string{
+		"/etc/passwd",
+		"..",
+		"../outside",
+		"sub/../../outside",
+		"escape/passwd",
+	}
+	for _, name := range bad {
+		if full, err := s.path(name); err == nil {
+			t.Errorf("path(%q) = %q, expected an error", name, full)
+		}
+	}
+}
+
+func TestLocalSandboxExec(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the local sandbox must run as root to switch UIDs")
+	}
+	l := &limits{
+		maxCPU:      10,
+		maxSession:  20,
+		maxTimeout:  20,
+		maxFD:       100,
+		maxFileSize: 10,
+		maxMemory:   256,
+		maxThreads:  50,
+	}
+	sandbox, err := newLocalSandbox("", false, nil, l, "local-sandbox-test")
+	if err != nil {
+		t.Fatalf("creating sandbox: %v", err)
+	}
+	s := sandbox.(*localSandbox)
+	defer s.Shutdown()
+
+	files := map[string]string{
+		"in.txt":         "hello\n",
+		"tests/data.txt": "data\n",
+	}
+	if err := s.PutFiles(files, 0644); err != nil {
+		t.Fatalf("PutFiles: %v", err)
+	}
+	if err := s.PutFiles(map[string]string{"../outside.txt": "nope"}, 0644); err == nil {
+		t.Errorf("PutFiles allowed a file outside the sandbox")
+	}
+
+	var stdout, stderr bytes.Buffer
+	script := `cat in.txt tests/data.txt; read line; echo "$line" > out.txt; echo oops >&2; exit 3`
+	status, usage, err := s.Exec([]string{"/bin/sh", "-c", script}, strings.NewReader("from stdin\n"), &stdout, &stderr, false)
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if status != 3 {
+		t.Errorf("exit status %d, expected 3 (stderr: %q)", status, stderr.String())
+	}
+	if stdout.String() != "hello\ndata\n" {
+		t.Errorf("stdout %q, expected %q", stdout.String(), "hello\ndata\n")
+	}
+	if stderr.String() != "oops\n" {
+		t.Errorf("stderr %q, expected %q", stderr.String(), "oops\n")
+	}
+	if usage == nil {
+		t.Errorf("no resource usage reported")
+	}
+
+	after, err := s.GetFiles([]string{"out.txt", "in.txt"})
+	if err != nil {
+		t.Fatalf("GetFiles: %v", err)
+	}
+	if after["out.txt"] != "from stdin\n" {
+		t.Errorf("out.txt contains %q, expected %q", after["out.txt"], "from stdin\n")
+	}
+	if after["in.txt"] != files["in.txt"] {
+		t.Errorf("in.txt contains %q, expected %q", after["in.txt"], files["in.txt"])
+	}
+
+	// commands run as the sandbox user, not as root
+	stdout.Reset()
+	if _, _, err := s.Exec([]string{"/usr/bin/id", "-u"}, nil, &stdout, &stderr, false); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if uid := strings.TrimSpace(stdout.String()); uid == "0" {
+		t.Errorf("command ran as root")
+	}
+
+	// shutting down twice is harmless, and the directory is removed
+	if err := s.Shutdown(); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := s.Shutdown(); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+	if _, err := os.Stat(s.Dir); !os.IsNotExist(err) {
+		t.Errorf("sandbox directory %s still exists after shutdown", s.Dir)
+	}
+	if _, _, err := s.Exec([]string{"/bin/true"}, nil, &stdout, &stderr, false); err == nil {
+		t.Errorf("Exec succeeded after shutdown")
+	}
+}
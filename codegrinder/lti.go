@@ -61,6 +61,12 @@ type LTIRequest struct {
 	CanvasAssignmentTitle            string  `form:"custom_canvas_assignment_title"`           // YouFace Template
 	CanvasAssignmentID               int64   `form:"custom_canvas_assignment_id"`              // 1566693
 	CanvasAPIDomain                  string  `form:"custom_canvas_api_domain"`                 // dixie.instructure.com
+	CanvasAssignmentDueAt            string  `form:"custom_canvas_assignment_due_at"`          // 2016-09-30T23:59:59-06:00 (empty if none)
+	ContentItemReturnURL             string  `form:"content_item_return_url"`                  // https://... to return a ContentItemSelection
+	ContentItemData                  string  `form:"data"`                                     // <opaque>: echoed back with the selection
+	AcceptMediaTypes                 string  `form:"accept_media_types"`                       // application/vnd.ims.lti.v1.ltilink
+	ExtContentReturnTypes            string  `form:"ext_content_return_types"`                 // lti_launch_url
+	ExtContentReturnURL              string  `form:"ext_content_return_url"`                   // https://... to return a Canvas content selection
 	OAuthVersion                     string  `form:"oauth_version"`                            // 1.0
 	OAuthSignature                   string  `form:"oauth_signature"`                          // <opaque> base64
 	OAuthSignatureMethod             string  `form:"oauth_signature_method"`                   // HMAC-SHA1
@@ -95,6 +101,7 @@ type LTIConfig struct {
 	Title           string              `xml:"blti:title"`
 	Description     string              `xml:"blti:description"`
 	Icon            string              `xml:"blti:icon"`
+	Custom          LTIConfigCustom     `xml:"blti:custom"`
 	Extensions      LTIConfigExtensions `xml:"blti:extensions"`
 	CartridgeBundle LTICartridge        `xml:"cartridge_bundle"`
 	CartridgeIcon   LTICartridge        `xml:"cartridge_icon"`
@@ -107,6 +114,11 @@ type LTIConfigExtensions struct {
 	Options    []LTIConfigOptions
 }
 
+// LTIConfigCustom is the XML format for custom parameters the LMS should send with each launch.
+type LTIConfigCustom struct {
+	Properties []LTIConfigExtension
+}
+
 // LTIConfigOptions is part of the XML format for Canvas extensions to LTI configuration.
 type LTIConfigOptions struct {
 	XMLName xml.Name `xml:"lticm:options"`
@@ -140,6 +152,11 @@ func GetConfigXML(w http.ResponseWriter) {
 			" http://www.imsglobal.org/xsd/imslticp_v1p0 http://www.imsglobal.org/xsd/lti/ltiv1p0/imslticp_v1p0.xsd",
 		Title:       Config.ToolName,
 		Description: Config.ToolDescription,
+		Custom: LTIConfigCustom{
+			Properties: []LTIConfigExtension{
+				LTIConfigExtension{Name: "canvas_assignment_due_at", Value: "$Canvas.assignment.dueAt.iso8601"},
+			},
+		},
 		Extensions: LTIConfigExtensions{
 			Platform: "canvas.instructure.com",
 			Extensions: []LTIConfigExtension{
@@ -153,7 +170,18 @@ func GetConfigXML(w http.ResponseWriter) {
 					Options: []LTIConfigExtension{
 						LTIConfigExtension{Name: "url", Value: "https://" + Config.Hostname + "/v2/lti/problem_sets"},
 						LTIConfigExtension{Name: "text", Value: Config.ToolName},
-						LTIConfigExtension{Name: "selection_width", Value: "320"},
+						LTIConfigExtension{Name: "selection_width", Value: "800"},
+						LTIConfigExtension{Name: "selection_height", Value: "640"},
+						LTIConfigExtension{Name: "enabled", Value: "true"},
+					},
+				},
+				LTIConfigOptions{
+					Name: "assignment_selection",
+					Options: []LTIConfigExtension{
+						LTIConfigExtension{Name: "url", Value: "https://" + Config.Hostname + "/v2/lti/problem_sets"},
+						LTIConfigExtension{Name: "message_type", Value: "ContentItemSelectionRequest"},
+						LTIConfigExtension{Name: "text", Value: Config.ToolName},
+						LTIConfigExtension{Name: "selection_width", Value: "800"},
 						LTIConfigExtension{Name: "selection_height", Value: "640"},
 						LTIConfigExtension{Name: "enabled", Value: "true"},
 					},
@@ -221,7 +249,9 @@ func getMyURL(r *http.Request, withPath bool) *url.URL {
 	return u
 }
 
-func checkOAuthSignature(w http.ResponseWriter, r *http.Request) {
+// checkOAuthSignature verifies the signature on an LTI launch using the
+// secret for its consumer key (requires withTx).
+func checkOAuthSignature(w http.ResponseWriter, r *http.Request, tx *sql.Tx) {
 	// make sure this is a signed request
 	r.ParseForm()
 	expected := r.Form.Get("oauth_signature")
@@ -230,12 +260,80 @@ func checkOAuthSignature(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// find the secret for this consumer
+	secret, err := getLTISecret(tx, r.Form.Get("oauth_consumer_key"))
+	if err != nil {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "unable to find LTI secret: %v", err)
+		return
+	}
+
 	// compute the signature
-	sig := computeOAuthSignature(r.Method, getMyURL(r, true).String(), r.Form, Config.LTISecret)
+	sig := computeOAuthSignature(r.Method, getMyURL(r, true).String(), r.Form, secret)
 
 	// verify it
 	if sig != expected {
+		ltiRejectsCounter.Add(1)
 		loggedHTTPErrorf(w, http.StatusUnauthorized, "Signature mismatch: got %s but expected %s", sig, expected)
+		return
+	}
+
+	// make sure the request is fresh
+	timestamp, err := strconv.ParseInt(r.Form.Get("oauth_timestamp"), 10, 64)
+	if err != nil {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "Missing or invalid oauth_timestamp form field")
+		return
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(Config.LTITimestampSkew)*time.Second {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "oauth_timestamp is off by %v, which is outside the allowed window", skew)
+	}
+}
+
+// checkOAuthNonce rejects an LTI launch if its nonce has already been used
+// (requires withTx and checkOAuthSignature).
+// Nonces are remembered until their timestamps fall outside the allowed window,
+// after which checkOAuthSignature would reject the request anyway.
+func checkOAuthNonce(w http.ResponseWriter, r *http.Request, tx *sql.Tx) {
+	consumerKey := r.Form.Get("oauth_consumer_key")
+	nonce := r.Form.Get("oauth_nonce")
+	if nonce == "" {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "Missing oauth_nonce form field")
+		return
+	}
+	timestamp, _ := strconv.ParseInt(r.Form.Get("oauth_timestamp"), 10, 64)
+	now := time.Now()
+
+	// forget nonces that have expired
+	if _, err := tx.Exec(`DELETE FROM oauth_nonces WHERE expires_at < $1`, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// has this one been seen before?
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM oauth_nonces WHERE consumer_key = $1 AND nonce = $2`, consumerKey, nonce).Scan(&count); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if count > 0 {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "oauth_nonce %q for consumer %q has already been used; rejecting replayed launch from %s",
+			nonce, consumerKey, r.RemoteAddr)
+		return
+	}
+
+	expiresAt := time.Unix(timestamp, 0).Add(time.Duration(Config.LTITimestampSkew) * time.Second)
+	if _, err := tx.Exec(`INSERT INTO oauth_nonces (consumer_key, nonce, created_at, expires_at) VALUES ($1, $2, $3, $4)`,
+		consumerKey, nonce, now, expiresAt); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
 	}
 }
 
@@ -363,13 +461,12 @@ func LtiProblemSet(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTIR
 
 	// redirect to the console
 	http.Redirect(w, r, fmt.Sprintf("/#/assignment/%d", asst.ID), http.StatusSeeOther)
-	//_ = asst
-	//http.Redirect(w, r, "/v2/users/me/cookie", http.StatusSeeOther)
 }
 
 // LtiProblemSets handles /lti/problem_set requests.
 // It creates the user/course if necessary, creates a session,
-// and redirects the user to the problem set picker UI URL.
+// and shows instructors a list of problem sets to choose from
+// when the LMS asked for a content item selection.
 func LtiProblemSets(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTIRequest, render render.Render, session sessions.Session) {
 	now := time.Now()
 
@@ -389,16 +486,27 @@ func LtiProblemSets(w http.ResponseWriter, r *http.Request, tx *sql.Tx, form LTI
 	// sign the user in
 	session.Set("id", user.ID)
 
-	u := &url.URL{
-		Path: "/",
-		Fragment: fmt.Sprintf("/problem_sets/%s/%s",
-			url.QueryEscape(form.OAuthConsumerKey),
-			url.QueryEscape(form.LaunchPresentationReturnURL)),
+	// instructors choosing a problem set for a new assignment get the picker
+	sel := &ltiSelection{
+		UserID:      user.ID,
+		ConsumerKey: form.OAuthConsumerKey,
+		Data:        form.ContentItemData,
+	}
+	switch {
+	case form.LTIMessageType == "ContentItemSelectionRequest" && form.ContentItemReturnURL != "":
+		sel.Kind, sel.ReturnURL = ltiSelectionContentItem, form.ContentItemReturnURL
+	case form.ExtContentReturnURL != "":
+		sel.Kind, sel.ReturnURL = ltiSelectionExtContent, form.ExtContentReturnURL
+	default:
+		// anyone else can sign in the command-line tool from the device page
+		http.Redirect(w, r, "/v2/device", http.StatusSeeOther)
+		return
 	}
-
-	log.Printf("problem set picker redirecting to %s", u.String())
-	//http.Redirect(w, r, u.String(), http.StatusSeeOther)
-	http.Redirect(w, r, "/v2/users/me/cookie", http.StatusSeeOther)
+	if !user.Admin && !isInstructorLaunch(form.Roles) {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "only instructors can choose problem sets")
+		return
+	}
+	renderProblemSetPicker(w, tx, sel)
 }
 
 // get/create/update this user
@@ -501,6 +609,7 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 			form.CanvasAssignmentTitle, course.ID, course.Name, problemSet.ID, user.ID, user.Name, user.Email)
 		asst.ID = 0
 		asst.RawScores = map[string][]float64{}
+		asst.StepScores = map[string][]float64{}
 		asst.Score = 0.0
 		asst.CreatedAt = now
 		asst.UpdatedAt = now
@@ -522,6 +631,17 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 		asst.FinishedURL != form.LaunchPresentationReturnURL ||
 		asst.ConsumerKey != form.OAuthConsumerKey
 
+	// the LMS reports the due date when it knows one
+	dueAt := asst.DueAt
+	if form.CanvasAssignmentDueAt != "" {
+		if t, err := time.Parse(time.RFC3339, form.CanvasAssignmentDueAt); err != nil {
+			log.Printf("unable to parse due date %q for assignment %q: %v", form.CanvasAssignmentDueAt, form.CanvasAssignmentTitle, err)
+		} else {
+			dueAt = t
+		}
+	}
+	changed = changed || !asst.DueAt.Equal(dueAt)
+
 	// make any changes
 	asst.CourseID = course.ID
 	asst.ProblemSetID = problemSet.ID
@@ -558,6 +678,7 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 	asst.OutcomeExtAccepted = form.ExtOutcomeDataValuesAccepted
 	asst.FinishedURL = form.LaunchPresentationReturnURL
 	asst.ConsumerKey = form.OAuthConsumerKey
+	asst.DueAt = dueAt
 	if asst.ID < 1 || changed {
 		// if something changed, note the update time and save
 		if asst.ID > 0 {
@@ -584,7 +705,7 @@ func getUpdateAssignment(tx *sql.Tx, form *LTIRequest, now time.Time, course *Co
 	return asst, nil
 }
 
-func saveGrade(asst *Assignment, user *User, text string) error {
+func saveGrade(asst *Assignment, user *User, secret, text string) error {
 	if asst.GradeID == "" {
 		log.Printf("cannot post grade for assignment %d user %d (%s) because no grade ID is present", asst.ID, asst.UserID, user.Name)
 		return nil
@@ -623,7 +744,7 @@ func saveGrade(asst *Assignment, user *User, text string) error {
 	result := fmt.Sprintf("%s%s\n", xml.Header, raw)
 
 	// sign the request
-	auth := signXMLRequest(asst.ConsumerKey, "POST", outcomeURL, result, Config.LTISecret)
+	auth := signXMLRequest(asst.ConsumerKey, "POST", outcomeURL, result, secret)
 
 	// POST the grade
 	req, err := http.NewRequest("POST", outcomeURL, strings.NewReader(result))
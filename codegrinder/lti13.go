@@ -0,0 +1,859 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+	"github.com/russross/sessions"
+	"gopkg.in/square/go-jose.v1"
+)
+
+// LTI 1.3 launches use OpenID Connect third-party initiated login:
+//
+// 1.  The platform sends the user to /v2/lti13/login with its issuer
+//     and a login hint.
+// 2.  We record a state and nonce, set a cookie naming the state so
+//     only this browser can complete the launch, and send the user
+//     back to the platform's authorization endpoint.
+// 3.  The platform posts a signed id_token to /v2/lti13/launch.
+// 4.  We check the signature against the platform's published keys,
+//     check the state, its cookie, and the nonce, and then handle the launch much like
+//     an LTI 1.1 launch.
+//
+// Platforms must be registered in the lti_platforms table first.
+
+const (
+	ltiLaunchStateTimeout = 10 * time.Minute
+	ltiKeySetCacheTime    = time.Hour
+	ltiKeySetRefetchDelay = time.Minute
+	ltiHTTPTimeout        = 30 * time.Second
+	ltiStateCookiePrefix  = "lti13_state_"
+	ltiStateCookiePath    = "/v2/lti13/launch"
+	ltiVersion13          = "1.3.0"
+	ltiResourceLinkLaunch = "LtiResourceLinkRequest"
+	ltiDeepLinkingLaunch  = "LtiDeepLinkingRequest"
+	ltiMembershipRole     = "http://purl.imsglobal.org/vocab/lis/v2/membership#"
+	ltiProblemSetPath     = "/v2/lti/problem_sets/"
+)
+
+// LTIClaims is the payload of an LTI 1.3 id_token.
+type LTIClaims struct {
+	Issuer     string      `json:"iss"`
+	Subject    string      `json:"sub"`
+	Audience   jwtAudience `json:"aud"`
+	AuthParty  string      `json:"azp"`
+	ExpiresAt  int64       `json:"exp"`
+	IssuedAt   int64       `json:"iat"`
+	Nonce      string      `json:"nonce"`
+	Name       string      `json:"name"`
+	GivenName  string      `json:"given_name"`
+	FamilyName string      `json:"family_name"`
+	Email      string      `json:"email"`
+	Picture    string      `json:"picture"`
+
+	MessageType       string                 `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+	Version           string                 `json:"https://purl.imsglobal.org/spec/lti/claim/version"`
+	DeploymentID      string                 `json:"https://purl.imsglobal.org/spec/lti/claim/deployment_id"`
+	TargetLinkURI     string                 `json:"https://purl.imsglobal.org/spec/lti/claim/target_link_uri"`
+	Roles             []string               `json:"https://purl.imsglobal.org/spec/lti/claim/roles"`
+	Custom            map[string]interface{} `json:"https://purl.imsglobal.org/spec/lti/claim/custom"`
+	LTI11LegacyUserID string                 `json:"https://purl.imsglobal.org/spec/lti/claim/lti11_legacy_user_id"`
+
+	Context struct {
+		ID    string `json:"id"`
+		Label string `json:"label"`
+		Title string `json:"title"`
+	} `json:"https://purl.imsglobal.org/spec/lti/claim/context"`
+
+	ResourceLink struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"https://purl.imsglobal.org/spec/lti/claim/resource_link"`
+
+	LaunchPresentation struct {
+		DocumentTarget string `json:"document_target"`
+		ReturnURL      string `json:"return_url"`
+		Locale         string `json:"locale"`
+	} `json:"https://purl.imsglobal.org/spec/lti/claim/launch_presentation"`
+
+	ToolPlatform struct {
+		GUID              string `json:"guid"`
+		Name              string `json:"name"`
+		ContactEmail      string `json:"contact_email"`
+		ProductFamilyCode string `json:"product_family_code"`
+		Version           string `json:"version"`
+	} `json:"https://purl.imsglobal.org/spec/lti/claim/tool_platform"`
+
+	Endpoint struct {
+		Scope     []string `json:"scope"`
+		LineItems string   `json:"lineitems"`
+		LineItem  string   `json:"lineitem"`
+	} `json:"https://purl.imsglobal.org/spec/lti-ags/claim/endpoint"`
+
+	NamesRoleService struct {
+		ContextMembershipsURL string   `json:"context_memberships_url"`
+		ServiceVersions       []string `json:"service_versions"`
+	} `json:"https://purl.imsglobal.org/spec/lti-nrps/claim/namesroleservice"`
+
+	DeepLinkingSettings struct {
+		ReturnURL   string   `json:"deep_link_return_url"`
+		AcceptTypes []string `json:"accept_types"`
+		Data        string   `json:"data"`
+	} `json:"https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings"`
+}
+
+// jwtAudience is the aud claim, which may be a single string or a list.
+type jwtAudience []string
+
+func (aud *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*aud = jwtAudience(list)
+	return nil
+}
+
+func (aud jwtAudience) contains(s string) bool {
+	for _, elt := range aud {
+		if elt == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ltiToolKey is the private key used to sign requests to platforms.
+// The public half is published at /v2/lti13/jwks.
+var ltiToolKey *jose.JsonWebKey
+
+// loadLTIToolKey loads the tool's private key from a PEM file,
+// generating a new key and saving it if the file does not exist.
+func loadLTIToolKey(filename string) error {
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		log.Printf("generating new LTI tool key in %s", filename)
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		raw = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := ioutil.WriteFile(filename, raw, 0600); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return fmt.Errorf("no PEM data found in %s", filename)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	jwk := &jose.JsonWebKey{Key: key, Algorithm: string(jose.RS256), Use: "sig"}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	ltiToolKey = jwk
+	return nil
+}
+
+// signLTIToken signs a JWT with the tool's private key.
+func signLTIToken(claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(jose.RS256, ltiToolKey)
+	if err != nil {
+		return "", err
+	}
+	signer.SetEmbedJwk(false)
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+// GetLTIJWKS handles requests to /v2/lti13/jwks,
+// returning the public key platforms use to check our signatures.
+func GetLTIJWKS(w http.ResponseWriter, render render.Render) {
+	if ltiToolKey == nil {
+		loggedHTTPErrorf(w, http.StatusNotFound, "no LTI tool key is configured")
+		return
+	}
+	public := jose.JsonWebKey{
+		Key:       &ltiToolKey.Key.(*rsa.PrivateKey).PublicKey,
+		KeyID:     ltiToolKey.KeyID,
+		Algorithm: ltiToolKey.Algorithm,
+		Use:       ltiToolKey.Use,
+	}
+	render.JSON(http.StatusOK, &jose.JsonWebKeySet{Keys: []jose.JsonWebKey{public}})
+}
+
+// platform key sets are cached by URL
+type cachedKeySet struct {
+	keys      *jose.JsonWebKeySet
+	fetchedAt time.Time
+}
+
+var (
+	platformKeySetsMutex sync.Mutex
+	platformKeySets      = make(map[string]*cachedKeySet)
+)
+
+// ltiHTTPClient is used for all requests to LTI platforms, so a slow
+// platform cannot tie up a request indefinitely.
+var ltiHTTPClient = &http.Client{Timeout: ltiHTTPTimeout}
+
+// getPlatformKey finds the public key with the given ID in a platform's key set.
+// Key sets are cached, but fetched again if a key is not found in case the
+// platform has rotated its keys. The lock is not held while fetching, so
+// a slow platform does not hold up launches from other platforms.
+func getPlatformKey(jwksURL, kid string) (*jose.JsonWebKey, error) {
+	now := time.Now()
+	platformKeySetsMutex.Lock()
+	cached := platformKeySets[jwksURL]
+	platformKeySetsMutex.Unlock()
+	if cached != nil && now.Sub(cached.fetchedAt) < ltiKeySetCacheTime {
+		if keys := cached.keys.Key(kid); len(keys) > 0 {
+			return &keys[0], nil
+		}
+		if now.Sub(cached.fetchedAt) < ltiKeySetRefetchDelay {
+			return nil, fmt.Errorf("key %q not found in key set %s", kid, jwksURL)
+		}
+	}
+
+	resp, err := ltiHTTPClient.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d (%s) fetching key set %s", resp.StatusCode, resp.Status, jwksURL)
+	}
+	set := new(jose.JsonWebKeySet)
+	if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+		return nil, fmt.Errorf("error decoding key set %s: %v", jwksURL, err)
+	}
+	platformKeySetsMutex.Lock()
+	platformKeySets[jwksURL] = &cachedKeySet{keys: set, fetchedAt: now}
+	platformKeySetsMutex.Unlock()
+
+	keys := set.Key(kid)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key %q not found in key set %s", kid, jwksURL)
+	}
+	return &keys[0], nil
+}
+
+// verifyLTIToken checks the signature and standard claims of an id_token
+// issued by the given platform and returns its claims.
+func verifyLTIToken(platform *LTIPlatform, token string) (*LTIClaims, error) {
+	obj, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token: %v", err)
+	}
+	if len(obj.Signatures) != 1 {
+		return nil, fmt.Errorf("token must have exactly one signature, found %d", len(obj.Signatures))
+	}
+	header := obj.Signatures[0].Header
+	if header.Algorithm != string(jose.RS256) {
+		return nil, fmt.Errorf("token signed with %q, but only %s is accepted", header.Algorithm, jose.RS256)
+	}
+	key, err := getPlatformKey(platform.JWKSURL, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := obj.Verify(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad token signature: %v", err)
+	}
+
+	claims := new(LTIClaims)
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("error decoding token claims: %v", err)
+	}
+	if claims.Issuer != platform.Issuer {
+		return nil, fmt.Errorf("token issuer is %q, expected %q", claims.Issuer, platform.Issuer)
+	}
+	if !claims.Audience.contains(platform.ClientID) {
+		return nil, fmt.Errorf("token audience %v does not include client ID %q", claims.Audience, platform.ClientID)
+	}
+	if len(claims.Audience) > 1 && claims.AuthParty != platform.ClientID {
+		return nil, fmt.Errorf("token authorized party is %q, expected %q", claims.AuthParty, platform.ClientID)
+	}
+	skew := time.Duration(Config.LTITimestampSkew) * time.Second
+	now := time.Now()
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(skew)) {
+		return nil, fmt.Errorf("token expired at %v", time.Unix(claims.ExpiresAt, 0))
+	}
+	if now.Add(skew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, fmt.Errorf("token issued in the future at %v", time.Unix(claims.IssuedAt, 0))
+	}
+	return claims, nil
+}
+
+// ltiPlatformID qualifies a user or context ID from an LTI 1.3 platform with
+// the platform's issuer, since platforms only keep their own IDs unique.
+func ltiPlatformID(issuer, id string) string {
+	return issuer + "|" + id
+}
+
+// ltiUserID gives the LTI ID for a user launched by an LTI 1.3 platform.
+// A platform may report the ID a user had under LTI 1.1, but it is only
+// honored when the platform is linked to the consumer key that user
+// launched through. Otherwise any platform could sign in as any user.
+func ltiUserID(db meddler.DB, platform *LTIPlatform, subject, legacyID string) (string, error) {
+	if legacyID == "" || platform.LegacyConsumerKey == "" {
+		return ltiPlatformID(platform.Issuer, subject), nil
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM users JOIN assignments ON users.id = assignments.user_id `+
+		`WHERE users.lti_id = $1 AND assignments.consumer_key = $2 AND assignments.lti_platform_id IS NULL`,
+		legacyID, platform.LegacyConsumerKey).Scan(&count); err != nil {
+		return "", err
+	}
+	if count == 0 {
+		return ltiPlatformID(platform.Issuer, subject), nil
+	}
+	return legacyID, nil
+}
+
+// toLTIRequest translates the claims of an LTI 1.3 launch into the
+// equivalent LTI 1.1 launch parameters.
+func (claims *LTIClaims) toLTIRequest() *LTIRequest {
+	form := &LTIRequest{
+		PersonNameFull:                   claims.Name,
+		PersonNameFamily:                 claims.FamilyName,
+		PersonNameGiven:                  claims.GivenName,
+		PersonContactEmailPrimary:        claims.Email,
+		UserID:                           ltiPlatformID(claims.Issuer, claims.Subject),
+		UserImage:                        claims.Picture,
+		LTIMessageType:                   claims.MessageType,
+		LTIVersion:                       claims.Version,
+		LaunchPresentationDocumentTarget: claims.LaunchPresentation.DocumentTarget,
+		LaunchPresentationLocale:         claims.LaunchPresentation.Locale,
+		LaunchPresentationReturnURL:      claims.LaunchPresentation.ReturnURL,
+		TCInstanceName:                   claims.ToolPlatform.Name,
+		TCInstanceGUID:                   claims.ToolPlatform.GUID,
+		TCInstanceContactEmail:           claims.ToolPlatform.ContactEmail,
+		TCInstanceVersion:                claims.ToolPlatform.Version,
+		TCInfoProductFamilyCode:          claims.ToolPlatform.ProductFamilyCode,
+		ContextTitle:                     claims.Context.Title,
+		ContextLabel:                     claims.Context.Label,
+		ContextID:                        ltiPlatformID(claims.Issuer, claims.Context.ID),
+		ResourceLinkTitle:                claims.ResourceLink.Title,
+		ResourceLinkID:                   claims.ResourceLink.ID,
+	}
+
+	// translate membership roles into their LTI 1.1 short names
+	var roles []string
+	for _, role := range claims.Roles {
+		if strings.HasPrefix(role, ltiMembershipRole) {
+			role = role[len(ltiMembershipRole):]
+		}
+		roles = append(roles, role)
+	}
+	form.Roles = strings.Join(roles, ",")
+
+	// custom parameters are named as they are for LTI 1.1
+	custom := func(name string) string {
+		if value, present := claims.Custom[name]; present && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+	customInt := func(name string) int64 {
+		var n int64
+		fmt.Sscan(custom(name), &n)
+		return n
+	}
+	form.CanvasUserLoginID = custom("canvas_user_login_id")
+	form.CanvasEnrollmentState = custom("canvas_enrollment_state")
+	form.CanvasCourseID = customInt("canvas_course_id")
+	form.CanvasUserID = customInt("canvas_user_id")
+	form.CanvasAssignmentTitle = custom("canvas_assignment_title")
+	form.CanvasAssignmentID = customInt("canvas_assignment_id")
+	form.CanvasAPIDomain = custom("canvas_api_domain")
+	form.CanvasAssignmentDueAt = custom("canvas_assignment_due_at")
+	fmt.Sscan(custom("canvas_assignment_points_possible"), &form.CanvasAssignmentPointsPossible)
+	if form.CanvasAssignmentTitle == "" {
+		form.CanvasAssignmentTitle = claims.ResourceLink.Title
+	}
+
+	return form
+}
+
+// problemSetUnique finds the problem set named by a resource link launch,
+// either from the target link URI or from a problem_set custom parameter.
+func (claims *LTIClaims) problemSetUnique() string {
+	if u, err := url.Parse(claims.TargetLinkURI); err == nil && strings.HasPrefix(u.Path, ltiProblemSetPath) {
+		return strings.TrimPrefix(u.Path, ltiProblemSetPath)
+	}
+	if value, present := claims.Custom["problem_set"]; present && value != nil {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+func newRandomToken() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// LTI13Login handles requests to /v2/lti13/login,
+// the first step of an LTI 1.3 launch.
+// It records a state and nonce for the launch and redirects the user
+// to the platform's authorization endpoint.
+func LTI13Login(w http.ResponseWriter, r *http.Request, tx *sql.Tx) {
+	r.ParseForm()
+	issuer := r.Form.Get("iss")
+	loginHint := r.Form.Get("login_hint")
+	targetLinkURI := r.Form.Get("target_link_uri")
+	clientID := r.Form.Get("client_id")
+	if issuer == "" || loginHint == "" || targetLinkURI == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "LTI login must include iss, login_hint, and target_link_uri")
+		return
+	}
+
+	// find the platform
+	platforms := []*LTIPlatform{}
+	var err error
+	if clientID != "" {
+		err = meddler.QueryAll(tx, &platforms, `SELECT * FROM lti_platforms WHERE issuer = $1 AND client_id = $2 AND enabled`, issuer, clientID)
+	} else {
+		err = meddler.QueryAll(tx, &platforms, `SELECT * FROM lti_platforms WHERE issuer = $1 AND enabled`, issuer)
+	}
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if len(platforms) != 1 {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "found %d enabled LTI platforms for issuer %q and client ID %q", len(platforms), issuer, clientID)
+		return
+	}
+	platform := platforms[0]
+
+	// record the state and nonce for this launch
+	state, err := newRandomToken()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating state: %v", err)
+		return
+	}
+	nonce, err := newRandomToken()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating nonce: %v", err)
+		return
+	}
+	now := time.Now()
+	if _, err := tx.Exec(`DELETE FROM lti_launch_states WHERE expires_at < $1`, now); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if _, err := tx.Exec(`INSERT INTO lti_launch_states (state, nonce, lti_platform_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		state, nonce, platform.ID, now, now.Add(ltiLaunchStateTimeout)); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// tie the state to this browser. The launch is posted from the
+	// platform's site, so the cookie must allow cross-site requests.
+	cookie := &http.Cookie{
+		Name:     ltiStateCookiePrefix + state,
+		Value:    "1",
+		Path:     ltiStateCookiePath,
+		MaxAge:   int(ltiLaunchStateTimeout.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+	}
+	w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=None")
+
+	// send the user to the platform to authenticate
+	u, err := url.Parse(platform.AuthLoginURL)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "bad authorization URL for platform %d: %v", platform.ID, err)
+		return
+	}
+	redirect := getMyURL(r, false)
+	redirect.Path = "/v2/lti13/launch"
+	q := u.Query()
+	q.Set("scope", "openid")
+	q.Set("response_type", "id_token")
+	q.Set("response_mode", "form_post")
+	q.Set("prompt", "none")
+	q.Set("client_id", platform.ClientID)
+	q.Set("redirect_uri", redirect.String())
+	q.Set("login_hint", loginHint)
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	if hint := r.Form.Get("lti_message_hint"); hint != "" {
+		q.Set("lti_message_hint", hint)
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// LTI13Launch handles requests to /v2/lti13/launch,
+// where the platform posts the signed id_token for an LTI 1.3 launch.
+// It checks the token, creates or updates the user, course, and assignment,
+// signs the user in, and redirects to the assignment.
+func LTI13Launch(w http.ResponseWriter, r *http.Request, tx *sql.Tx, session sessions.Session) {
+	r.ParseForm()
+	if msg := r.Form.Get("error"); msg != "" {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "LTI platform reported an error: %s: %s", msg, r.Form.Get("error_description"))
+		return
+	}
+	state := r.Form.Get("state")
+	token := r.Form.Get("id_token")
+	if state == "" || token == "" {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusBadRequest, "LTI launch must include state and id_token")
+		return
+	}
+
+	// the launch must finish in the browser that started it
+	if _, err := r.Cookie(ltiStateCookiePrefix + state); err != nil {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "LTI launch state from %s was not started in this browser", r.RemoteAddr)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   ltiStateCookiePrefix + state,
+		Path:   ltiStateCookiePath,
+		MaxAge: -1,
+	})
+
+	// each state can only be used once
+	var nonce string
+	var platformID int64
+	var expiresAt time.Time
+	if err := tx.QueryRow(`DELETE FROM lti_launch_states WHERE state = $1 RETURNING nonce, lti_platform_id, expires_at`, state).
+		Scan(&nonce, &platformID, &expiresAt); err != nil {
+		ltiRejectsCounter.Add(1)
+		if err == sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "unknown or reused LTI launch state from %s", r.RemoteAddr)
+		} else {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		}
+		return
+	}
+	now := time.Now()
+	if now.After(expiresAt) {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "LTI launch state expired at %v", expiresAt)
+		return
+	}
+	platform := new(LTIPlatform)
+	if err := meddler.Load(tx, "lti_platforms", platform, platformID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !platform.Enabled {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "LTI platform %d (%s) is disabled", platform.ID, platform.Name)
+		return
+	}
+
+	// check the token
+	claims, err := verifyLTIToken(platform, token)
+	if err != nil {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "LTI launch from platform %d (%s) rejected: %v", platform.ID, platform.Name, err)
+		return
+	}
+	if claims.Nonce != nonce {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "LTI launch nonce does not match")
+		return
+	}
+	if claims.Version != ltiVersion13 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "LTI version %q is not supported", claims.Version)
+		return
+	}
+	if platform.DeploymentID != "" && claims.DeploymentID != platform.DeploymentID {
+		ltiRejectsCounter.Add(1)
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "LTI deployment ID %q does not match platform %d", claims.DeploymentID, platform.ID)
+		return
+	}
+	form := claims.toLTIRequest()
+	if form.UserID, err = ltiUserID(tx, platform, claims.Subject, claims.LTI11LegacyUserID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	switch claims.MessageType {
+	case ltiResourceLinkLaunch:
+	case ltiDeepLinkingLaunch:
+		ltiDeepLinking(w, tx, platform, claims, form, session, now)
+		return
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "LTI message type %q is not supported", claims.MessageType)
+		return
+	}
+
+	// load the problem set
+	unique := claims.problemSetUnique()
+	if unique == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "LTI launch does not name a problem set")
+		return
+	}
+	problemSet := new(ProblemSet)
+	if err := meddler.QueryRow(tx, problemSet, `SELECT * FROM problem_sets WHERE unique_id = $1`, unique); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	// load the course
+	course, err := getUpdateCourse(tx, form, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if course.PlatformID != platform.ID || course.MembershipsURL != claims.NamesRoleService.ContextMembershipsURL {
+		course.PlatformID = platform.ID
+		course.MembershipsURL = claims.NamesRoleService.ContextMembershipsURL
+		course.UpdatedAt = now
+		if err := meddler.Save(tx, "courses", course); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	// load the user
+	user, err := getUpdateUser(tx, form, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	// load the assignment
+	asst, err := getUpdateAssignment(tx, form, now, course, problemSet, user)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if asst.PlatformID != platform.ID || asst.PlatformUserID != claims.Subject || asst.LineItemURL != claims.Endpoint.LineItem {
+		asst.PlatformID = platform.ID
+		asst.PlatformUserID = claims.Subject
+		asst.LineItemURL = claims.Endpoint.LineItem
+		asst.UpdatedAt = now
+		if err := meddler.Save(tx, "assignments", asst); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+
+	// sign the user in
+	session.Set("id", user.ID)
+
+	// redirect to the console
+	http.Redirect(w, r, fmt.Sprintf("/#/assignment/%d", asst.ID), http.StatusSeeOther)
+}
+
+// ltiDeepLinking handles a deep linking launch, where an instructor
+// chooses a problem set to link to from inside the platform.
+func ltiDeepLinking(w http.ResponseWriter, tx *sql.Tx, platform *LTIPlatform, claims *LTIClaims, form *LTIRequest, session sessions.Session, now time.Time) {
+	settings := &claims.DeepLinkingSettings
+	if settings.ReturnURL == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "LTI deep linking request has no return URL")
+		return
+	}
+	accepted := len(settings.AcceptTypes) == 0
+	for _, elt := range settings.AcceptTypes {
+		if elt == "ltiResourceLink" {
+			accepted = true
+		}
+	}
+	if !accepted {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "LTI deep linking request does not accept resource links")
+		return
+	}
+
+	course, err := getUpdateCourse(tx, form, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if course.PlatformID != platform.ID || course.MembershipsURL != claims.NamesRoleService.ContextMembershipsURL {
+		course.PlatformID = platform.ID
+		course.MembershipsURL = claims.NamesRoleService.ContextMembershipsURL
+		course.UpdatedAt = now
+		if err := meddler.Save(tx, "courses", course); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	user, err := getUpdateUser(tx, form, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if !user.Admin && !isInstructorLaunch(form.Roles) {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "only instructors can choose problem sets")
+		return
+	}
+	session.Set("id", user.ID)
+
+	renderProblemSetPicker(w, tx, &ltiSelection{
+		Kind:         ltiSelectionDeepLink,
+		ReturnURL:    settings.ReturnURL,
+		Data:         settings.Data,
+		PlatformID:   platform.ID,
+		DeploymentID: claims.DeploymentID,
+		UserID:       user.ID,
+	})
+}
+
+// GetLTIPlatforms handles requests to /v2/lti_platforms,
+// returning a list of all registered LTI 1.3 platforms.
+func GetLTIPlatforms(w http.ResponseWriter, tx *sql.Tx, render render.Render) {
+	platforms := []*LTIPlatform{}
+	if err := meddler.QueryAll(tx, &platforms, `SELECT * FROM lti_platforms ORDER BY id`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, platforms)
+}
+
+// PostLTIPlatform handles requests to /v2/lti_platforms,
+// registering a new LTI 1.3 platform.
+func PostLTIPlatform(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, platform LTIPlatform, render render.Render) {
+	if !checkLTIPlatform(w, &platform) {
+		return
+	}
+	now := time.Now()
+	platform.ID = 0
+	platform.CreatedAt = now
+	platform.UpdatedAt = now
+	if err := meddler.Insert(tx, "lti_platforms", &platform); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) registered LTI platform %d (%s)", currentUser.ID, currentUser.Email, platform.ID, platform.Name)
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "lti_platform.create",
+		ObjectType: "lti_platform",
+		ObjectID:   platform.ID,
+		Target:     platform.Name,
+		After:      &platform,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &platform)
+}
+
+// PutLTIPlatform handles requests to /v2/lti_platforms/:lti_platform_id,
+// updating the registration of an LTI 1.3 platform.
+func PutLTIPlatform(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, platform LTIPlatform, render render.Render) {
+	platformID, err := parseID(w, "lti_platform_id", params["lti_platform_id"])
+	if err != nil {
+		return
+	}
+	old := new(LTIPlatform)
+	if err := meddler.Load(tx, "lti_platforms", old, platformID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if !checkLTIPlatform(w, &platform) {
+		return
+	}
+	platform.ID = old.ID
+	platform.CreatedAt = old.CreatedAt
+	platform.UpdatedAt = time.Now()
+	if err := meddler.Update(tx, "lti_platforms", &platform); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) updated LTI platform %d (%s)", currentUser.ID, currentUser.Email, platform.ID, platform.Name)
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "lti_platform.update",
+		ObjectType: "lti_platform",
+		ObjectID:   platform.ID,
+		Target:     platform.Name,
+		Before:     old,
+		After:      &platform,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, &platform)
+}
+
+// DeleteLTIPlatform handles requests to /v2/lti_platforms/:lti_platform_id,
+// removing the registration of an LTI 1.3 platform.
+func DeleteLTIPlatform(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor) {
+	platformID, err := parseID(w, "lti_platform_id", params["lti_platform_id"])
+	if err != nil {
+		return
+	}
+	platform := new(LTIPlatform)
+	if err := meddler.Load(tx, "lti_platforms", platform, platformID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM lti_platforms WHERE id = $1`, platformID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "lti_platform.delete",
+		ObjectType: "lti_platform",
+		ObjectID:   platform.ID,
+		Target:     platform.Name,
+		Before:     platform,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+func checkLTIPlatform(w http.ResponseWriter, platform *LTIPlatform) bool {
+	platform.LegacyConsumerKey = strings.TrimSpace(platform.LegacyConsumerKey)
+	if platform.Issuer == "" || platform.ClientID == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "platform must include issuer and client ID")
+		return false
+	}
+	for _, elt := range []string{platform.AuthLoginURL, platform.AuthTokenURL, platform.JWKSURL} {
+		if u, err := url.Parse(elt); err != nil || u.Scheme == "" || u.Host == "" {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "platform URL %q is not valid", elt)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// LTI Advantage services (Assignment and Grade Services and Names and
+// Role Provisioning Services) are called with OAuth2 bearer tokens.
+// We get a token from the platform by presenting a JWT signed with
+// the tool key.
+
+const (
+	ltiScopeScore       = "https://purl.imsglobal.org/spec/lti-ags/scope/score"
+	ltiScopeMemberships = "https://purl.imsglobal.org/spec/lti-nrps/scope/contextmembership.readonly"
+	ltiScoreContentType = "application/vnd.ims.lis.v1.score+json"
+	ltiMembershipsType  = "application/vnd.ims.lti-nrps.v2.membershipcontainer+json"
+	ltiAssertionType    = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	ltiTokenLifetime    = 5 * time.Minute
+)
+
+type cachedServiceToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+var (
+	serviceTokensMutex sync.Mutex
+	serviceTokens      = make(map[string]*cachedServiceToken)
+)
+
+// getLTIServiceToken returns an access token for the given scope from the platform.
+// Tokens are cached until shortly before they expire. The lock is not
+// held while requesting a token, so a slow platform does not hold up others.
+func getLTIServiceToken(platform *LTIPlatform, scope string) (string, error) {
+	if ltiToolKey == nil {
+		return "", fmt.Errorf("no LTI tool key is configured")
+	}
+
+	cacheKey := fmt.Sprintf("%d %s", platform.ID, scope)
+	now := time.Now()
+	serviceTokensMutex.Lock()
+	cached := serviceTokens[cacheKey]
+	serviceTokensMutex.Unlock()
+	if cached != nil && now.Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	// sign a client assertion
+	jti, err := newRandomToken()
+	if err != nil {
+		return "", err
+	}
+	assertion, err := signLTIToken(map[string]interface{}{
+		"iss": platform.ClientID,
+		"sub": platform.ClientID,
+		"aud": platform.AuthTokenURL,
+		"iat": now.Unix(),
+		"exp": now.Add(ltiTokenLifetime).Unix(),
+		"jti": jti,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// trade it for an access token
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_assertion_type", ltiAssertionType)
+	form.Set("client_assertion", assertion)
+	form.Set("scope", scope)
+	resp, err := ltiHTTPClient.PostForm(platform.AuthTokenURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("status %d (%s) requesting access token: %s", resp.StatusCode, resp.Status, body)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("error decoding access token: %v", err)
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("platform returned an empty access token")
+	}
+
+	// cache it, leaving a margin before it expires
+	lifetime := time.Duration(result.ExpiresIn)*time.Second - time.Minute
+	if lifetime > 0 {
+		serviceTokensMutex.Lock()
+		serviceTokens[cacheKey] = &cachedServiceToken{token: result.AccessToken, expiresAt: now.Add(lifetime)}
+		serviceTokensMutex.Unlock()
+	}
+	return result.AccessToken, nil
+}
+
+// LTIScore is a score posted to a line item using Assignment and Grade Services.
+type LTIScore struct {
+	UserID           string  `json:"userId"`
+	ScoreGiven       float64 `json:"scoreGiven"`
+	ScoreMaximum     float64 `json:"scoreMaximum"`
+	Comment          string  `json:"comment,omitempty"`
+	Timestamp        string  `json:"timestamp"`
+	ActivityProgress string  `json:"activityProgress"`
+	GradingProgress  string  `json:"gradingProgress"`
+}
+
+// saveGradeAGS posts the current score of an assignment launched using
+// LTI 1.3 to its line item.
+func saveGradeAGS(db meddler.DB, asst *Assignment, user *User) error {
+	if asst.LineItemURL == "" {
+		log.Printf("cannot post grade for assignment %d user %d (%s) because no line item is present", asst.ID, asst.UserID, user.Name)
+		return nil
+	}
+	platform := new(LTIPlatform)
+	if err := meddler.Load(db, "lti_platforms", platform, asst.PlatformID); err != nil {
+		return err
+	}
+	if !platform.Enabled {
+		return fmt.Errorf("LTI platform %d (%s) is disabled", platform.ID, platform.Name)
+	}
+	token, err := getLTIServiceToken(platform, ltiScopeScore)
+	if err != nil {
+		return err
+	}
+
+	// the scores endpoint is the line item URL with /scores added to the path
+	u, err := url.Parse(asst.LineItemURL)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/scores"
+
+	score := &LTIScore{
+		UserID:           asst.PlatformUserID,
+		ScoreGiven:       asst.Score,
+		ScoreMaximum:     1.0,
+		Timestamp:        time.Now().Format(time.RFC3339Nano),
+		ActivityProgress: "Completed",
+		GradingProgress:  "FullyGraded",
+	}
+	raw, err := json.Marshal(score)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", ltiScoreContentType)
+	resp, err := ltiHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return loggedErrorf("result status %d (%s) when posting score for user %d", resp.StatusCode, resp.Status, asst.UserID)
+	}
+	log.Printf("assignment %q grade of %0.5f posted for %s (%s)", asst.CanvasTitle, asst.Score, user.Name, user.Email)
+	return nil
+}
+
+// LTIMembership is a single member of a course as reported by
+// Names and Role Provisioning Services.
+type LTIMembership struct {
+	Status            string   `json:"status"`
+	Name              string   `json:"name"`
+	GivenName         string   `json:"given_name"`
+	FamilyName        string   `json:"family_name"`
+	Email             string   `json:"email"`
+	UserID            string   `json:"user_id"`
+	LTI11LegacyUserID string   `json:"lti11_legacy_user_id"`
+	Picture           string   `json:"picture"`
+	Roles             []string `json:"roles"`
+}
+
+// getLTIMemberships fetches the full membership list for a course,
+// following pagination links.
+func getLTIMemberships(platform *LTIPlatform, membershipsURL string) ([]*LTIMembership, error) {
+	token, err := getLTIServiceToken(platform, ltiScopeMemberships)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []*LTIMembership
+	for next := membershipsURL; next != ""; {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", ltiMembershipsType)
+		resp, err := ltiHTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var container struct {
+			Members []*LTIMembership `json:"members"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&container)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("status %d (%s) fetching course memberships", resp.StatusCode, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error decoding course memberships: %v", err)
+		}
+		members = append(members, container.Members...)
+		next = nextLink(resp.Header.Get("Link"))
+	}
+	return members, nil
+}
+
+// nextLink finds the rel="next" URL in a Link header.
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		for _, param := range parts[1:] {
+			if strings.Replace(strings.TrimSpace(param), " ", "", -1) == `rel="next"` {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+// PostCourseRoster handles requests to /v2/courses/:course_id/roster,
+// fetching the course roster from an LTI 1.3 platform.
+// Names and email addresses of users in the course are brought up to date,
+// and the roster is returned with the user ID of each member
+// (zero for members who have not launched this course yet).
+// The request transaction is finished before the roster is fetched,
+// and the updates are made in a transaction of their own.
+func PostCourseRoster(w http.ResponseWriter, tx *sql.Tx, db *sql.DB, params martini.Params, currentUser *User, audit *auditor, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if course.PlatformID == 0 || course.MembershipsURL == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "course %d has no roster service; launch it using LTI 1.3 first", course.ID)
+		return
+	}
+	platform := new(LTIPlatform)
+	if err := meddler.Load(tx, "lti_platforms", platform, course.PlatformID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	members, err := getLTIMemberships(platform, course.MembershipsURL)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusBadGateway, "error fetching roster for course %d: %v", course.ID, err)
+		return
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error starting transaction: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	roster := []*RosterMember{}
+	updated := []int64{}
+	for _, member := range members {
+		ltiID, err := ltiUserID(tx, platform, member.UserID, member.LTI11LegacyUserID)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		var roles []string
+		for _, role := range member.Roles {
+			roles = append(roles, strings.TrimPrefix(role, ltiMembershipRole))
+		}
+		elt := &RosterMember{
+			Name:   member.Name,
+			Email:  member.Email,
+			LtiID:  ltiID,
+			Roles:  strings.Join(roles, ","),
+			Status: member.Status,
+		}
+
+		// only users who belong to this course are touched
+		user := new(User)
+		err = meddler.QueryRow(tx, user, `SELECT * FROM users WHERE lti_id = $1 AND id IN (SELECT user_id FROM assignments WHERE course_id = $2)`, ltiID, course.ID)
+		if err != nil && err != sql.ErrNoRows {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		if err == nil {
+			elt.UserID = user.ID
+			if (member.Name != "" && user.Name != member.Name) || (member.Email != "" && user.Email != member.Email) {
+				if member.Name != "" {
+					user.Name = member.Name
+				}
+				if member.Email != "" {
+					user.Email = member.Email
+				}
+				user.UpdatedAt = now
+				if err := meddler.Save(tx, "users", user); err != nil {
+					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+					return
+				}
+				log.Printf("user %d (%s) updated from roster of course %d", user.ID, user.Email, course.ID)
+				updated = append(updated, user.ID)
+			}
+		}
+		roster = append(roster, elt)
+	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "course.roster",
+		ObjectType: "course",
+		ObjectID:   course.ID,
+		CourseID:   course.ID,
+		Target:     fmt.Sprintf("%d members", len(roster)),
+		After:      map[string]interface{}{"members": len(roster), "updatedUserIDs": updated},
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, roster)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// problemTypeManifestName is the file in Config.FilesDir/<type>/ that
+// describes a problem type. Problem types need no Go code:
+// the TA loads them into the database at startup, and the daycare builds
+// handlers for them from the manifest. A manifest looks like this:
+//
+//	{
+//	    "name": "cppgtest",
+//	    "image": "codegrinder/cpp",
+//	    "actions": [
+//	        {
+//	            "action": "grade",
+//	            "button": "Grade",
+//	            "message": "Grading‥",
+//	            "maxCPU": 60, "maxSession": 120, "maxTimeout": 120,
+//	            "maxFD": 100, "maxFileSize": 10, "maxMemory": 512, "maxThreads": 20,
+//	            "command": ["make", "grade"],
+//	            "parser": "xunit",
+//	            "resultFile": "test_detail.xml"
+//	        }
+//	    ]
+//	}
+//
+// The command defaults to "make <action>". The parser is one of the
+// resultParsers, which read the resultFile left behind by the command, or
+// none (the default), which passes if the command exits successfully. Any files matching the
+// returnFiles patterns that were changed by the command are sent back to
+// the student.
+const problemTypeManifestName = "problemtype.json"
+
+type ProblemTypeManifest struct {
+	Name    string                       `json:"name"`
+	Image   string                       `json:"image"`
+	Actions []*ProblemTypeManifestAction `json:"actions"`
+}
+
+type ProblemTypeManifestAction struct {
+	ProblemTypeAction
+	Command     []string `json:"command,omitempty"`
+	Parser      string   `json:"parser,omitempty"`
+	ResultFile  string   `json:"resultFile,omitempty"`
+	ReturnFiles []string `json:"returnFiles,omitempty"`
+}
+
+// readProblemTypeManifests finds and validates all problem type manifests in a directory.
+func readProblemTypeManifests(dir string) ([]*ProblemTypeManifest, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*", problemTypeManifestName))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var manifests []*ProblemTypeManifest
+	for _, path := range paths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		manifest := new(ProblemTypeManifest)
+		if err := json.Unmarshal(raw, manifest); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+		if err := manifest.normalize(filepath.Base(filepath.Dir(path))); err != nil {
+			return nil, fmt.Errorf("error in %s: %v", path, err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+func (manifest *ProblemTypeManifest) normalize(dirName string) error {
+	if manifest.Name == "" {
+		manifest.Name = dirName
+	}
+	if manifest.Name != dirName {
+		return fmt.Errorf("problem type name %q must match its directory name %q", manifest.Name, dirName)
+	}
+	if manifest.Image == "" {
+		return fmt.Errorf("problem type %s must have an image", manifest.Name)
+	}
+	if len(manifest.Actions) == 0 {
+		return fmt.Errorf("problem type %s must have at least one action", manifest.Name)
+	}
+	seen := make(map[string]bool)
+	for _, action := range manifest.Actions {
+		if action.Action == "" {
+			return fmt.Errorf("problem type %s has an action with no name", manifest.Name)
+		}
+		if seen[action.Action] {
+			return fmt.Errorf("problem type %s has more than one %s action", manifest.Name, action.Action)
+		}
+		seen[action.Action] = true
+		action.ProblemType = manifest.Name
+		if action.Button == "" {
+			action.Button = strings.Title(action.Action)
+		}
+		if len(action.Command) == 0 {
+			action.Command = []string{"make", action.Action}
+		}
+		if action.Parser == "" {
+			action.Parser = "none"
+		}
+		if action.Parser != "none" && resultParsers[action.Parser] == nil {
+			return fmt.Errorf("action %s of problem type %s has unknown parser %q", action.Action, manifest.Name, action.Parser)
+		}
+		if action.Parser != "none" && action.Interactive {
+			return fmt.Errorf("interactive action %s of problem type %s cannot use the %s parser", action.Action, manifest.Name, action.Parser)
+		}
+		if action.Parser != "none" && action.ResultFile == "" {
+			return fmt.Errorf("action %s of problem type %s needs a resultFile for the %s parser", action.Action, manifest.Name, action.Parser)
+		}
+		for _, pattern := range action.ReturnFiles {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("action %s of problem type %s has bad returnFiles pattern %q", action.Action, manifest.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// loadProblemTypeManifests stores the problem types described by manifests
+// in the database, replacing any existing actions for those types.
+func loadProblemTypeManifests(db *sql.DB, dir string) error {
+	manifests, err := readProblemTypeManifests(dir)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, manifest := range manifests {
+		result, err := tx.Exec(`UPDATE problem_types SET image = $1 WHERE name = $2`, manifest.Image, manifest.Name)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			if _, err := tx.Exec(`INSERT INTO problem_types (name, image) VALUES ($1, $2)`, manifest.Name, manifest.Image); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM problem_type_actions WHERE problem_type = $1`, manifest.Name); err != nil {
+			return err
+		}
+		for _, action := range manifest.Actions {
+			if err := meddler.Insert(tx, "problem_type_actions", &action.ProblemTypeAction); err != nil {
+				return err
+			}
+		}
+		log.Printf("loaded problem type %s from manifest", manifest.Name)
+	}
+
+	return tx.Commit()
+}
+
+// registerProblemTypeManifests creates handlers for the problem types described by manifests.
+func registerProblemTypeManifests(dir string) error {
+	manifests, err := readProblemTypeManifests(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, manifest := range manifests {
+		handlers := make(map[string]nannyHandler)
+		problemTypeHandlers[manifest.Name] = handlers
+		for _, action := range manifest.Actions {
+			handlers[action.Action] = action.handler(manifest.Name)
+		}
+	}
+	return nil
+}
+
+func (action *ProblemTypeManifestAction) handler(problemType string) nannyHandler {
+	return func(n *Nanny, args, options []string, files map[string]string, stdin io.Reader) {
+		log.Printf("%s %s", problemType, action.Action)
+		if action.Parser == "none" {
+			n.ExecSimple(action.Command, stdin, true)
+		} else {
+			runAndParseResults(n, action.Parser, action.Command, nil, action.ResultFile)
+		}
+		if len(action.ReturnFiles) > 0 && n.ReportCard.Passed {
+			returnChangedFiles(n, files, action.ReturnFiles)
+		}
+	}
+}
+
+// returnChangedFiles sends any files matching the patterns that were changed
+// in the sandbox back to the student.
+func returnChangedFiles(n *Nanny, files map[string]string, patterns []string) {
+	var names []string
+	for name := range files {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	after, err := n.GetFiles(names)
+	if err != nil {
+		log.Printf("error trying to download files from container: %v", err)
+		return
+	}
+	changed := make(map[string]string)
+	for name, contents := range after {
+		if files[name] != contents {
+			changed[name] = contents
+		}
+	}
+	if len(changed) > 0 {
+		n.Events <- &EventMessage{Event: "files", Files: changed}
+	}
+}
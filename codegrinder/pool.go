@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// sandboxPool keeps a set of pre-started, idle sandboxes ready for use.
+// Each sandbox is used by exactly one nanny and is destroyed afterward,
+// so the pool only hides startup latency; it never reuses a sandbox.
+//
+// Pools are keyed by everything that goes into creating a sandbox.
+// A key is only kept filled once a request has asked for it, and idle
+// sandboxes that are not claimed within poolMaxIdle are retired.
+type sandboxPool struct {
+	sync.Mutex
+	entries map[poolKey]*poolEntry
+	counter int64
+}
+
+type poolKey struct {
+	image       string
+	interactive bool
+	limits      limits
+}
+
+type poolEntry struct {
+	idle     []*pooledSandbox
+	pending  int
+	lastUsed time.Time
+}
+
+type pooledSandbox struct {
+	sandbox Sandbox
+	created time.Time
+}
+
+// checkedOutSandbox is a pooled sandbox in use by a nanny. Pooled sandboxes
+// are created with extra time to wait in the pool, so the time limit is
+// enforced from when the sandbox is checked out instead.
+type checkedOutSandbox struct {
+	Sandbox
+	timer *time.Timer
+}
+
+func checkOut(sandbox Sandbox, interactive bool, limits *limits, name string) *checkedOutSandbox {
+	s := &checkedOutSandbox{Sandbox: sandbox}
+	s.timer = time.AfterFunc(sandboxTimeLimit(interactive, limits), func() {
+		log.Printf("pooled sandbox for %s timed out", name)
+		if err := sandbox.Shutdown(); err != nil {
+			log.Printf("error shutting down pooled sandbox: %v", err)
+		}
+	})
+	return s
+}
+
+func (s *checkedOutSandbox) Shutdown() error {
+	s.timer.Stop()
+	return s.Sandbox.Shutdown()
+}
+
+// how long a sandbox may sit in the pool before it is retired
+const poolMaxIdle = 5 * time.Minute
+
+// how often to check for idle sandboxes to retire
+const poolExpireInterval = time.Minute
+
+var pool = &sandboxPool{entries: make(map[poolKey]*poolEntry)}
+
+// NewPooledSandbox returns a sandbox from the pool if one is available,
+// or creates a new one directly if not. Either way, the pool is topped up
+// in the background.
+//
+// Requests with terminal settings in their args are never pooled,
+// since the environment of a sandbox is fixed when it is created.
+func NewPooledSandbox(image string, interactive bool, args []string, limits *limits, name string) (Sandbox, error) {
+	if Config.PoolSize <= 0 || len(sandboxEnv(args)) != len(sandboxEnv(nil)) {
+		return NewSandbox(image, interactive, args, limits, name)
+	}
+
+	key := poolKey{image: image, interactive: interactive, limits: *limits}
+	if sandbox := pool.get(key); sandbox != nil {
+		poolHitsCounter.Add(1)
+		log.Printf("using pooled sandbox for %s", name)
+		return checkOut(sandbox, interactive, limits, name), nil
+	}
+	poolMissesCounter.Add(1)
+	return NewSandbox(image, interactive, args, limits, name)
+}
+
+// get takes an idle sandbox for the given key, or returns nil if none is ready.
+// It also starts refilling the pool for that key.
+func (p *sandboxPool) get(key poolKey) Sandbox {
+	p.Lock()
+	defer p.Unlock()
+
+	entry := p.entries[key]
+	if entry == nil {
+		entry = new(poolEntry)
+		p.entries[key] = entry
+	}
+	entry.lastUsed = time.Now()
+
+	var sandbox Sandbox
+	for sandbox == nil && len(entry.idle) > 0 {
+		elt := entry.idle[0]
+		entry.idle = entry.idle[1:]
+		poolSizeCounter.Add(-1)
+		if time.Since(elt.created) < poolMaxIdle {
+			sandbox = elt.sandbox
+		} else {
+			go elt.sandbox.Shutdown()
+		}
+	}
+
+	// top it up
+	for len(entry.idle)+entry.pending < Config.PoolSize {
+		entry.pending++
+		p.counter++
+		go p.fill(key, fmt.Sprintf("nanny-pool-%d", p.counter))
+	}
+
+	return sandbox
+}
+
+// fill creates a new sandbox and adds it to the pool.
+func (p *sandboxPool) fill(key poolKey, name string) {
+	l := key.limits
+	l.maxIdle = int64((poolMaxIdle + poolExpireInterval) / time.Second)
+	sandbox, err := NewSandbox(key.image, key.interactive, nil, &l, name)
+
+	p.Lock()
+	defer p.Unlock()
+	entry := p.entries[key]
+	entry.pending--
+	if err != nil {
+		log.Printf("error creating pooled sandbox: %v", err)
+		return
+	}
+	entry.idle = append(entry.idle, &pooledSandbox{sandbox: sandbox, created: time.Now()})
+	poolSizeCounter.Add(1)
+}
+
+// expire retires sandboxes that have been idle too long, and forgets keys
+// that are no longer being used.
+func (p *sandboxPool) expire() {
+	var retired []Sandbox
+
+	p.Lock()
+	for key, entry := range p.entries {
+		var keep []*pooledSandbox
+		for _, elt := range entry.idle {
+			if time.Since(elt.created) > poolMaxIdle {
+				retired = append(retired, elt.sandbox)
+				poolSizeCounter.Add(-1)
+			} else {
+				keep = append(keep, elt)
+			}
+		}
+		entry.idle = keep
+		if len(entry.idle) == 0 && entry.pending == 0 && time.Since(entry.lastUsed) > poolMaxIdle {
+			delete(p.entries, key)
+		}
+	}
+	p.Unlock()
+
+	for _, sandbox := range retired {
+		if err := sandbox.Shutdown(); err != nil {
+			log.Printf("error retiring pooled sandbox: %v", err)
+		}
+	}
+}
+
+// expirePool periodically retires idle sandboxes.
+func expirePool() {
+	for {
+		time.Sleep(poolExpireInterval)
+		pool.expire()
+	}
+}
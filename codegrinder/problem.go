@@ -73,6 +73,9 @@ func getProblemType(tx *sql.Tx, name string) (*ProblemType, error) {
 			if err != nil {
 				return err
 			}
+			if relpath == problemTypeManifestName {
+				return nil
+			}
 			raw, err := ioutil.ReadFile(path)
 			if err != nil {
 				return err
@@ -179,17 +182,32 @@ func GetProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, curren
 // deleting the given problem.
 // Note: this deletes all steps, assignments, and commits related to the problem,
 // and it removes it from any problem sets it was part of.
-func DeleteProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+func DeleteProblem(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor, render render.Render) {
 	problemID, err := strconv.ParseInt(params["problem_id"], 10, 64)
 	if err != nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing problem_id from URL: %v", err)
 		return
 	}
 
+	problem := new(Problem)
+	if err := meddler.Load(tx, "problems", problem, problemID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
 	if _, err := tx.Exec(`DELETE FROM problems WHERE id = $1`, problemID); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "problem.delete",
+		ObjectType: "problem",
+		ObjectID:   problem.ID,
+		Target:     problem.Unique,
+		Before:     problem,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 }
 
 // GetProblemSteps handles a request to /v2/problems/:problem_id/steps,
@@ -222,6 +240,9 @@ func GetProblemSteps(w http.ResponseWriter, r *http.Request, tx *sql.Tx, params
 		loggedHTTPErrorf(w, http.StatusNotFound, "not found")
 		return
 	}
+	if !currentUser.Admin && !currentUser.Author {
+		stripHiddenFiles(problemSteps)
+	}
 
 	render.JSON(http.StatusOK, problemSteps)
 }
@@ -253,6 +274,9 @@ func GetProblemStep(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cu
 		loggedHTTPDBNotFoundError(w, err)
 		return
 	}
+	if !currentUser.Admin && !currentUser.Author {
+		stripHiddenFiles([]*ProblemStep{problemStep})
+	}
 
 	render.JSON(http.StatusOK, problemStep)
 }
@@ -357,14 +381,29 @@ func GetProblemSetProblems(w http.ResponseWriter, r *http.Request, tx *sql.Tx, p
 // DeleteProblemSet handles request to /v2/problem_sets/:problem_set_id,
 // deleting the given problem set.
 // Note: this deletes all assignments and commits related to the problem set.
-func DeleteProblemSet(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+func DeleteProblemSet(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor, render render.Render) {
 	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
 	if err != nil {
 		return
 	}
 
+	problemSet := new(ProblemSet)
+	if err := meddler.Load(tx, "problem_sets", problemSet, problemSetID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
 	if _, err := tx.Exec(`DELETE FROM problem_sets WHERE id = $1`, problemSetID); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "problem_set.delete",
+		ObjectType: "problem_set",
+		ObjectID:   problemSet.ID,
+		Target:     problemSet.Unique,
+		Before:     problemSet,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 }
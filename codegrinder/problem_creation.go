@@ -16,7 +16,7 @@ import (
 // PostProblemBundleConfirmed handles a request to /v2/problem_bundles/confirmed,
 // creating a new problem.
 // The bundle must have a full set of passing commits signed by the daycare.
-func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle ProblemBundle, render render.Render) {
+func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, bundle ProblemBundle, render render.Render) {
 	if bundle.Problem == nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must contain a problem")
 		return
@@ -26,7 +26,7 @@ func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser *
 		return
 	}
 
-	saveProblemBundleCommon(w, tx, currentUser, &bundle, render)
+	saveProblemBundleCommon(w, tx, currentUser, audit, &bundle, render)
 }
 
 // PutProblemBundle handles a request to /v2/problem_bundles/:problem_id,
@@ -34,7 +34,7 @@ func PostProblemBundleConfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser *
 // The bundle must have a full set of passing commits signed by the daycare.
 // If any assignments exist that refer to this problem, then the updates cannot change the number
 // of steps in the problem.
-func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, bundle ProblemBundle, render render.Render) {
+func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, bundle ProblemBundle, render render.Render) {
 	if bundle.Problem == nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must contain a problem")
 		return
@@ -80,10 +80,10 @@ func PutProblemBundle(w http.ResponseWriter, tx *sql.Tx, params martini.Params,
 		}
 	}
 
-	saveProblemBundleCommon(w, tx, currentUser, &bundle, render)
+	saveProblemBundleCommon(w, tx, currentUser, audit, &bundle, render)
 }
 
-func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle *ProblemBundle, render render.Render) {
+func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, bundle *ProblemBundle, render render.Render) {
 	now := time.Now()
 
 	// clean up basic fields and do some checks
@@ -144,6 +144,7 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 	}
 
 	isUpdate, oldStepCount := false, 0
+	var before interface{}
 	if problem.ID != 0 {
 		isUpdate = true
 
@@ -152,6 +153,12 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 			return
 		}
+		old := new(Problem)
+		if err := meddler.Load(tx, "problems", old, problem.ID); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+		before = auditProblemSummary(old, oldStepCount)
 	}
 	if err := meddler.Save(tx, "problems", problem); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
@@ -168,8 +175,13 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 				loggedHTTPErrorf(w, http.StatusInternalServerError, "json error: %v", err)
 				return
 			}
-			if _, err = tx.Exec(`UPDATE problem_steps SET note=$1,instructions=$2,weight=$3,files=$4 WHERE problem_id=$5 AND step=$6`,
-				step.Note, step.Instructions, step.Weight, raw, step.ProblemID, step.Step); err != nil {
+			rawHidden, err := json.Marshal(step.HiddenFiles)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "json error: %v", err)
+				return
+			}
+			if _, err = tx.Exec(`UPDATE problem_steps SET note=$1,instructions=$2,weight=$3,files=$4,hidden_files=$5 WHERE problem_id=$6 AND step=$7`,
+				step.Note, step.Instructions, step.Weight, raw, rawHidden, step.ProblemID, step.Step); err != nil {
 				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 				return
 			}
@@ -196,6 +208,21 @@ func saveProblemBundleCommon(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 	} else {
 		log.Printf("problem %s (%d) with %d step(s) created", problem.Unique, problem.ID, len(steps))
 	}
+	action := "problem.create"
+	if isUpdate {
+		action = "problem.update"
+	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     action,
+		ObjectType: "problem",
+		ObjectID:   problem.ID,
+		Target:     problem.Unique,
+		Before:     before,
+		After:      auditProblemSummary(problem, len(steps)),
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, bundle)
 }
@@ -346,7 +373,7 @@ func PostProblemBundleUnconfirmed(w http.ResponseWriter, tx *sql.Tx, currentUser
 
 // PostProblemSetBundle handles requests to /v2/problem_set/bundles,
 // creating a new problem set.
-func PostProblemSetBundle(w http.ResponseWriter, tx *sql.Tx, bundle ProblemSetBundle, render render.Render) {
+func PostProblemSetBundle(w http.ResponseWriter, tx *sql.Tx, audit *auditor, bundle ProblemSetBundle, render render.Render) {
 	now := time.Now()
 
 	if bundle.ProblemSet == nil {
@@ -388,6 +415,16 @@ func PostProblemSetBundle(w http.ResponseWriter, tx *sql.Tx, bundle ProblemSetBu
 	}
 
 	log.Printf("problem set %s (%d) with %d problem(s) created", set.Unique, set.ID, len(bundle.ProblemSetProblems))
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "problem_set.create",
+		ObjectType: "problem_set",
+		ObjectID:   set.ID,
+		Target:     set.Unique,
+		After:      &bundle,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 
 	render.JSON(http.StatusOK, bundle)
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/russross/codegrinder/common"
+)
+
+// nannyQueue limits the number of nannies running at once on a daycare.
+// Requests beyond the limit wait in a FIFO queue, and requests beyond the
+// queue limit are turned away.
+type nannyQueue struct {
+	sync.Mutex
+	active  int
+	waiting []*queueTicket
+
+	// recent average number of seconds a request holds a slot,
+	// or zero if no request has finished yet
+	averageSeconds float64
+}
+
+// weight given to each new run time in the recent average
+const queueAverageWeight = 0.1
+
+// queueTicket represents one request waiting for (or holding) a nanny slot.
+// ready is closed when the request is admitted.
+type queueTicket struct {
+	ready    chan struct{}
+	admitted bool
+	start    time.Time
+}
+
+var daycareQueue = new(nannyQueue)
+
+// Enter joins the queue. If a slot is free the returned ticket is already admitted.
+func (q *nannyQueue) Enter() (*queueTicket, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	ticket := &queueTicket{ready: make(chan struct{})}
+	if q.active < Config.MaxNannies && len(q.waiting) == 0 {
+		q.admit(ticket)
+		return ticket, nil
+	}
+	if len(q.waiting) >= Config.MaxQueue {
+		queueRejectsCounter.Add(1)
+		return nil, fmt.Errorf("daycare %s is full (%d running, %d waiting); please try again in a few minutes",
+			Config.Hostname, q.active, len(q.waiting))
+	}
+	q.waiting = append(q.waiting, ticket)
+	nanniesQueuedCounter.Set(int64(len(q.waiting)))
+	return ticket, nil
+}
+
+// admit must be called with the lock held.
+func (q *nannyQueue) admit(ticket *queueTicket) {
+	q.active++
+	ticket.admitted = true
+	ticket.start = time.Now()
+	close(ticket.ready)
+	nanniesActiveCounter.Set(int64(q.active))
+}
+
+// Leave gives up a ticket. If it was admitted, its slot goes to the next
+// request in line and its running time is used to estimate future waits.
+func (q *nannyQueue) Leave(ticket *queueTicket) {
+	q.Lock()
+	defer q.Unlock()
+
+	if !ticket.admitted {
+		for i, elt := range q.waiting {
+			if elt == ticket {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				break
+			}
+		}
+		nanniesQueuedCounter.Set(int64(len(q.waiting)))
+		return
+	}
+
+	q.active--
+	seconds := time.Since(ticket.start).Seconds()
+	if q.averageSeconds == 0 {
+		q.averageSeconds = seconds
+	} else {
+		q.averageSeconds += queueAverageWeight * (seconds - q.averageSeconds)
+	}
+	averageNannySecondsCounter.Set(q.averageSeconds)
+	if len(q.waiting) > 0 && q.active < Config.MaxNannies {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.admit(next)
+		nanniesQueuedCounter.Set(int64(len(q.waiting)))
+	}
+	nanniesActiveCounter.Set(int64(q.active))
+}
+
+// Load reports the number of running and waiting requests, and the
+// recent average number of seconds each request has held a slot.
+func (q *nannyQueue) Load() (active, queued int, average float64) {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.active, len(q.waiting), q.averageSeconds
+}
+
+// Position reports where a ticket is in line (1 is next) and a rough
+// estimate of how long it will wait. The position is 0 once admitted.
+func (q *nannyQueue) Position(ticket *queueTicket) (int, time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	if ticket.admitted {
+		return 0, 0
+	}
+	for i, elt := range q.waiting {
+		if elt == ticket {
+			rounds := float64(i/Config.MaxNannies + 1)
+			eta := time.Duration(rounds*q.averageSeconds) * time.Second
+			return i + 1, eta
+		}
+	}
+	return 0, 0
+}
+
+// waitForTurn blocks until the ticket is admitted, keeping the client informed
+// of its place in line. It returns an error if the client goes away.
+func waitForTurn(socket *websocket.Conn, ticket *queueTicket) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastPosition := -1
+	var lastSent time.Time
+	for {
+		position, eta := daycareQueue.Position(ticket)
+		if position == 0 {
+			return nil
+		}
+
+		// report changes right away, and send a reminder periodically
+		// so we notice if the client has disconnected
+		if position != lastPosition || time.Since(lastSent) > 10*time.Second {
+			res := &DaycareResponse{Event: &EventMessage{
+				Time:          time.Now(),
+				Event:         "queue",
+				QueuePosition: position,
+				QueueETA:      eta,
+			}}
+			if err := socket.WriteJSON(res); err != nil {
+				return err
+			}
+			lastPosition = position
+			lastSent = time.Now()
+		}
+
+		select {
+		case <-ticket.ready:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
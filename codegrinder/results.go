@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+// resultParser fills in a report card from the contents of a test results file.
+type resultParser func(n *Nanny, contents string)
+
+// resultParsers are the test result formats that handlers and problem type
+// manifests can select by name.
+var resultParsers = map[string]resultParser{
+	"xunit":  parseXUnit,
+	"tap":    parseTAP,
+	"json":   parseJSONResults,
+	"gotest": parseGoTestJSON,
+}
+
+// runAndParseResults runs a test command and then parses the results file it
+// produces using the named parser.
+func runAndParseResults(n *Nanny, parser string, cmd []string, stdin io.Reader, filename string) {
+	parse := resultParsers[parser]
+	if parse == nil {
+		n.ReportCard.LogAndFailf("Unknown test result format %q", parser)
+		return
+	}
+
+	// run tests
+	_, _, _, status, err := n.Exec(cmd, stdin, false)
+	if err != nil {
+		n.ReportCard.LogAndFailf("Error running unit tests: %v", err)
+		return
+	}
+
+	// did it end in a segfault?
+	if status > 127 {
+		n.ReportCard.LogAndFailf("Crashed with exit status %d while running unit tests", status)
+		return
+	}
+	n.ReportCard.Passed = status == 0
+
+	// parse the test results
+	resultfiles, err := n.GetFiles([]string{filename})
+	if err != nil {
+		n.ReportCard.LogAndFailf("Unit test failed: unable to read results")
+		return
+	}
+
+	parse(n, resultfiles[filename])
+}
+
+func truncateDetails(details string) string {
+	if len(details) > MaxDetailsLen {
+		return details[:MaxDetailsLen]
+	}
+	return details
+}
+
+// TAP types
+var (
+	tapPlan      = regexp.MustCompile(`^1\.\.(\d+)`)
+	tapTestLine  = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(\w+)\b\s*(.*))?$`)
+	tapYAMLStart = regexp.MustCompile(`^\s+---\s*$`)
+	tapYAMLEnd   = regexp.MustCompile(`^\s+\.\.\.\s*$`)
+	tapFile      = regexp.MustCompile(`(?m)^\s*file:\s*['"]?([^'"\s]+)`)
+	tapLine      = regexp.MustCompile(`(?m)^\s*line:\s*(\d+)`)
+)
+
+type tapResult struct {
+	name      string
+	ok        bool
+	directive string
+	details   []string
+}
+
+// parseTAP reads results in the Test Anything Protocol, version 13.
+// YAML diagnostic blocks and comments following a failed test become its
+// details, and file: and line: entries in the YAML block give its context.
+func parseTAP(n *Nanny, contents string) {
+	var results []*tapResult
+	planned := -1
+	bailout := ""
+
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	scanner.Buffer(make([]byte, 64*1024), MaxDetailsLen)
+	inYAML := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		var last *tapResult
+		if len(results) > 0 {
+			last = results[len(results)-1]
+		}
+
+		switch {
+		case inYAML:
+			if tapYAMLEnd.MatchString(line) {
+				inYAML = false
+			} else if last != nil {
+				last.details = append(last.details, line+"\n")
+			}
+		case tapYAMLStart.MatchString(line):
+			inYAML = true
+		case strings.HasPrefix(line, "TAP version"):
+		case strings.HasPrefix(line, "Bail out!"):
+			bailout = strings.TrimSpace(strings.TrimPrefix(line, "Bail out!"))
+		case tapPlan.MatchString(line):
+			planned, _ = strconv.Atoi(tapPlan.FindStringSubmatch(line)[1])
+		case tapTestLine.MatchString(line):
+			groups := tapTestLine.FindStringSubmatch(line)
+			result := &tapResult{
+				name:      groups[3],
+				ok:        groups[1] == "",
+				directive: strings.ToUpper(groups[4]),
+			}
+			if result.name == "" {
+				result.name = fmt.Sprintf("test %d", len(results)+1)
+			}
+			if result.directive != "SKIP" && result.directive != "TODO" {
+				result.directive = ""
+			}
+			results = append(results, result)
+		case strings.HasPrefix(strings.TrimSpace(line), "#") && last != nil:
+			last.details = append(last.details, strings.TrimPrefix(strings.TrimSpace(line), "#")+"\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		n.ReportCard.LogAndFailf("error parsing unit test results: %v", err)
+		return
+	}
+
+	// form a report card
+	passed, fails := 0, 0
+	for _, result := range results {
+		details := truncateDetails(strings.Join(result.details, ""))
+		switch {
+		case result.directive != "":
+			// skipped tests and failing TODO tests do not count against the student
+			n.ReportCard.Results = append(n.ReportCard.Results, &ReportCardResult{
+				Name:    result.name,
+				Outcome: "skipped",
+				Details: details,
+			})
+		case result.ok:
+			passed++
+			n.ReportCard.AddPassedResult(result.name, "")
+		default:
+			fails++
+			ctx := ""
+			if groups := tapFile.FindStringSubmatch(details); len(groups) > 1 {
+				ctx = groups[1]
+				if groups := tapLine.FindStringSubmatch(details); len(groups) > 1 {
+					ctx += ":" + groups[1]
+				}
+			}
+			n.ReportCard.AddFailedResult(result.name, details, ctx)
+		}
+	}
+	if planned > len(results) {
+		fails++
+		n.ReportCard.AddFailedResult("plan", fmt.Sprintf("Planned %d tests but only %d ran\n", planned, len(results)), "")
+	}
+	if bailout != "" {
+		fails++
+		n.ReportCard.AddFailedResult("bail out", bailout+"\n", "")
+	}
+
+	n.ReportCard.Note = fmt.Sprintf("Passed %d/%d tests in %v",
+		passed, passed+fails, time.Since(n.Start))
+	n.ReportCard.Passed = n.ReportCard.Passed && len(results) > 0 && fails == 0
+}
+
+// JSONResults is a generic test result format for frameworks that can
+// write JSON. Each result uses the same fields as a ReportCardResult:
+//
+//	{
+//	    "results": [
+//	        { "name": "test_add", "outcome": "passed" },
+//	        { "name": "test_sub", "outcome": "failed", "details": "...", "context": "calc.py:12" }
+//	    ]
+//	}
+type JSONResults struct {
+	Results []*ReportCardResult `json:"results"`
+}
+
+func parseJSONResults(n *Nanny, contents string) {
+	results := new(JSONResults)
+	if err := json.Unmarshal([]byte(contents), results); err != nil {
+		n.ReportCard.LogAndFailf("error parsing unit test results: %v", err)
+		return
+	}
+
+	// form a report card
+	passed, fails := 0, 0
+	for _, result := range results.Results {
+		if result.Name == "" {
+			result.Name = fmt.Sprintf("test %d", len(n.ReportCard.Results)+1)
+		}
+		result.Details = truncateDetails(result.Details)
+		switch result.Outcome {
+		case "passed":
+			passed++
+		case "skipped":
+		case "failed", "error":
+			fails++
+		default:
+			fails++
+			result.Details = truncateDetails(fmt.Sprintf("unknown test outcome %q\n%s", result.Outcome, result.Details))
+			result.Outcome = "error"
+		}
+		n.ReportCard.Results = append(n.ReportCard.Results, result)
+	}
+
+	n.ReportCard.Note = fmt.Sprintf("Passed %d/%d tests in %v",
+		passed, passed+fails, time.Since(n.Start))
+	n.ReportCard.Passed = n.ReportCard.Passed && passed+fails > 0 && fails == 0
+}
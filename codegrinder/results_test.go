@@ -0,0 +1,165 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+// parseForTest runs a result parser as if the test command had exited
+// with the given status.
+func parseForTest(parser string, status int, contents string) *ReportCard {
+	n := &Nanny{ReportCard: NewReportCard(), Start: time.Now()}
+	n.ReportCard.Passed = status == 0
+	resultParsers[parser](n, contents)
+	return n.ReportCard
+}
+
+type expectedResult struct {
+	name    string
+	outcome string
+	context string
+}
+
+func checkResults(t *testing.T, card *ReportCard, passed bool, expected []expectedResult) {
+	if card.Passed != passed {
+		t.Errorf("report card passed = %v, expected %v (note: %s)", card.Passed, passed, card.Note)
+	}
+	if len(card.Results) != len(expected) {
+		t.Fatalf("found %d results, expected %d", len(card.Results), len(expected))
+	}
+	for i, elt := range expected {
+		result := card.Results[i]
+		if result.Name != elt.name || result.Outcome != elt.outcome || result.Context != elt.context {
+			t.Errorf("result %d is %q %s %q, expected %q %s %q",
+				i, result.Name, result.Outcome, result.Context, elt.name, elt.outcome, elt.context)
+		}
+	}
+}
+
+func TestParseTAP(t *testing.T) {
+	contents := `TAP version 13
+1..5
+ok 1 - adds numbers
+not ok 2 - subtracts numbers
+  ---
+  message: expected 1, got 2
+  file: calc.js
+  line: 14
+  ...
+ok 3 - multiplies # SKIP not ready
+not ok 4 divides # TODO later
+ok 5
+`
+	card := parseForTest("tap", 1, contents)
+	checkResults(t, card, false, []expectedResult{
+		{"adds numbers", "passed", ""},
+		{"subtracts numbers", "failed", "calc.js:14"},
+		{"multiplies", "skipped", ""},
+		{"divides", "skipped", ""},
+		{"test 5", "passed", ""},
+	})
+	if !strings.Contains(card.Results[1].Details, "expected 1, got 2") {
+		t.Errorf("details of failed test are %q", card.Results[1].Details)
+	}
+	if !strings.HasPrefix(card.Note, "Passed 2/3 tests") {
+		t.Errorf("note is %q", card.Note)
+	}
+}
+
+func TestParseTAPPlanAndBailOut(t *testing.T) {
+	contents := `1..3
+ok 1 - first
+Bail out! database went away
+`
+	card := parseForTest("tap", 0, contents)
+	checkResults(t, card, false, []expectedResult{
+		{"first", "passed", ""},
+		{"plan", "failed", ""},
+		{"bail out", "failed", ""},
+	})
+
+	// a clean exit with no tests is not a pass
+	card = parseForTest("tap", 0, "TAP version 13\n")
+	checkResults(t, card, false, nil)
+
+	card = parseForTest("tap", 0, "1..2\nok 1 - a\nok 2 - b\n")
+	checkResults(t, card, true, []expectedResult{
+		{"a", "passed", ""},
+		{"b", "passed", ""},
+	})
+}
+
+func TestParseJSONResults(t *testing.T) {
+	contents := `{
+	"results": [
+		{ "name": "test_add", "outcome": "passed" },
+		{ "name": "test_sub", "outcome": "failed", "details": "1 != 2", "context": "calc.py:12" },
+		{ "name": "test_mul", "outcome": "skipped" },
+		{ "outcome": "exploded" }
+	]
+}`
+	card := parseForTest("json", 1, contents)
+	checkResults(t, card, false, []expectedResult{
+		{"test_add", "passed", ""},
+		{"test_sub", "failed", "calc.py:12"},
+		{"test_mul", "skipped", ""},
+		{"test 4", "error", ""},
+	})
+	if !strings.Contains(card.Results[3].Details, `unknown test outcome "exploded"`) {
+		t.Errorf("details of unknown outcome are %q", card.Results[3].Details)
+	}
+
+	card = parseForTest("json", 0, `{"results": [{"name": "a", "outcome": "passed"}]}`)
+	checkResults(t, card, true, []expectedResult{{"a", "passed", ""}})
+
+	card = parseForTest("json", 0, `not json`)
+	checkResults(t, card, false, nil)
+}
+
+func TestParseGoTestJSON(t *testing.T) {
+	contents := `{"Action":"run","Package":"student","Test":"TestAdd"}
+{"Action":"output","Package":"student","Test":"TestAdd","Output":"=== RUN   TestAdd\n"}
+{"Action":"pass","Package":"student","Test":"TestAdd","Elapsed":0}
+{"Action":"run","Package":"student","Test":"TestSub"}
+{"Action":"run","Package":"student","Test":"TestSub/small"}
+{"Action":"output","Package":"student","Test":"TestSub/small","Output":"    calc_test.go:14: expected 1, got 2\n"}
+{"Action":"fail","Package":"student","Test":"TestSub/small","Elapsed":0}
+{"Action":"run","Package":"student","Test":"TestSub-edge"}
+{"Action":"pass","Package":"student","Test":"TestSub-edge","Elapsed":0}
+{"Action":"run","Package":"student","Test":"TestSub/large"}
+{"Action":"pass","Package":"student","Test":"TestSub/large","Elapsed":0}
+{"Action":"fail","Package":"student","Test":"TestSub","Elapsed":0}
+{"Action":"run","Package":"student","Test":"TestMul"}
+{"Action":"skip","Package":"student","Test":"TestMul","Elapsed":0}
+{"Action":"run","Package":"student","Test":"TestDiv"}
+{"Action":"output","Package":"student","Test":"TestDiv","Output":"panic: runtime error: integer divide by zero\n"}
+{"Action":"fail","Package":"student","Elapsed":0}
+`
+	card := parseForTest("gotest", 1, contents)
+	checkResults(t, card, false, []expectedResult{
+		{"TestAdd", "passed", ""},
+		{"TestDiv", "failed", ""},
+		{"TestMul", "skipped", ""},
+		{"TestSub-edge", "passed", ""},
+		{"TestSub/large", "passed", ""},
+		{"TestSub/small", "failed", "calc_test.go:14"},
+	})
+	if strings.Contains(card.Results[5].Details, "===") {
+		t.Errorf("progress lines were not removed from details: %q", card.Results[5].Details)
+	}
+
+	// build failures are reported as plain text with no tests
+	contents = `# student
+./calc.go:7:2: undefined: x
+{"Action":"output","Package":"student","Output":"FAIL\tstudent [build failed]\n"}
+{"Action":"fail","Package":"student","Elapsed":0}
+`
+	card = parseForTest("gotest", 2, contents)
+	checkResults(t, card, false, []expectedResult{{"build", "failed", ""}})
+	if !strings.Contains(card.Results[0].Details, "undefined: x") {
+		t.Errorf("build failure details are %q", card.Results[0].Details)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// courseRoleRank orders the course roles: each role can do anything
+// the roles ranked below it can do.
+var courseRoleRank = map[string]int{
+	RoleStudent:    1,
+	RoleGrader:     2,
+	RoleInstructor: 3,
+}
+
+// Roles is the set of roles held by the current user, whether granted
+// explicitly in the user_roles table or implied by the user's flags and
+// LTI launches.
+type Roles struct {
+	Global  map[string]bool
+	Courses map[int64]map[string]bool
+}
+
+func isGlobalRole(role string) bool {
+	return role == RoleAdmin || role == RoleAuthor
+}
+
+func isCourseRole(role string) bool {
+	return courseRoleRank[role] > 0
+}
+
+// loadRoles finds every role held by a user.
+func loadRoles(tx *sql.Tx, user *User) (*Roles, error) {
+	roles := &Roles{
+		Global:  make(map[string]bool),
+		Courses: make(map[int64]map[string]bool),
+	}
+	if user.Admin {
+		roles.Global[RoleAdmin] = true
+	}
+	if user.Author {
+		roles.Global[RoleAuthor] = true
+	}
+	addCourseRole := func(courseID int64, role string) {
+		if roles.Courses[courseID] == nil {
+			roles.Courses[courseID] = make(map[string]bool)
+		}
+		roles.Courses[courseID][role] = true
+	}
+
+	// roles implied by LTI launches
+	rows, err := tx.Query(`SELECT DISTINCT course_id, instructor, roles FROM assignments WHERE user_id = $1`, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		asst := new(Assignment)
+		if err := rows.Scan(&asst.CourseID, &asst.Instructor, &asst.Roles); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// teaching assistants may also be reported as instructors
+		switch {
+		case asst.IsTeachingAssistantRole():
+			addCourseRole(asst.CourseID, RoleGrader)
+		case asst.Instructor:
+			addCourseRole(asst.CourseID, RoleInstructor)
+		default:
+			addCourseRole(asst.CourseID, RoleStudent)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// explicit grants
+	grants := []*UserRole{}
+	if err := meddler.QueryAll(tx, &grants, `SELECT * FROM user_roles WHERE user_id = $1`, user.ID); err != nil {
+		return nil, err
+	}
+	for _, grant := range grants {
+		if grant.CourseID == 0 {
+			roles.Global[grant.Role] = true
+		} else {
+			addCourseRole(grant.CourseID, grant.Role)
+		}
+	}
+
+	return roles, nil
+}
+
+// Has reports whether the user holds a global role.
+// Administrators hold every role.
+func (roles *Roles) Has(role string) bool {
+	return roles.Global[RoleAdmin] || roles.Global[role]
+}
+
+// HasInCourse reports whether the user holds a course role (or a higher one)
+// in the given course.
+func (roles *Roles) HasInCourse(courseID int64, role string) bool {
+	if roles.Global[RoleAdmin] {
+		return true
+	}
+	for held := range roles.Courses[courseID] {
+		if courseRoleRank[held] >= courseRoleRank[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// HasInAnyCourse reports whether the user holds a course role (or a higher one)
+// in at least one course.
+func (roles *Roles) HasInAnyCourse(role string) bool {
+	if roles.Global[RoleAdmin] {
+		return true
+	}
+	for courseID := range roles.Courses {
+		if roles.HasInCourse(courseID, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary lists the roles in a form suitable to return through the API.
+func (roles *Roles) Summary() *RoleSummary {
+	summary := &RoleSummary{Global: []string{}, Courses: []*CourseRoles{}}
+	for role := range roles.Global {
+		summary.Global = append(summary.Global, role)
+	}
+	sort.Strings(summary.Global)
+	var courseIDs []int
+	for courseID := range roles.Courses {
+		courseIDs = append(courseIDs, int(courseID))
+	}
+	sort.Ints(courseIDs)
+	for _, courseID := range courseIDs {
+		elt := &CourseRoles{CourseID: int64(courseID)}
+		for role := range roles.Courses[int64(courseID)] {
+			elt.Roles = append(elt.Roles, role)
+		}
+		sort.Strings(elt.Roles)
+		summary.Courses = append(summary.Courses, elt)
+	}
+	return summary
+}
+
+// authorize returns a martini service that only lets a request through
+// if the current user holds one of the given roles (requires withCurrentUser).
+// With no roles listed, any signed-in user is allowed.
+//
+// Course roles are checked in the course named by the route: the
+// :course_id parameter, or else the course of the :assignment_id
+// parameter. Routes that do not name a course accept the role held
+// in any course; the handler is then responsible for limiting the
+// results to the courses the user can see.
+func authorize(allowed ...string) martini.Handler {
+	return func(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, roles *Roles) {
+		if len(allowed) == 0 || roles.Has(RoleAdmin) {
+			return
+		}
+
+		// find the course named by the route, if any
+		var courseID int64
+		if s, present := params["course_id"]; present {
+			id, err := parseID(w, "course_id", s)
+			if err != nil {
+				return
+			}
+			courseID = id
+		} else if s, present := params["assignment_id"]; present {
+			id, err := parseID(w, "assignment_id", s)
+			if err != nil {
+				return
+			}
+			if err := tx.QueryRow(`SELECT course_id FROM assignments WHERE id = $1`, id).Scan(&courseID); err != nil {
+				loggedHTTPDBNotFoundError(w, err)
+				return
+			}
+		}
+
+		for _, role := range allowed {
+			switch {
+			case isGlobalRole(role) && roles.Has(role):
+				return
+			case isCourseRole(role) && courseID > 0 && roles.HasInCourse(courseID, role):
+				return
+			case isCourseRole(role) && courseID == 0 && roles.HasInAnyCourse(role):
+				return
+			}
+		}
+		if courseID > 0 {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) does not have the required role in course %d", currentUser.ID, currentUser.Email, courseID)
+		} else {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) does not have the required role", currentUser.ID, currentUser.Email)
+		}
+	}
+}
+
+// GetUserMeRoles handles requests to /v2/users/me/roles,
+// returning every role held by the current user.
+func GetUserMeRoles(w http.ResponseWriter, roles *Roles, render render.Render) {
+	render.JSON(http.StatusOK, roles.Summary())
+}
+
+// GetRoles handles requests to /v2/roles,
+// returning all explicitly granted roles.
+// If parameter user_id=<...> is present, results will be limited to that user.
+// If parameter course_id=<...> is present, results will be limited to that course.
+func GetRoles(w http.ResponseWriter, r *http.Request, tx *sql.Tx, render render.Render) {
+	where := ""
+	args := []interface{}{}
+	for _, name := range []string{"user_id", "course_id"} {
+		if s := r.FormValue(name); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s: %v", name, err)
+				return
+			}
+			where, args = addWhereEq(where, args, name, id)
+		}
+	}
+	grants := []*UserRole{}
+	if err := meddler.QueryAll(tx, &grants, `SELECT * FROM user_roles`+where+` ORDER BY id`, args...); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, grants)
+}
+
+// PostRole handles requests to /v2/roles,
+// granting a global role, or a course role in any course.
+func PostRole(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, grant UserRole, render render.Render) {
+	if isGlobalRole(grant.Role) && grant.CourseID != 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "role %q cannot be granted in a course", grant.Role)
+		return
+	}
+	if isCourseRole(grant.Role) && grant.CourseID == 0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "role %q must be granted in a course", grant.Role)
+		return
+	}
+	saveRoleGrant(w, tx, currentUser, audit, &grant, render)
+}
+
+// GetCourseRoles handles requests to /v2/courses/:course_id/roles,
+// returning the roles explicitly granted in a course.
+func GetCourseRoles(w http.ResponseWriter, tx *sql.Tx, params martini.Params, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	grants := []*UserRole{}
+	if err := meddler.QueryAll(tx, &grants, `SELECT * FROM user_roles WHERE course_id = $1 ORDER BY id`, courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, grants)
+}
+
+// PostCourseRole handles requests to /v2/courses/:course_id/roles,
+// granting a role in a course. Instructors can add graders and students;
+// only administrators can add instructors.
+func PostCourseRole(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, roles *Roles, audit *auditor, grant UserRole, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	grant.CourseID = courseID
+	if !isCourseRole(grant.Role) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "role %q cannot be granted in a course", grant.Role)
+		return
+	}
+	if grant.Role == RoleInstructor && !roles.Has(RoleAdmin) {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "only an administrator can add an instructor")
+		return
+	}
+	saveRoleGrant(w, tx, currentUser, audit, &grant, render)
+}
+
+func saveRoleGrant(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, grant *UserRole, render render.Render) {
+	if !isGlobalRole(grant.Role) && !isCourseRole(grant.Role) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "unknown role %q", grant.Role)
+		return
+	}
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, grant.UserID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if grant.CourseID != 0 {
+		course := new(Course)
+		if err := meddler.Load(tx, "courses", course, grant.CourseID); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+	}
+
+	// granting a role the user already has is not an error
+	existing := new(UserRole)
+	err := meddler.QueryRow(tx, existing, `SELECT * FROM user_roles WHERE user_id = $1 AND role = $2 AND COALESCE(course_id, 0) = $3`,
+		grant.UserID, grant.Role, grant.CourseID)
+	if err == nil {
+		render.JSON(http.StatusOK, existing)
+		return
+	}
+	if err != sql.ErrNoRows {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	grant.ID = 0
+	grant.GrantedBy = currentUser.ID
+	grant.CreatedAt = time.Now()
+	if err := meddler.Insert(tx, "user_roles", grant); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) granted role %s in course %d to user %d (%s)",
+		currentUser.ID, currentUser.Email, grant.Role, grant.CourseID, user.ID, user.Email)
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "role.grant",
+		ObjectType: "user",
+		ObjectID:   user.ID,
+		CourseID:   grant.CourseID,
+		Target:     grant.Role,
+		After:      grant,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, grant)
+}
+
+// DeleteRole handles requests to /v2/roles/:role_id,
+// revoking any explicitly granted role.
+func DeleteRole(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor) {
+	roleID, err := parseID(w, "role_id", params["role_id"])
+	if err != nil {
+		return
+	}
+	grant := new(UserRole)
+	if err := meddler.Load(tx, "user_roles", grant, roleID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	revokeRoleGrant(w, tx, currentUser, audit, grant)
+}
+
+// DeleteCourseRole handles requests to /v2/courses/:course_id/roles/:role_id,
+// revoking a role granted in a course. Only administrators can remove instructors.
+func DeleteCourseRole(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, roles *Roles, audit *auditor) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	roleID, err := parseID(w, "role_id", params["role_id"])
+	if err != nil {
+		return
+	}
+	grant := new(UserRole)
+	if err := meddler.QueryRow(tx, grant, `SELECT * FROM user_roles WHERE id = $1 AND course_id = $2`, roleID, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if grant.Role == RoleInstructor && !roles.Has(RoleAdmin) {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "only an administrator can remove an instructor")
+		return
+	}
+	revokeRoleGrant(w, tx, currentUser, audit, grant)
+}
+
+func revokeRoleGrant(w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, grant *UserRole) {
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE id = $1`, grant.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) revoked role %s in course %d from user %d",
+		currentUser.ID, currentUser.Email, grant.Role, grant.CourseID, grant.UserID)
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "role.revoke",
+		ObjectType: "user",
+		ObjectID:   grant.UserID,
+		CourseID:   grant.CourseID,
+		Target:     grant.Role,
+		Before:     grant,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/russross/codegrinder/common"
+)
+
+// Sandbox is an isolated place to run student code.
+// A Nanny owns exactly one Sandbox, which is created when the nanny is
+// launched and destroyed when it shuts down. All paths are relative
+// to the student's home directory inside the sandbox.
+type Sandbox interface {
+	// PutFiles copies a set of files into the sandbox.
+	PutFiles(files map[string]string, mode int64) error
+
+	// GetFiles copies a set of files out of the sandbox.
+	GetFiles(filenames []string) (map[string]string, error)
+
+	// Exec runs a command in the sandbox, streaming its output to stdout and stderr,
+	// and waits for it to finish. It reports the resources the command used as well
+	// as the backend can measure them; wall-clock time is filled in by the caller.
+	Exec(cmd []string, stdin io.Reader, stdout, stderr io.Writer, useTTY bool) (status int, usage *ResourceUsage, err error)
+
+	// Shutdown kills anything still running in the sandbox and releases its resources.
+	Shutdown() error
+}
+
+// sandboxBackend creates a new sandbox that is ready to accept files and commands.
+type sandboxBackend func(image string, interactive bool, args []string, limits *limits, name string) (Sandbox, error)
+
+var sandboxBackends = make(map[string]sandboxBackend)
+
+// NewSandbox creates a sandbox using the backend selected in the config file.
+func NewSandbox(image string, interactive bool, args []string, limits *limits, name string) (Sandbox, error) {
+	backend := sandboxBackends[Config.Sandbox]
+	if backend == nil {
+		return nil, fmt.Errorf("unknown sandbox backend %q", Config.Sandbox)
+	}
+	return backend(image, interactive, args, limits, name)
+}
+
+// sandboxTimeLimit is how long a sandbox may be used before everything in it
+// is killed. Pooled sandboxes are created with extra time to sit idle, and
+// the pool enforces this limit from when they are checked out.
+func sandboxTimeLimit(interactive bool, limits *limits) time.Duration {
+	seconds := limits.maxCPU * 2
+	if interactive {
+		seconds = limits.maxSession
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// sandboxEnv returns the environment variables that should be passed to a
+// command running in a sandbox, including terminal settings requested by the client.
+func sandboxEnv(args []string) []string {
+	env := []string{"USER=student", "HOME=/home/student"}
+	for _, s := range args {
+		if strings.HasPrefix(s, "COLUMNS=") {
+			env = append(env, s)
+		}
+		if strings.HasPrefix(s, "LINES=") {
+			env = append(env, s)
+		}
+		if strings.HasPrefix(s, "TERM=") {
+			env = append(env, s)
+		}
+	}
+	return env
+}
+
+var uidsInUse map[int64]bool = make(map[int64]bool)
+var uidsMutex sync.Mutex
+
+func allocUID() (int64, error) {
+	uidsMutex.Lock()
+	defer uidsMutex.Unlock()
+	if len(uidsInUse) > 1000 {
+		err := fmt.Errorf("more than 1000 UIDs in use, cannot create more sandboxes")
+		log.Printf("%v", err)
+		return 0, err
+	}
+	for {
+		uid := rand.Int63n(1000) + 10000
+		if !uidsInUse[uid] {
+			uidsInUse[uid] = true
+			return uid, nil
+		}
+	}
+}
+
+func releaseUID(uid int64) {
+	uidsMutex.Lock()
+	defer uidsMutex.Unlock()
+	delete(uidsInUse, uid)
+}
+
+func uidgid(uid int64) string {
+	return fmt.Sprintf("%d:%d", uid, uid)
+}
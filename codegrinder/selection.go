@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// Instructors choose a problem set from inside the LMS by launching the
+// selection endpoint. We render a list of problem sets, and when one is
+// chosen we send a link to /v2/lti/problem_sets/:unique back to the LMS
+// using whichever mechanism the launch asked for:
+//
+// *   contentitem: an LTI 1.1 ContentItemSelection message signed with
+//     the consumer secret
+// *   extcontent: the older Canvas ext_content_return_url redirect
+// *   deeplink: an LTI 1.3 LtiDeepLinkingResponse signed with the tool key
+
+const (
+	ltiSelectionContentItem = "contentitem"
+	ltiSelectionExtContent  = "extcontent"
+	ltiSelectionDeepLink    = "deeplink"
+	ltiSelectionTimeout     = time.Hour
+)
+
+// ltiSelection records where to send the problem set an instructor picks.
+// It is signed and carried through the picker page in a hidden field.
+type ltiSelection struct {
+	Kind         string `json:"kind"`
+	ReturnURL    string `json:"returnURL"`
+	Data         string `json:"data,omitempty"`
+	ConsumerKey  string `json:"consumerKey,omitempty"`
+	PlatformID   int64  `json:"platformID,omitempty"`
+	DeploymentID string `json:"deploymentID,omitempty"`
+	UserID       int64  `json:"userID"`
+	ExpiresAt    int64  `json:"expiresAt"`
+}
+
+func (sel *ltiSelection) sign() (string, error) {
+	raw, err := json.Marshal(sel)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(Config.SessionSecret))
+	mac.Write(raw)
+	return base64.RawURLEncoding.EncodeToString(raw) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func parseLTISelection(token string) (*ltiSelection, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed selection token")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed selection token: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed selection token: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(Config.SessionSecret))
+	mac.Write(raw)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("selection token signature mismatch")
+	}
+	sel := new(ltiSelection)
+	if err := json.Unmarshal(raw, sel); err != nil {
+		return nil, fmt.Errorf("malformed selection token: %v", err)
+	}
+	if time.Now().After(time.Unix(sel.ExpiresAt, 0)) {
+		return nil, fmt.Errorf("selection token expired")
+	}
+	return sel, nil
+}
+
+// isInstructorLaunch returns true if the LTI roles allow choosing problem sets.
+func isInstructorLaunch(roles string) bool {
+	for _, role := range strings.Split(roles, ",") {
+		role = strings.TrimPrefix(strings.TrimSpace(role), "urn:lti:role:ims/lis/")
+		if role == "Instructor" || role == "ContentDeveloper" {
+			return true
+		}
+	}
+	return false
+}
+
+var pickerTemplate = template.Must(template.New("picker").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Choose a problem set</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+input[type=search] { width: 100%; padding: 0.3em; margin-bottom: 1em; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 0.3em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.tags { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Choose a problem set</h1>
+<input type="search" id="search" placeholder="Search by name, description, or tag" autofocus>
+<table>
+{{range .ProblemSets}}<tr data-search="{{.Search}}">
+<td><form method="POST" action="/v2/lti/selection">
+<input type="hidden" name="token" value="{{$.Token}}">
+<input type="hidden" name="unique" value="{{.Unique}}">
+<button type="submit">Select</button>
+</form></td>
+<td><code>{{.Unique}}</code><br>{{.Note}}<div class="tags">{{range .Tags}}{{.}} {{end}}</div></td>
+</tr>
+{{else}}<tr><td>No problem sets are available.</td></tr>
+{{end}}</table>
+<script>
+document.getElementById("search").addEventListener("input", function () {
+	var terms = this.value.toLowerCase().split(/\s+/);
+	var rows = document.querySelectorAll("tr[data-search]");
+	for (var i = 0; i < rows.length; i++) {
+		var text = rows[i].getAttribute("data-search");
+		var match = true;
+		for (var j = 0; j < terms.length; j++) {
+			if (text.indexOf(terms[j]) < 0) {
+				match = false;
+			}
+		}
+		rows[i].style.display = match ? "" : "none";
+	}
+});
+</script>
+</body>
+</html>
+`))
+
+// renderProblemSetPicker writes the page where an instructor chooses a problem set.
+func renderProblemSetPicker(w http.ResponseWriter, tx *sql.Tx, sel *ltiSelection) {
+	problemSets := []*ProblemSet{}
+	if err := meddler.QueryAll(tx, &problemSets, `SELECT * FROM problem_sets ORDER BY unique_id`); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	sel.ExpiresAt = time.Now().Add(ltiSelectionTimeout).Unix()
+	token, err := sel.sign()
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error signing selection: %v", err)
+		return
+	}
+
+	type pickerRow struct {
+		*ProblemSet
+		Search string
+	}
+	data := struct {
+		Token       string
+		ProblemSets []pickerRow
+	}{Token: token}
+	for _, elt := range problemSets {
+		search := strings.ToLower(elt.Unique + " " + elt.Note + " " + strings.Join(elt.Tags, " "))
+		data.ProblemSets = append(data.ProblemSets, pickerRow{ProblemSet: elt, Search: search})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pickerTemplate.Execute(w, data); err != nil {
+		loggedErrorf("error rendering problem set picker: %v", err)
+	}
+}
+
+var autoPostTemplate = template.Must(template.New("autopost").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.Action}}">
+{{range .Fields}}<input type="hidden" name="{{.Name}}" value="{{.Value}}">
+{{end}}<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+type autoPostField struct {
+	Name, Value string
+}
+
+// renderAutoPost writes a page that immediately posts the given fields to the LMS.
+func renderAutoPost(w http.ResponseWriter, action string, fields []autoPostField) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Action string
+		Fields []autoPostField
+	}{Action: action, Fields: fields}
+	if err := autoPostTemplate.Execute(w, data); err != nil {
+		loggedErrorf("error rendering form post: %v", err)
+	}
+}
+
+// PostLTISelection handles requests to /v2/lti/selection,
+// sending the problem set an instructor chose back to the LMS.
+func PostLTISelection(w http.ResponseWriter, r *http.Request, tx *sql.Tx) {
+	r.ParseForm()
+	sel, err := parseLTISelection(r.Form.Get("token"))
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusUnauthorized, "%v", err)
+		return
+	}
+	problemSet := new(ProblemSet)
+	if err := meddler.QueryRow(tx, problemSet, `SELECT * FROM problem_sets WHERE unique_id = $1`, r.Form.Get("unique")); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	link := getMyURL(r, false)
+	link.Path = ltiProblemSetPath + problemSet.Unique
+	title := problemSet.Unique
+	if problemSet.Note != "" {
+		title = problemSet.Note
+	}
+	now := time.Now()
+
+	switch sel.Kind {
+	case ltiSelectionExtContent:
+		u, err := url.Parse(sel.ReturnURL)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusBadRequest, "bad return URL: %v", err)
+			return
+		}
+		q := u.Query()
+		q.Set("return_type", "lti_launch_url")
+		q.Set("url", link.String())
+		q.Set("title", title)
+		q.Set("text", problemSet.Unique)
+		u.RawQuery = q.Encode()
+		http.Redirect(w, r, u.String(), http.StatusSeeOther)
+
+	case ltiSelectionContentItem:
+		items, err := json.Marshal(map[string]interface{}{
+			"@context": "http://purl.imsglobal.org/ctx/lti/v1/ContentItem",
+			"@graph": []interface{}{
+				map[string]interface{}{
+					"@type":     "LtiLinkItem",
+					"mediaType": "application/vnd.ims.lti.v1.ltilink",
+					"url":       link.String(),
+					"title":     title,
+					"text":      problemSet.Unique,
+					"lineItem": map[string]interface{}{
+						"@type": "LineItem",
+						"label": title,
+						"scoreConstraints": map[string]interface{}{
+							"@type":         "NumericLimits",
+							"normalMaximum": 100,
+						},
+					},
+				},
+			},
+		})
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error encoding content items: %v", err)
+			return
+		}
+		secret, err := getLTISecret(tx, sel.ConsumerKey)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusUnauthorized, "unable to find LTI secret: %v", err)
+			return
+		}
+		v := url.Values{}
+		v.Set("lti_message_type", "ContentItemSelection")
+		v.Set("lti_version", "LTI-1p0")
+		v.Set("content_items", string(items))
+		if sel.Data != "" {
+			v.Set("data", sel.Data)
+		}
+		v.Set("oauth_version", "1.0")
+		v.Set("oauth_consumer_key", sel.ConsumerKey)
+		v.Set("oauth_signature_method", "HMAC-SHA1")
+		v.Set("oauth_timestamp", strconv.FormatInt(now.Unix(), 10))
+		v.Set("oauth_nonce", strconv.FormatInt(now.UnixNano(), 10))
+		v.Set("oauth_callback", "about:blank")
+		v.Set("oauth_signature", computeOAuthSignature("POST", sel.ReturnURL, v, secret))
+
+		var fields []autoPostField
+		for _, name := range []string{"lti_message_type", "lti_version", "content_items", "data",
+			"oauth_version", "oauth_consumer_key", "oauth_signature_method", "oauth_timestamp", "oauth_nonce", "oauth_callback", "oauth_signature"} {
+			if _, present := v[name]; present {
+				fields = append(fields, autoPostField{Name: name, Value: v.Get(name)})
+			}
+		}
+		renderAutoPost(w, sel.ReturnURL, fields)
+
+	case ltiSelectionDeepLink:
+		platform := new(LTIPlatform)
+		if err := meddler.Load(tx, "lti_platforms", platform, sel.PlatformID); err != nil {
+			loggedHTTPDBNotFoundError(w, err)
+			return
+		}
+		nonce, err := newRandomToken()
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error generating nonce: %v", err)
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   platform.ClientID,
+			"aud":   platform.Issuer,
+			"iat":   now.Unix(),
+			"exp":   now.Add(5 * time.Minute).Unix(),
+			"nonce": nonce,
+			"https://purl.imsglobal.org/spec/lti/claim/message_type":  "LtiDeepLinkingResponse",
+			"https://purl.imsglobal.org/spec/lti/claim/version":       ltiVersion13,
+			"https://purl.imsglobal.org/spec/lti/claim/deployment_id": sel.DeploymentID,
+			"https://purl.imsglobal.org/spec/lti-dl/claim/content_items": []interface{}{
+				map[string]interface{}{
+					"type":  "ltiResourceLink",
+					"title": title,
+					"text":  problemSet.Unique,
+					"url":   link.String(),
+					"lineItem": map[string]interface{}{
+						"scoreMaximum": 100,
+						"label":        title,
+						"resourceId":   problemSet.Unique,
+					},
+				},
+			},
+		}
+		if sel.Data != "" {
+			claims["https://purl.imsglobal.org/spec/lti-dl/claim/data"] = sel.Data
+		}
+		token, err := signLTIToken(claims)
+		if err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "error signing deep linking response: %v", err)
+			return
+		}
+		renderAutoPost(w, sel.ReturnURL, []autoPostField{{Name: "JWT", Value: token}})
+
+	default:
+		loggedHTTPErrorf(w, http.StatusBadRequest, "unknown selection kind %q", sel.Kind)
+	}
+}
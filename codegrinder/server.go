@@ -25,7 +25,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/fsouza/go-dockerclient"
 	"github.com/go-martini/martini"
 	_ "github.com/lib/pq"
 	"github.com/martini-contrib/binding"
@@ -46,21 +45,29 @@ var Config struct {
 	LetsEncryptEmail string `json:"letsEncryptEmail"` // Email address to register TLS certificates: "foo@bar.com"
 
 	// ta-only required parameters
-	LTISecret     string `json:"ltiSecret"`     // LTI authentication shared secret. Must match that given to Canvas course: `head -c 32 /dev/urandom | base64`
+	LTISecret     string `json:"ltiSecret"`     // LTI shared secret for consumer keys not in the database. Must match that given to Canvas course: `head -c 32 /dev/urandom | base64`
 	SessionSecret string `json:"sessionSecret"` // Random string used to sign cookie sessions: `head -c 32 /dev/urandom | base64`
 	WWWDir        string `json:"wwwDir"`        // Full path of directory holding static files to serve: "/home/foo/codegrinder/www"
-	FilesDir      string `json:"filesDir"`      // Full path of directory holding problem-type files: "/home/foo/codegrinder/files"
+	FilesDir      string `json:"filesDir"`      // Full path of directory holding problem-type files and manifests: "/home/foo/codegrinder/files"
 
 	// daycare-only required parameters
 	TAHostname   string   `json:"taHostname"`   // Hostname for the TA: "your.host.goes.here". Defaults to Hostname
 	Capacity     int      `json:"capacity"`     // Relative capacity of this daycare for containers: 1
 	ProblemTypes []string `json:"problemTypes"` // List of problem types this daycare host supports: [ "python27unittest", "gotest", ... ]
 
+	// daycare-only parameters where the default is usually sufficient
+	Sandbox    string `json:"sandbox"`    // Sandbox backend used to run student code, "docker" or "local": default "docker"
+	PoolSize   int    `json:"poolSize"`   // Number of idle sandboxes to keep ready for each kind of request, or -1 to disable: default capacity
+	MaxNannies int    `json:"maxNannies"` // Number of requests this daycare will run at once: default number of CPUs
+	MaxQueue   int    `json:"maxQueue"`   // Number of requests that may wait for a turn before new ones are turned away: default 10 * maxNannies
+
 	// ta-only parameters where the default is usually sufficient
 	ToolName         string `json:"toolName"`         // LTI human readable name: default "CodeGrinder"
 	ToolID           string `json:"toolID"`           // LTI unique ID: default "codegrinder"
 	ToolDescription  string `json:"toolDescription"`  // LTI description: default "Programming exercises with grading"
 	LetsEncryptCache string `json:"letsEncryptCache"` // Full path of LetsEncrypt cache file: default "/etc/codegrinder/letsencrypt.cache"
+	LTITimestampSkew int    `json:"ltiTimestampSkew"` // Seconds an LTI launch timestamp may differ from the current time: default 300
+	LTIKeyFile       string `json:"ltiKeyFile"`       // Full path of the private key for LTI 1.3, created if missing: default "/etc/codegrinder/lti.key"
 	PostgresHost     string `json:"postgresHost"`     // Host parameter for Postgres: default "/var/run/postgresql"
 	PostgresPort     string `json:"postgresPort"`     // Port parameter for Postgres: default "5432"
 	PostgresUsername string `json:"postgresUsername"` // Username parameter for Postgres: default $USER
@@ -88,6 +95,8 @@ func main() {
 	Config.ToolID = "codegrinder"
 	Config.ToolDescription = "Programming exercises with grading"
 	Config.LetsEncryptCache = "/etc/codegrinder/letsencrypt.cache"
+	Config.LTITimestampSkew = 300
+	Config.LTIKeyFile = "/etc/codegrinder/lti.key"
 	Config.PostgresHost = "/var/run/postgresql"
 	Config.PostgresPort = ""
 	Config.PostgresUsername = os.Getenv("USER")
@@ -181,7 +190,7 @@ func main() {
 
 		// make sure relevant secrets are included in config file
 		if Config.LTISecret == "" {
-			log.Fatalf("cannot run TA role with no ltiSecret in the config file")
+			log.Printf("no ltiSecret in the config file, so only consumer keys in the database will be accepted")
 		}
 		if Config.SessionSecret == "" {
 			log.Fatalf("cannot run TA role with no sessionSecret in the config file")
@@ -195,6 +204,20 @@ func main() {
 
 		// set up the database
 		db := setupDB(Config.PostgresHost, Config.PostgresPort, Config.PostgresUsername, Config.PostgresPassword, Config.PostgresDatabase)
+		m.Map(db)
+
+		// load any problem types described by manifests
+		if err := loadProblemTypeManifests(db, Config.FilesDir); err != nil {
+			log.Fatalf("error loading problem type manifests: %v", err)
+		}
+
+		// load the key used to sign LTI 1.3 service requests
+		if err := loadLTIToolKey(Config.LTIKeyFile); err != nil {
+			log.Fatalf("error loading LTI key: %v", err)
+		}
+
+		// post grades to the LMS in the background
+		go gradePostWorker(db)
 
 		// martini service: wrap handler in a transaction
 		withTx := func(c martini.Context, w http.ResponseWriter) {
@@ -209,37 +232,41 @@ func main() {
 			c.Map(tx)
 			c.Next()
 
-			// was it a successful result?
+			// was it a successful result? a handler that calls out to
+			// another service may have finished the transaction itself
 			rw := w.(martini.ResponseWriter)
 			if rw.Status() < http.StatusBadRequest {
 				// commit the transaction
-				if err := tx.Commit(); err != nil {
+				if err := tx.Commit(); err != nil && err != sql.ErrTxDone {
 					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error committing transaction: %v", err)
 					return
 				}
 			} else {
 				// rollback
 				log.Printf("rolling back transaction")
-				if err := tx.Rollback(); err != nil {
+				if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
 					loggedHTTPErrorf(w, http.StatusInternalServerError, "db error rolling back transaction: %v", err)
 					return
 				}
 			}
 		}
 
-		// martini service: to require an active logged-in session
-		auth := func(w http.ResponseWriter, session sessions.Session) {
-			if userID := session.Get("id"); userID == nil {
-				loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication: no user ID found in session")
+		// martini service: to require an active logged-in session or an API token
+		auth := func(c martini.Context, w http.ResponseWriter, r *http.Request, session sessions.Session) {
+			if header := r.Header.Get("Authorization"); header != "" {
+				token, err := checkAPIToken(db, header, r.Method)
+				if err != nil {
+					loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication: %v", err)
+					return
+				}
+				c.Map(token)
+				c.Map(authUserID(token.UserID))
 				return
 			}
-		}
 
-		// martini service: include the current logged-in user (requires withTx and auth)
-		withCurrentUser := func(c martini.Context, w http.ResponseWriter, tx *sql.Tx, session sessions.Session) {
 			rawID := session.Get("id")
 			if rawID == nil {
-				loggedHTTPErrorf(w, http.StatusInternalServerError, "cannot find user ID in session")
+				loggedHTTPErrorf(w, http.StatusUnauthorized, "authentication: no user ID found in session")
 				return
 			}
 			userID, ok := rawID.(int64)
@@ -248,6 +275,13 @@ func main() {
 				loggedHTTPErrorf(w, http.StatusInternalServerError, "error extracting user ID from session")
 				return
 			}
+			c.Map((*APIToken)(nil))
+			c.Map(authUserID(userID))
+		}
+
+		// martini service: include the current logged-in user and their roles (requires withTx and auth)
+		withCurrentUser := func(c martini.Context, w http.ResponseWriter, r *http.Request, tx *sql.Tx, rawID authUserID) {
+			userID := int64(rawID)
 
 			// load the user record
 			user := new(User)
@@ -260,27 +294,31 @@ func main() {
 				return
 			}
 
-			// map the current user to the request context
-			c.Map(user)
-		}
-
-		// martini service: require logged in user to be an administrator (requires withCurrentUser)
-		administratorOnly := func(w http.ResponseWriter, currentUser *User) {
-			if !currentUser.Admin {
-				loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an administrator", currentUser.ID, currentUser.Email)
-				return
-			}
-		}
-
-		// martini service: require logged in user to be an author or administrator (requires withCurrentUser)
-		authorOnly := func(w http.ResponseWriter, tx *sql.Tx, currentUser *User) {
-			if currentUser.Admin {
+			// load the user's roles; the Admin and Author fields report
+			// the global roles however they were granted
+			roles, err := loadRoles(tx, user)
+			if err != nil {
+				loggedHTTPErrorf(w, http.StatusInternalServerError, "db error loading roles: %v", err)
 				return
 			}
-			if !currentUser.Author {
-				loggedHTTPErrorf(w, http.StatusUnauthorized, "user %d (%s) is not an author", currentUser.ID, currentUser.Name)
-				return
+			user.Admin = roles.Global[RoleAdmin]
+			user.Author = roles.Global[RoleAuthor]
+
+			// an administrator can act as another user for support
+			actor := user
+			var imp *Impersonation
+			if header := r.Header.Get(ImpersonationHeader); header != "" {
+				var ok bool
+				if imp, user, roles, ok = impersonate(w, r, tx, db, user, roles, header); !ok {
+					return
+				}
 			}
+
+			// map the current user to the request context
+			c.Map(imp)
+			c.Map(newAuditor(actor, imp))
+			c.Map(user)
+			c.Map(roles)
 		}
 
 		// version
@@ -292,7 +330,7 @@ func main() {
 		r.Get("/v2/daycare_registrations",
 			func(w http.ResponseWriter, render render.Render) {
 				daycareRegistrations.Expire()
-				render.JSON(http.StatusOK, daycareRegistrations.daycares)
+				render.JSON(http.StatusOK, daycareRegistrations.List())
 			})
 		r.Post("/v2/daycare_registrations", binding.Json(DaycareRegistration{}),
 			func(w http.ResponseWriter, reg DaycareRegistration) {
@@ -304,7 +342,7 @@ func main() {
 			})
 
 		// stats
-		r.Get("/v2/stats", auth, withTx, withCurrentUser, authorOnly, func(w http.ResponseWriter, r *http.Request) {
+		r.Get("/v2/stats", auth, withTx, withCurrentUser, authorize(RoleAuthor), func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			fmt.Fprintf(w, "{\n")
 			first := true
@@ -320,62 +358,116 @@ func main() {
 
 		// LTI
 		r.Get("/v2/lti/config.xml", counter, GetConfigXML)
-		r.Post("/v2/lti/problem_sets", counter, binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSets)
-		r.Post("/v2/lti/problem_sets/:unique", counter, binding.Bind(LTIRequest{}), checkOAuthSignature, withTx, LtiProblemSet)
+		r.Post("/v2/lti/problem_sets", counter, binding.Bind(LTIRequest{}), withTx, checkOAuthSignature, checkOAuthNonce, LtiProblemSets)
+		r.Post("/v2/lti/problem_sets/:unique", counter, binding.Bind(LTIRequest{}), withTx, checkOAuthSignature, checkOAuthNonce, LtiProblemSet)
+		r.Post("/v2/lti/selection", counter, withTx, PostLTISelection)
+
+		// LTI 1.3
+		r.Get("/v2/lti13/jwks", counter, GetLTIJWKS)
+		r.Get("/v2/lti13/login", counter, withTx, LTI13Login)
+		r.Post("/v2/lti13/login", counter, withTx, LTI13Login)
+		r.Post("/v2/lti13/launch", counter, withTx, LTI13Launch)
+		r.Get("/v2/lti_platforms", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), GetLTIPlatforms)
+		r.Post("/v2/lti_platforms", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), binding.Json(LTIPlatform{}), PostLTIPlatform)
+		r.Put("/v2/lti_platforms/:lti_platform_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), binding.Json(LTIPlatform{}), PutLTIPlatform)
+		r.Delete("/v2/lti_platforms/:lti_platform_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteLTIPlatform)
+		r.Post("/v2/courses/:course_id/roster", counter, auth, withTx, withCurrentUser, authorize(RoleInstructor), PostCourseRoster)
+
+		// LTI consumer keys
+		r.Get("/v2/lti_consumers", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), GetLTIConsumers)
+		r.Post("/v2/lti_consumers", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), binding.Json(LTIConsumer{}), PostLTIConsumer)
+		r.Post("/v2/lti_consumers/:lti_consumer_id/rotate", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), PostLTIConsumerRotate)
+		r.Post("/v2/lti_consumers/:lti_consumer_id/disable", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), PostLTIConsumerDisable)
+		r.Post("/v2/lti_consumers/:lti_consumer_id/enable", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), PostLTIConsumerEnable)
 
 		// problem bundles--for problem creation only
-		r.Post("/v2/problem_bundles/unconfirmed", counter, auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PostProblemBundleUnconfirmed)
-		r.Post("/v2/problem_bundles/confirmed", counter, auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PostProblemBundleConfirmed)
-		r.Put("/v2/problem_bundles/:problem_id", counter, auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemBundle{}), PutProblemBundle)
+		r.Post("/v2/problem_bundles/unconfirmed", counter, auth, withTx, withCurrentUser, authorize(RoleAuthor), binding.Json(ProblemBundle{}), PostProblemBundleUnconfirmed)
+		r.Post("/v2/problem_bundles/confirmed", counter, auth, withTx, withCurrentUser, authorize(RoleAuthor), binding.Json(ProblemBundle{}), PostProblemBundleConfirmed)
+		r.Put("/v2/problem_bundles/:problem_id", counter, auth, withTx, withCurrentUser, authorize(RoleAuthor), binding.Json(ProblemBundle{}), PutProblemBundle)
 
 		// problem set bundles--for problem set creation only
-		r.Post("/v2/problem_set_bundles", counter, auth, withTx, withCurrentUser, authorOnly, binding.Json(ProblemSetBundle{}), PostProblemSetBundle)
+		r.Post("/v2/problem_set_bundles", counter, auth, withTx, withCurrentUser, authorize(RoleAuthor), binding.Json(ProblemSetBundle{}), PostProblemSetBundle)
 
 		// problem types
-		r.Get("/v2/problem_types", counter, auth, withTx, GetProblemTypes)
-		r.Get("/v2/problem_types/:name", counter, auth, withTx, GetProblemType)
+		r.Get("/v2/problem_types", counter, auth, withTx, withCurrentUser, authorize(), GetProblemTypes)
+		r.Get("/v2/problem_types/:name", counter, auth, withTx, withCurrentUser, authorize(), GetProblemType)
 
 		// problems
-		r.Get("/v2/problems", counter, auth, withTx, withCurrentUser, GetProblems)
-		r.Get("/v2/problems/:problem_id", counter, auth, withTx, withCurrentUser, GetProblem)
-		r.Get("/v2/problems/:problem_id/steps", counter, auth, withTx, withCurrentUser, GetProblemSteps)
-		r.Get("/v2/problems/:problem_id/steps/:step", counter, auth, withTx, withCurrentUser, GetProblemStep)
-		r.Delete("/v2/problems/:problem_id", counter, auth, withTx, withCurrentUser, administratorOnly, DeleteProblem)
+		r.Get("/v2/problems", counter, auth, withTx, withCurrentUser, authorize(), GetProblems)
+		r.Get("/v2/problems/:problem_id", counter, auth, withTx, withCurrentUser, authorize(), GetProblem)
+		r.Get("/v2/problems/:problem_id/steps", counter, auth, withTx, withCurrentUser, authorize(), GetProblemSteps)
+		r.Get("/v2/problems/:problem_id/steps/:step", counter, auth, withTx, withCurrentUser, authorize(), GetProblemStep)
+		r.Delete("/v2/problems/:problem_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteProblem)
 
 		// problem sets
-		r.Get("/v2/problem_sets", counter, auth, withTx, withCurrentUser, GetProblemSets)
-		r.Get("/v2/problem_sets/:problem_set_id", counter, auth, withTx, withCurrentUser, GetProblemSet)
-		r.Get("/v2/problem_sets/:problem_set_id/problems", counter, auth, withTx, withCurrentUser, GetProblemSetProblems)
-		r.Delete("/v2/problem_sets/:problem_set_id", counter, auth, withTx, withCurrentUser, administratorOnly, DeleteProblemSet)
+		r.Get("/v2/problem_sets", counter, auth, withTx, withCurrentUser, authorize(), GetProblemSets)
+		r.Get("/v2/problem_sets/:problem_set_id", counter, auth, withTx, withCurrentUser, authorize(), GetProblemSet)
+		r.Get("/v2/problem_sets/:problem_set_id/problems", counter, auth, withTx, withCurrentUser, authorize(), GetProblemSetProblems)
+		r.Delete("/v2/problem_sets/:problem_set_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteProblemSet)
 
 		// courses
-		r.Get("/v2/courses", counter, auth, withTx, withCurrentUser, GetCourses)
-		r.Get("/v2/courses/:course_id", counter, auth, withTx, withCurrentUser, GetCourse)
-		r.Delete("/v2/courses/:course_id", counter, auth, withTx, withCurrentUser, administratorOnly, DeleteCourse)
+		r.Get("/v2/courses", counter, auth, withTx, withCurrentUser, authorize(), GetCourses)
+		r.Get("/v2/courses/:course_id", counter, auth, withTx, withCurrentUser, authorize(), GetCourse)
+		r.Delete("/v2/courses/:course_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteCourse)
 
 		// users
-		r.Get("/v2/users", counter, auth, withTx, withCurrentUser, GetUsers)
-		r.Get("/v2/users/me", counter, auth, withTx, withCurrentUser, GetUserMe)
-		r.Get("/v2/users/me/cookie", counter, auth, GetUserMeCookie)
-		r.Get("/v2/users/:user_id", counter, auth, withTx, withCurrentUser, GetUser)
-		r.Get("/v2/courses/:course_id/users", counter, auth, withTx, withCurrentUser, GetCourseUsers)
-		r.Delete("/v2/users/:user_id", counter, auth, withTx, withCurrentUser, administratorOnly, DeleteUser)
+		r.Get("/v2/users", counter, auth, withTx, withCurrentUser, authorize(), GetUsers)
+		r.Get("/v2/users/me", counter, auth, withTx, withCurrentUser, authorize(), GetUserMe)
+		r.Get("/v2/users/me/tokens", counter, auth, withTx, withCurrentUser, authorize(), GetUserMeTokens)
+		r.Post("/v2/users/me/tokens", counter, auth, withTx, withCurrentUser, authorize(), binding.Json(APIToken{}), PostUserMeToken)
+		r.Delete("/v2/users/me/tokens/:token_id", counter, auth, withTx, withCurrentUser, authorize(), DeleteUserMeToken)
+
+		r.Get("/v2/users/:user_id", counter, auth, withTx, withCurrentUser, authorize(), GetUser)
+		r.Get("/v2/courses/:course_id/users", counter, auth, withTx, withCurrentUser, authorize(), GetCourseUsers)
+		r.Delete("/v2/users/:user_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteUser)
+
+		// device logins for grind
+		r.Post("/v2/device/code", counter, withTx, PostDeviceCode)
+		r.Post("/v2/device/token", counter, withTx, binding.Json(DeviceCode{}), PostDeviceToken)
+		r.Get("/v2/device", counter, auth, withTx, withCurrentUser, authorize(), GetDevice)
+		r.Post("/v2/device", counter, auth, withTx, withCurrentUser, authorize(), PostDevice)
+
+		// roles
+		r.Get("/v2/users/me/roles", counter, auth, withTx, withCurrentUser, authorize(), GetUserMeRoles)
+		r.Get("/v2/roles", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), GetRoles)
+		r.Post("/v2/roles", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), binding.Json(UserRole{}), PostRole)
+		r.Delete("/v2/roles/:role_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteRole)
+		r.Get("/v2/courses/:course_id/roles", counter, auth, withTx, withCurrentUser, authorize(RoleGrader), GetCourseRoles)
+		r.Post("/v2/courses/:course_id/roles", counter, auth, withTx, withCurrentUser, authorize(RoleInstructor), binding.Json(UserRole{}), PostCourseRole)
+		r.Delete("/v2/courses/:course_id/roles/:role_id", counter, auth, withTx, withCurrentUser, authorize(RoleInstructor), DeleteCourseRole)
+
+		// impersonation
+		r.Get("/v2/impersonations", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), GetImpersonations)
+		r.Post("/v2/impersonations", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), binding.Json(Impersonation{}), PostImpersonation)
+		r.Delete("/v2/impersonations/:impersonation_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteImpersonation)
+
+		// audit log
+		r.Get("/v2/audit_log", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), GetAuditLog)
 
 		// assignments
-		r.Get("/v2/users/:user_id/assignments", counter, auth, withTx, withCurrentUser, GetUserAssignments)
-		r.Get("/v2/courses/:course_id/users/:user_id/assignments", counter, auth, withTx, withCurrentUser, GetCourseUserAssignments)
-		r.Get("/v2/assignments", counter, auth, withTx, withCurrentUser, GetAssignments)
-		r.Get("/v2/assignments/:assignment_id", counter, auth, withTx, withCurrentUser, GetAssignment)
-		r.Delete("/v2/assignments/:assignment_id", counter, auth, withTx, withCurrentUser, administratorOnly, DeleteAssignment)
+		r.Get("/v2/users/:user_id/assignments", counter, auth, withTx, withCurrentUser, authorize(), GetUserAssignments)
+		r.Get("/v2/courses/:course_id/users/:user_id/assignments", counter, auth, withTx, withCurrentUser, authorize(), GetCourseUserAssignments)
+		r.Get("/v2/assignments", counter, auth, withTx, withCurrentUser, authorize(), GetAssignments)
+		r.Get("/v2/assignments/:assignment_id", counter, auth, withTx, withCurrentUser, authorize(), GetAssignment)
+		r.Delete("/v2/assignments/:assignment_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteAssignment)
+		r.Put("/v2/assignments/:assignment_id/extension", counter, auth, withTx, withCurrentUser, authorize(RoleInstructor), binding.Json(AssignmentExtension{}), PutAssignmentExtension)
+		r.Put("/v2/courses/:course_id/problem_sets/:problem_set_id/due_date", counter, auth, withTx, withCurrentUser, authorize(RoleInstructor), binding.Json(AssignmentDueDate{}), PutCourseProblemSetDueDate)
 
 		// commits
-		r.Get("/v2/assignments/:assignment_id/problems/:problem_id/commits/last", counter, auth, withTx, withCurrentUser, GetAssignmentProblemCommitLast)
-		r.Get("/v2/assignments/:assignment_id/problems/:problem_id/steps/:step/commits/last", counter, auth, withTx, withCurrentUser, GetAssignmentProblemStepCommitLast)
-		r.Delete("/v2/commits/:commit_id", counter, auth, withTx, withCurrentUser, administratorOnly, DeleteCommit)
+		r.Get("/v2/assignments/:assignment_id/problems/:problem_id/commits", counter, auth, withTx, withCurrentUser, authorize(), GetAssignmentProblemCommits)
+		r.Get("/v2/assignments/:assignment_id/problems/:problem_id/commits/last", counter, auth, withTx, withCurrentUser, authorize(), GetAssignmentProblemCommitLast)
+		r.Get("/v2/assignments/:assignment_id/problems/:problem_id/steps/:step/commits/last", counter, auth, withTx, withCurrentUser, authorize(), GetAssignmentProblemStepCommitLast)
+		r.Get("/v2/commits/:commit_id", counter, auth, withTx, withCurrentUser, authorize(), GetCommit)
+		r.Delete("/v2/commits/:commit_id", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), DeleteCommit)
+
+		// grade posts
+		r.Get("/v2/grade_posts", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), GetGradePosts)
+		r.Post("/v2/grade_posts/:grade_post_id/retry", counter, auth, withTx, withCurrentUser, authorize(RoleAdmin), PostGradePostRetry)
+		r.Post("/v2/courses/:course_id/grade_posts", counter, auth, withTx, withCurrentUser, authorize(RoleInstructor), PostCourseGradePosts)
 
 		// commit bundles
-		r.Post("/v2/commit_bundles/unsigned", counter, auth, withTx, withCurrentUser, binding.Json(CommitBundle{}), PostCommitBundlesUnsigned)
-		r.Post("/v2/commit_bundles/signed", counter, auth, withTx, withCurrentUser, binding.Json(CommitBundle{}), PostCommitBundlesSigned)
+		r.Post("/v2/commit_bundles/unsigned", counter, auth, withTx, withCurrentUser, authorize(), binding.Json(CommitBundle{}), PostCommitBundlesUnsigned)
+		r.Post("/v2/commit_bundles/signed", counter, auth, withTx, withCurrentUser, authorize(), binding.Json(CommitBundle{}), PostCommitBundlesSigned)
 	}
 
 	// set up daycare role
@@ -394,18 +486,40 @@ func main() {
 			log.Fatalf("Daycare capacity must be greater than zero")
 		}
 
-		// attach to docker and try a ping
-		var err error
-		dockerClient, err = docker.NewVersionedClient("unix:///var/run/docker.sock", "1.23")
-		if err != nil {
-			log.Fatalf("NewVersionedClient: %v", err)
+		if Config.Sandbox == "" {
+			Config.Sandbox = "docker"
+		}
+		if sandboxBackends[Config.Sandbox] == nil {
+			log.Fatalf("unknown sandbox backend %q", Config.Sandbox)
+		}
+		if Config.PoolSize == 0 {
+			Config.PoolSize = Config.Capacity
+		}
+		if Config.MaxNannies <= 0 {
+			Config.MaxNannies = runtime.NumCPU()
+		}
+		if Config.MaxQueue <= 0 {
+			Config.MaxQueue = 10 * Config.MaxNannies
+		}
+
+		// create handlers for the problem types described by manifests
+		if Config.FilesDir == "" {
+			log.Fatalf("cannot run daycare role with no filesDir in the config file")
 		}
-		if err = dockerClient.Ping(); err != nil {
-			log.Fatalf("Ping: %v", err)
+		if err := registerProblemTypeManifests(Config.FilesDir); err != nil {
+			log.Fatalf("error loading problem type manifests: %v", err)
+		}
+
+		// attach to docker and try a ping
+		if Config.Sandbox == "docker" {
+			setupDocker()
 		}
 
 		r.Get("/v2/sockets/:problem_type/:action", SocketProblemTypeAction)
 
+		// retire idle sandboxes from the warm pool
+		go expirePool()
+
 		// register with the TA periodically
 		go func() {
 			if ta {
@@ -415,12 +529,17 @@ func main() {
 			status := ""
 
 			for {
+				active, queued, average := daycareQueue.Load()
 				reg := DaycareRegistration{
-					Hostname:     Config.Hostname,
-					ProblemTypes: Config.ProblemTypes,
-					Capacity:     Config.Capacity,
-					Time:         time.Now(),
-					Version:      CurrentVersion.Version,
+					Hostname:       Config.Hostname,
+					ProblemTypes:   Config.ProblemTypes,
+					Capacity:       Config.Capacity,
+					MaxNannies:     Config.MaxNannies,
+					ActiveNannies:  active,
+					QueuedNannies:  queued,
+					AverageSeconds: average,
+					Time:           time.Now(),
+					Version:        CurrentVersion.Version,
 				}
 				reg.Signature = reg.ComputeSignature(Config.DaycareSecret)
 				raw, err := json.MarshalIndent(&reg, "", "    ")
@@ -455,7 +574,7 @@ func main() {
 						status = "failed"
 					}
 				}
-				time.Sleep(time.Minute)
+				time.Sleep(daycareHeartbeatInterval)
 			}
 		}()
 	}
@@ -599,7 +718,7 @@ func parseID(w http.ResponseWriter, name, s string) (int64, error) {
 		return 0, loggedHTTPErrorf(w, http.StatusBadRequest, "error parsing %s from URL: %v", name, err)
 	}
 	if id < 1 {
-		return 0, loggedHTTPErrorf(w, http.StatusBadRequest, "invalid ID in URL: %s must be 1 or greater", name, err)
+		return 0, loggedHTTPErrorf(w, http.StatusBadRequest, "invalid ID in URL: %s must be 1 or greater", name)
 	}
 
 	return id, nil
@@ -746,6 +865,9 @@ type daycares struct {
 
 var daycareRegistrations daycares
 
+// how often each daycare reports its load to the TA
+const daycareHeartbeatInterval = 15 * time.Second
+
 func init() {
 	daycareRegistrations.daycares = make(map[string]*DaycareRegistration)
 }
@@ -762,6 +884,18 @@ func (m *daycares) Expire() {
 	}
 }
 
+// List returns a snapshot of the current registrations, keyed by host name.
+func (m *daycares) List() map[string]DaycareRegistration {
+	m.Lock()
+	defer m.Unlock()
+
+	list := make(map[string]DaycareRegistration)
+	for host, elt := range m.daycares {
+		list[host] = *elt
+	}
+	return list
+}
+
 func (m *daycares) Insert(reg *DaycareRegistration) error {
 	m.Lock()
 	defer m.Unlock()
@@ -784,6 +918,7 @@ func (m *daycares) Insert(reg *DaycareRegistration) error {
 
 	// clean it up a bit
 	sort.Strings(reg.ProblemTypes)
+	reg.Assigned = 0
 	reg.Time = time.Now()
 	reg.Version = ""
 	reg.Signature = ""
@@ -795,44 +930,71 @@ func (m *daycares) Insert(reg *DaycareRegistration) error {
 	return nil
 }
 
+// Assign picks the least-loaded daycare that supports the given problem type.
+// Load is the fraction of a daycare's nanny slots that are in use or spoken for,
+// counting requests assigned to it since its last heartbeat. Ties are broken
+// randomly, weighted by capacity.
 func (m *daycares) Assign(problemType string) (string, error) {
 	m.Lock()
 	defer m.Unlock()
 
-	// gather the total weights of all of the eligible daycare hosts
-	totalWeight := 0
+	// find the eligible daycare hosts with the lowest load
+	var best []*DaycareRegistration
+	bestLoad, totalWeight := 0.0, 0
 	for _, elt := range m.daycares {
 		n := sort.SearchStrings(elt.ProblemTypes, problemType)
-		if n < len(elt.ProblemTypes) && elt.ProblemTypes[n] == problemType {
+		if n >= len(elt.ProblemTypes) || elt.ProblemTypes[n] != problemType {
+			continue
+		}
+		load := elt.Load()
+		if len(best) == 0 || load < bestLoad {
+			best = nil
+			bestLoad, totalWeight = load, 0
+		}
+		if load == bestLoad {
+			best = append(best, elt)
 			totalWeight += elt.Capacity
 		}
 	}
-	if totalWeight == 0 {
+	if len(best) == 0 || totalWeight == 0 {
 		return "", fmt.Errorf("no eligible daycare found")
 	}
 
 	// pick a random point in pool of weights
 	point := rand.Intn(totalWeight)
 	skippedWeight := 0
-	for host, elt := range m.daycares {
-		n := sort.SearchStrings(elt.ProblemTypes, problemType)
-		if n < len(elt.ProblemTypes) && elt.ProblemTypes[n] == problemType {
-			skippedWeight += elt.Capacity
-		}
+	for _, elt := range best {
+		skippedWeight += elt.Capacity
 		if point < skippedWeight {
-			return host, nil
+			elt.Assigned++
+			return elt.Hostname, nil
 		}
 	}
 	return "", fmt.Errorf("failed to find daycare, please report this error")
 }
 
 type DaycareRegistration struct {
-	Hostname     string    `json:"hostname"`
-	ProblemTypes []string  `json:"problemTypes"`
-	Capacity     int       `json:"capacity"`
-	Time         time.Time `json:"time"`
-	Version      string    `json:"version,omitempty"`
-	Signature    string    `json:"signature,omitempty"`
+	Hostname       string    `json:"hostname"`
+	ProblemTypes   []string  `json:"problemTypes"`
+	Capacity       int       `json:"capacity"`
+	MaxNannies     int       `json:"maxNannies"`
+	ActiveNannies  int       `json:"activeNannies"`
+	QueuedNannies  int       `json:"queuedNannies"`
+	AverageSeconds float64   `json:"averageSeconds"`
+	Assigned       int       `json:"assigned"`
+	Time           time.Time `json:"time"`
+	Version        string    `json:"version,omitempty"`
+	Signature      string    `json:"signature,omitempty"`
+}
+
+// Load estimates how busy a daycare is as a fraction of its nanny slots.
+// Assigned counts requests sent its way by this TA since its last heartbeat.
+func (reg *DaycareRegistration) Load() float64 {
+	slots := reg.MaxNannies
+	if slots < 1 {
+		slots = 1
+	}
+	return float64(reg.ActiveNannies+reg.QueuedNannies+reg.Assigned) / float64(slots)
 }
 
 func (reg *DaycareRegistration) ComputeSignature(secret string) string {
@@ -845,6 +1007,10 @@ func (reg *DaycareRegistration) ComputeSignature(secret string) string {
 		v.Add(fmt.Sprintf("problemType-%d", n), elt)
 	}
 	v.Add("capacity", strconv.Itoa(reg.Capacity))
+	v.Add("maxNannies", strconv.Itoa(reg.MaxNannies))
+	v.Add("activeNannies", strconv.Itoa(reg.ActiveNannies))
+	v.Add("queuedNannies", strconv.Itoa(reg.QueuedNannies))
+	v.Add("averageSeconds", strconv.FormatFloat(reg.AverageSeconds, 'f', 3, 64))
 	v.Add("time", reg.Time.Round(time.Second).UTC().Format(time.RFC3339))
 	v.Add("version", reg.Version)
 
@@ -868,4 +1034,17 @@ var (
 	averageSecondsCounter = expvar.NewFloat("averageSeconds")
 	errorsCounter         = expvar.NewInt("errors")
 	goroutineCounter      = expvar.NewInt("goroutines")
+
+	poolSizeCounter                 = expvar.NewInt("poolSize")
+	poolHitsCounter                 = expvar.NewInt("poolHits")
+	poolMissesCounter               = expvar.NewInt("poolMisses")
+	firstEventMutex                 sync.Mutex
+	firstEvents                     int
+	firstEventSeconds               float64
+	averageFirstEventSecondsCounter = expvar.NewFloat("averageFirstEventSeconds")
+	nanniesActiveCounter            = expvar.NewInt("nanniesActive")
+	nanniesQueuedCounter            = expvar.NewInt("nanniesQueued")
+	queueRejectsCounter             = expvar.NewInt("queueRejects")
+	ltiRejectsCounter               = expvar.NewInt("ltiRejects")
+	averageNannySecondsCounter      = expvar.NewFloat("averageNannySeconds")
 )
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	. "github.com/russross/codegrinder/common"
+	"github.com/russross/meddler"
+)
+
+// API tokens are sent in an Authorization header in place of the
+// session cookie:
+//
+//     Authorization: Bearer cg_...
+//
+// Only the SHA-256 hash of each token is stored. The first few
+// characters are kept as a prefix so users can tell their tokens apart.
+
+const (
+	apiTokenPrefixLength = 8
+	apiTokenUseInterval  = time.Minute
+)
+
+// authUserID is the ID of the user making a request, as established by
+// either the session cookie or an API token.
+type authUserID int64
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIToken creates and stores a new token for a user.
+func newAPIToken(tx *sql.Tx, userID int64, name string, scopes []string, expiresAt, now time.Time) (*APIToken, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := APITokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	token := &APIToken{
+		UserID:    userID,
+		Name:      name,
+		Token:     secret,
+		Prefix:    secret[:len(APITokenPrefix)+apiTokenPrefixLength],
+		TokenHash: hashAPIToken(secret),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+	if err := meddler.Insert(tx, "api_tokens", token); err != nil {
+		return nil, err
+	}
+	log.Printf("API token %d (%s) created for user %d with scopes %s", token.ID, token.Name, userID, strings.Join(scopes, ","))
+	return token, nil
+}
+
+// auditAPIToken describes the creation or revocation of an API token
+// for the audit log, without the token itself.
+func auditAPIToken(action string, token *APIToken) *AuditEntry {
+	summary := *token
+	summary.Token = ""
+	entry := &AuditEntry{
+		Action:     action,
+		ObjectType: "api_token",
+		ObjectID:   token.ID,
+		Target:     fmt.Sprintf("%s (%s) for user %d", token.Name, token.Prefix, token.UserID),
+	}
+	if action == "token.revoke" {
+		entry.Before = &summary
+	} else {
+		entry.After = &summary
+	}
+	return entry
+}
+
+// checkAPIScopes makes sure a list of requested scopes is valid.
+func checkAPIScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if scope != APITokenScopeRead && scope != APITokenScopeWrite {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+func hasAPIScope(token *APIToken, scope string) bool {
+	for _, elt := range token.Scopes {
+		if elt == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAPIToken finds the token given in an Authorization header and
+// makes sure it is current and has a scope that allows the request method.
+func checkAPIToken(db meddler.DB, header, method string) (*APIToken, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || !strings.HasPrefix(parts[1], APITokenPrefix) {
+		return nil, fmt.Errorf("malformed Authorization header")
+	}
+	token := new(APIToken)
+	if err := meddler.QueryRow(db, token, `SELECT * FROM api_tokens WHERE token_hash = $1`, hashAPIToken(parts[1])); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("unknown or revoked API token")
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if !token.ExpiresAt.IsZero() && now.After(token.ExpiresAt) {
+		return nil, fmt.Errorf("API token %d expired at %v", token.ID, token.ExpiresAt)
+	}
+	scope := APITokenScopeWrite
+	if method == "GET" || method == "HEAD" {
+		scope = APITokenScopeRead
+	}
+	if !hasAPIScope(token, scope) && !hasAPIScope(token, APITokenScopeWrite) {
+		return nil, fmt.Errorf("API token %d does not have %s scope", token.ID, scope)
+	}
+
+	// note when the token was last used, but without a write for every request
+	if now.Sub(token.LastUsedAt) > apiTokenUseInterval {
+		token.LastUsedAt = now
+		if _, err := db.Exec(`UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, now, token.ID); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// GetUserMeTokens handles requests to /v2/users/me/tokens,
+// returning the API tokens of the current user (without the tokens themselves).
+func GetUserMeTokens(w http.ResponseWriter, tx *sql.Tx, currentUser *User, render render.Render) {
+	tokens := []*APIToken{}
+	if err := meddler.QueryAll(tx, &tokens, `SELECT * FROM api_tokens WHERE user_id = $1 ORDER BY id`, currentUser.ID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, tokens)
+}
+
+// PostUserMeToken handles requests to /v2/users/me/tokens,
+// creating a new API token for the current user.
+// The response is the only time the token is revealed.
+// A request authenticated by a token cannot create a token with more scopes.
+func PostUserMeToken(w http.ResponseWriter, tx *sql.Tx, currentUser *User, currentToken *APIToken, audit *auditor, token APIToken, render render.Render) {
+	if token.Name == "" {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "token name must not be empty")
+		return
+	}
+	if err := checkAPIScopes(token.Scopes); err != nil {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if currentToken != nil {
+		for _, scope := range token.Scopes {
+			if !hasAPIScope(currentToken, scope) {
+				loggedHTTPErrorf(w, http.StatusUnauthorized, "API token %d cannot create a token with %s scope", currentToken.ID, scope)
+				return
+			}
+		}
+	}
+	now := time.Now()
+	if !token.ExpiresAt.IsZero() && !token.ExpiresAt.After(now) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "token expiration time must be in the future")
+		return
+	}
+
+	created, err := newAPIToken(tx, currentUser.ID, token.Name, token.Scopes, token.ExpiresAt, now)
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := audit.record(tx, auditAPIToken("token.create", created)); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	render.JSON(http.StatusOK, created)
+}
+
+// DeleteUserMeToken handles requests to /v2/users/me/tokens/:token_id,
+// revoking one of the current user's API tokens.
+func DeleteUserMeToken(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor) {
+	tokenID, err := parseID(w, "token_id", params["token_id"])
+	if err != nil {
+		return
+	}
+	token := new(APIToken)
+	if err := meddler.QueryRow(tx, token, `SELECT * FROM api_tokens WHERE id = $1 AND user_id = $2`, tokenID, currentUser.ID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM api_tokens WHERE id = $1`, tokenID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if err := audit.record(tx, auditAPIToken("token.revoke", token)); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("API token %d revoked by user %d", tokenID, currentUser.ID)
+}
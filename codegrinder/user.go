@@ -83,16 +83,32 @@ func GetCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params, current
 // DeleteCourse handles /v2/courses/:course_id requests,
 // deleting a single course.
 // This will also delete all assignments and commits related to the course.
-func DeleteCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+func DeleteCourse(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor) {
 	courseID, err := parseID(w, "course_id", params["course_id"])
 	if err != nil {
 		return
 	}
 
+	course := new(Course)
+	if err := meddler.Load(tx, "courses", course, courseID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
 	if _, err := tx.Exec(`DELETE FROM courses WHERE id = $1`, courseID); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "course.delete",
+		ObjectType: "course",
+		ObjectID:   course.ID,
+		CourseID:   course.ID,
+		Target:     course.Name,
+		Before:     course,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 }
 
 // GetUsers handles /v2/users requests,
@@ -158,17 +174,6 @@ func GetUserMe(w http.ResponseWriter, tx *sql.Tx, currentUser *User, render rend
 	render.JSON(http.StatusOK, currentUser)
 }
 
-// GetUserMeCookie handlers /v2/users/me/cookie requests,
-// returning the cookie for the current user session.
-func GetUserMeCookie(w http.ResponseWriter, r *http.Request) {
-	cookie := r.Header.Get("Cookie")
-	for _, field := range strings.Fields(cookie) {
-		if strings.HasPrefix(field, CookieName+"=") {
-			fmt.Fprintf(w, "%s", field)
-		}
-	}
-}
-
 // GetUser handles /v2/users/:user_id requests,
 // returning a single user.
 func GetUser(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
@@ -235,16 +240,31 @@ func GetCourseUsers(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cu
 // DeleteUser handles /v2/users/:user_id requests,
 // deleting a single user.
 // This will also delete all assignments and commits related to the user.
-func DeleteUser(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+func DeleteUser(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor) {
 	userID, err := parseID(w, "user_id", params["user_id"])
 	if err != nil {
 		return
 	}
 
+	user := new(User)
+	if err := meddler.Load(tx, "users", user, userID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
 	if _, err := tx.Exec(`DELETE FROM users WHERE id = $1`, userID); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "user.delete",
+		ObjectType: "user",
+		ObjectID:   user.ID,
+		Target:     user.Email,
+		Before:     user,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 }
 
 // GetAssignments handles requests to /v2/assignments,
@@ -385,16 +405,137 @@ func GetAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, cur
 
 // DeleteAssignment handles requests to /v2/assignments/:assignment_id,
 // deleting the given assignment.
-func DeleteAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+func DeleteAssignment(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor) {
 	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
 	if err != nil {
 		return
 	}
 
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
 	if _, err := tx.Exec(`DELETE FROM assignments WHERE id = $1`, assignmentID); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "assignment.delete",
+		ObjectType: "assignment",
+		ObjectID:   assignment.ID,
+		CourseID:   assignment.CourseID,
+		Target:     fmt.Sprintf("%s for user %d", assignment.CanvasTitle, assignment.UserID),
+		Before:     assignment,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+}
+
+// PutCourseProblemSetDueDate handles requests to /v2/courses/:course_id/problem_sets/:problem_set_id/due_date,
+// setting the due date and late policy for every student assigned the given problem set in the given course.
+// Note that a due date reported by the LMS will replace this one the next time each student launches the assignment.
+func PutCourseProblemSetDueDate(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, dueDate AssignmentDueDate, render render.Render) {
+	courseID, err := parseID(w, "course_id", params["course_id"])
+	if err != nil {
+		return
+	}
+	problemSetID, err := parseID(w, "problem_set_id", params["problem_set_id"])
+	if err != nil {
+		return
+	}
+	if dueDate.LatePenalty < 0.0 || dueDate.LatePenalty > 1.0 {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "late penalty must be between 0 and 1")
+		return
+	}
+	if !dueDate.LateCutoff.IsZero() && dueDate.LateCutoff.Before(dueDate.DueAt) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "late cutoff must not be before the due date")
+		return
+	}
+
+	assignments := []*Assignment{}
+	if err := meddler.QueryAll(tx, &assignments, `SELECT * FROM assignments WHERE course_id = $1 AND problem_set_id = $2 ORDER BY id`,
+		courseID, problemSetID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	if len(assignments) == 0 {
+		loggedHTTPErrorf(w, http.StatusNotFound, "no assignments found for problem set %d in course %d", problemSetID, courseID)
+		return
+	}
+
+	before := &AssignmentDueDate{
+		DueAt:       assignments[0].DueAt,
+		LatePenalty: assignments[0].LatePenalty,
+		LateCutoff:  assignments[0].LateCutoff,
+	}
+	now := time.Now()
+	for _, asst := range assignments {
+		asst.DueAt = dueDate.DueAt
+		asst.LatePenalty = dueDate.LatePenalty
+		asst.LateCutoff = dueDate.LateCutoff
+		asst.UpdatedAt = now
+		if err := meddler.Save(tx, "assignments", asst); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+	}
+	log.Printf("user %d (%s) set due date %v for problem set %d in course %d (%d assignments)",
+		currentUser.ID, currentUser.Email, dueDate.DueAt, problemSetID, courseID, len(assignments))
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "problem_set.due_date",
+		ObjectType: "problem_set",
+		ObjectID:   problemSetID,
+		CourseID:   courseID,
+		Target:     fmt.Sprintf("%d assignments", len(assignments)),
+		Before:     before,
+		After:      &dueDate,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, assignments)
+}
+
+// PutAssignmentExtension handles requests to /v2/assignments/:assignment_id/extension,
+// giving a single student a later due date for the given assignment.
+func PutAssignmentExtension(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, audit *auditor, extension AssignmentExtension, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+
+	assignment := new(Assignment)
+	if err := meddler.Load(tx, "assignments", assignment, assignmentID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	before := &AssignmentExtension{ExtendedDueAt: assignment.ExtendedDueAt}
+	assignment.ExtendedDueAt = extension.ExtendedDueAt
+	assignment.UpdatedAt = time.Now()
+	if err := meddler.Save(tx, "assignments", assignment); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+	log.Printf("user %d (%s) set extension %v for assignment %d user %d",
+		currentUser.ID, currentUser.Email, extension.ExtendedDueAt, assignment.ID, assignment.UserID)
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "assignment.extension",
+		ObjectType: "assignment",
+		ObjectID:   assignment.ID,
+		CourseID:   assignment.CourseID,
+		Target:     fmt.Sprintf("%s for user %d", assignment.CanvasTitle, assignment.UserID),
+		Before:     before,
+		After:      &extension,
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	render.JSON(http.StatusOK, assignment)
 }
 
 // GetAssignmentProblemCommitLast handles requests to /v2/assignments/:assignment_id/problems/:problem_id/commits/last,
@@ -412,13 +553,13 @@ func GetAssignmentProblemCommitLast(w http.ResponseWriter, tx *sql.Tx, params ma
 	commit := new(Commit)
 
 	if currentUser.Admin {
-		err = meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 ORDER BY step DESC, updated_at DESC LIMIT 1`,
+		err = meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 ORDER BY step DESC, id DESC LIMIT 1`,
 			assignmentID, problemID)
 	} else {
 		err = meddler.QueryRow(tx, commit, `SELECT commits.* `+
 			`FROM commits JOIN user_assignments ON commits.assignment_id = user_assignments.assignment_id `+
 			`WHERE commits.assignment_id = $1 AND problem_id = $2 AND user_assignments.user_id = $3 `+
-			`ORDER BY step DESC, updated_at DESC LIMIT 1`, assignmentID, problemID, currentUser.ID)
+			`ORDER BY step DESC, commits.id DESC LIMIT 1`, assignmentID, problemID, currentUser.ID)
 	}
 
 	if err != nil {
@@ -448,12 +589,12 @@ func GetAssignmentProblemStepCommitLast(w http.ResponseWriter, tx *sql.Tx, param
 	commit := new(Commit)
 
 	if currentUser.Admin {
-		err = meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 AND step = $3 ORDER BY updated_at DESC LIMIT 1`, assignmentID, problemID, step)
+		err = meddler.QueryRow(tx, commit, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 AND step = $3 ORDER BY id DESC LIMIT 1`, assignmentID, problemID, step)
 	} else {
 		err = meddler.QueryRow(tx, commit, `SELECT commits.* `+
 			`FROM commits JOIN user_assignments ON commits.assignment_id = user_assignments.assignment_id `+
 			`WHERE commits.assignment_id = $1 AND problem_id = $2 AND step = $3 AND user_assignments.user_id = $4 `+
-			`ORDER BY updated_at DESC LIMIT 1`,
+			`ORDER BY commits.id DESC LIMIT 1`,
 			assignmentID, problemID, step, currentUser.ID)
 	}
 
@@ -465,24 +606,112 @@ func GetAssignmentProblemStepCommitLast(w http.ResponseWriter, tx *sql.Tx, param
 	render.JSON(http.StatusOK, commit)
 }
 
+// GetAssignmentProblemCommits handles requests to /v2/assignments/:assignment_id/problems/:problem_id/commits,
+// returning every revision saved for the given problem of the given assignment, oldest first.
+// Files and transcripts are left out; fetch a single commit to get them.
+func GetAssignmentProblemCommits(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	assignmentID, err := parseID(w, "assignment_id", params["assignment_id"])
+	if err != nil {
+		return
+	}
+	problemID, err := parseID(w, "problem_id", params["problem_id"])
+	if err != nil {
+		return
+	}
+
+	commits := []*Commit{}
+
+	if currentUser.Admin {
+		err = meddler.QueryAll(tx, &commits, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 ORDER BY id`,
+			assignmentID, problemID)
+	} else {
+		err = meddler.QueryAll(tx, &commits, `SELECT commits.* `+
+			`FROM commits JOIN user_assignments ON commits.assignment_id = user_assignments.assignment_id `+
+			`WHERE commits.assignment_id = $1 AND problem_id = $2 AND user_assignments.user_id = $3 `+
+			`ORDER BY commits.id`, assignmentID, problemID, currentUser.ID)
+	}
+
+	if err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
+
+	for _, commit := range commits {
+		commit.Files = nil
+		commit.Transcript = nil
+	}
+
+	render.JSON(http.StatusOK, commits)
+}
+
+// GetCommit handles requests to /v2/commits/:commit_id,
+// returning a single revision.
+func GetCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params, currentUser *User, render render.Render) {
+	commitID, err := parseID(w, "commit_id", params["commit_id"])
+	if err != nil {
+		return
+	}
+
+	commit := new(Commit)
+
+	if currentUser.Admin {
+		err = meddler.Load(tx, "commits", commit, commitID)
+	} else {
+		err = meddler.QueryRow(tx, commit, `SELECT commits.* `+
+			`FROM commits JOIN user_assignments ON commits.assignment_id = user_assignments.assignment_id `+
+			`WHERE commits.id = $1 AND user_assignments.user_id = $2`,
+			commitID, currentUser.ID)
+	}
+
+	if err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+
+	render.JSON(http.StatusOK, commit)
+}
+
 // DeleteCommit handles requests to /v2/commits/:commit_id,
 // deleting the given commit.
-func DeleteCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params) {
+func DeleteCommit(w http.ResponseWriter, tx *sql.Tx, params martini.Params, audit *auditor) {
 	commitID, err := parseID(w, "commit_id", params["commit_id"])
 	if err != nil {
 		return
 	}
 
+	commit := new(Commit)
+	if err := meddler.Load(tx, "commits", commit, commitID); err != nil {
+		loggedHTTPDBNotFoundError(w, err)
+		return
+	}
+	var courseID int64
+	if err := tx.QueryRow(`SELECT course_id FROM assignments WHERE id = $1`, commit.AssignmentID).Scan(&courseID); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 	if _, err = tx.Exec(`DELETE FROM commits WHERE id = $1`, commitID); err != nil {
 		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 		return
 	}
+	if err := audit.record(tx, &AuditEntry{
+		Action:     "commit.delete",
+		ObjectType: "commit",
+		ObjectID:   commit.ID,
+		CourseID:   courseID,
+		Target:     fmt.Sprintf("assignment %d problem %d step %d", commit.AssignmentID, commit.ProblemID, commit.Step),
+		Before:     auditCommitSummary(commit),
+	}); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+		return
+	}
 }
 
 // PostCommitBundlesUnsigned handles requests to /v2/commit_bundles/unsigned,
 // saving a new commit (or updating the most recent one), gathering the problem data,
 // signing everything, and returning it in a form ready to send to the daycare.
-func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+// A commit saved while an administrator is impersonating the user has a
+// marker added to its note before it is signed.
+func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, imp *Impersonation, audit *auditor, bundle CommitBundle, render render.Render) {
 	now := time.Now()
 
 	if bundle.Commit == nil {
@@ -504,13 +733,20 @@ func PostCommitBundlesUnsigned(w http.ResponseWriter, tx *sql.Tx, currentUser *U
 	bundle.Commit.Score = 0.0
 	bundle.Commit.CreatedAt = now
 	bundle.Commit.UpdatedAt = now
-	saveCommitBundleCommon(now, w, tx, currentUser, bundle, render)
+	if imp != nil {
+		note := impersonationNote(imp)
+		if bundle.Commit.Note != "" {
+			note += " " + bundle.Commit.Note
+		}
+		bundle.Commit.Note = note
+	}
+	saveCommitBundleCommon(now, w, tx, currentUser, audit, bundle, render)
 }
 
 // PostCommitBundlesSigned handles requests to /v2/commit_bundles/signed,
 // saving a new commit (or updating the most recent one), gathering the problem data,
 // verifying signatures, and posting a grade (if appropriate).
-func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *User, imp *Impersonation, audit *auditor, bundle CommitBundle, render render.Render) {
 	now := time.Now()
 
 	if bundle.Commit == nil {
@@ -521,10 +757,14 @@ func PostCommitBundlesSigned(w http.ResponseWriter, tx *sql.Tx, currentUser *Use
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must include commit signature")
 		return
 	}
-	saveCommitBundleCommon(now, w, tx, currentUser, bundle, render)
+	if imp != nil && !strings.HasPrefix(bundle.Commit.Note, impersonationNote(imp)) {
+		loggedHTTPErrorf(w, http.StatusBadRequest, "commit saved during an impersonation must be marked in its note")
+		return
+	}
+	saveCommitBundleCommon(now, w, tx, currentUser, audit, bundle, render)
 }
 
-func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, currentUser *User, bundle CommitBundle, render render.Render) {
+func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, currentUser *User, audit *auditor, bundle CommitBundle, render render.Render) {
 	if bundle.ProblemType != nil {
 		loggedHTTPErrorf(w, http.StatusBadRequest, "bundle must not include a problem type object")
 		return
@@ -630,19 +870,9 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		return
 	}
 
-	// update an existing commit if it exists
-	// note: this used to include AND action IS NULL AND updated_at > now.Add(-OpenCommitTimeout)
-	openCommit := new(Commit)
-	if err := meddler.QueryRow(tx, openCommit, `SELECT * FROM commits WHERE assignment_id = $1 AND problem_id = $2 AND step = $3 LIMIT 1`, commit.AssignmentID, commit.ProblemID, commit.Step); err != nil {
-		if err == sql.ErrNoRows {
-			commit.ID = 0
-		} else {
-			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
-			return
-		}
-	} else {
-		commit.ID = openCommit.ID
-		commit.CreatedAt = openCommit.CreatedAt
+	// every save is stored as a new revision, so only a signed commit keeps the ID it was signed with
+	if bundle.CommitSignature == "" {
+		commit.ID = 0
 	}
 
 	// sign the problem and the commit
@@ -674,8 +904,20 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 	}
 	if isInstructor {
 		log.Printf("instructor is testing student code, skipping save step")
+		if err := audit.record(tx, &AuditEntry{
+			Action:     "assignment.staff_commit",
+			ObjectType: "assignment",
+			ObjectID:   assignment.ID,
+			CourseID:   assignment.CourseID,
+			Target:     fmt.Sprintf("user %d problem %s step %d %s", assignment.UserID, problem.Unique, commit.Step, action),
+			After:      auditCommitSummary(commit),
+		}); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
 	} else {
-		if err := meddler.Save(tx, "commits", commit); err != nil {
+		commit.ID = 0
+		if err := meddler.Insert(tx, "commits", commit); err != nil {
 			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
 			return
 		}
@@ -694,6 +936,12 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 
 	// recompute the signature as the ID may have changed when saving
 	commitSig = commit.ComputeSignature(Config.DaycareSecret, typeSig, problemSig, bundle.Hostname, bundle.UserID)
+
+	// hidden files go to the daycare, but the student cannot read them
+	if err := sealHiddenFiles(steps); err != nil {
+		loggedHTTPErrorf(w, http.StatusInternalServerError, "error sealing hidden files: %v", err)
+		return
+	}
 	signed := &CommitBundle{
 		ProblemType:          problemType,
 		ProblemTypeSignature: typeSig,
@@ -708,14 +956,39 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 
 	// save the grade update
 	if !isInstructor && signed.Commit.ReportCard != nil {
+		before := auditGradeSummary(assignment, problem.Unique)
+
 		// save the raw score for this problem step
 		scores := assignment.RawScores[problem.Unique]
 		for int(signed.Commit.Step) > len(scores) {
 			scores = append(scores, 0.0)
 		}
-		scores[signed.Commit.Step-1] = signed.Commit.ReportCard.ComputeScore()
+		raw := signed.Commit.ReportCard.ComputeScore()
+		scores[signed.Commit.Step-1] = raw
 		assignment.RawScores[problem.Unique] = scores
 
+		// apply the late policy to get the credited score for this step:
+		// on-time work always counts, late work only counts if it
+		// improves on what was already earned
+		if assignment.StepScores == nil {
+			assignment.StepScores = map[string][]float64{}
+		}
+		credited, ok := assignment.StepScores[problem.Unique]
+		if !ok {
+			// assignments from before late policies were tracked
+			credited = append([]float64{}, scores[:signed.Commit.Step-1]...)
+		}
+		for int(signed.Commit.Step) > len(credited) {
+			credited = append(credited, 0.0)
+		}
+		credit := assignment.LateCredit(now)
+		if credit >= 1.0 {
+			credited[signed.Commit.Step-1] = raw
+		} else if raw*credit > credited[signed.Commit.Step-1] {
+			credited[signed.Commit.Step-1] = raw * credit
+		}
+		assignment.StepScores[problem.Unique] = credited
+
 		// get the weight of each step in the problem and problem in the set
 		weights := []*StepWeights{}
 		if err := meddler.QueryAll(tx, &weights, `SELECT problems.unique_id, problem_set_problems.weight AS problem_weight, problem_steps.step, problem_steps.weight AS step_weight `+
@@ -745,7 +1018,10 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		setWeightTotal, setScore := 0.0, 0.0
 		for unique, problemWeight := range problemWeights {
 			setWeightTotal += problemWeight
-			scores := assignment.RawScores[unique]
+			scores, ok := assignment.StepScores[unique]
+			if !ok {
+				scores = assignment.RawScores[unique]
+			}
 			problemWeightTotal, problemScore := 0.0, 0.0
 			for i, stepWeight := range stepWeights[unique] {
 				problemWeightTotal += stepWeight
@@ -791,7 +1067,46 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 		} else {
 			fmt.Fprintf(&report, "<h1>Grading transcript</h1>\n")
 		}
-		fmt.Fprintf(&report, "<pre>%s</pre>\n", html.EscapeString(transcript.String()))
+
+		// the daycare holds back the output of hidden tests,
+		// so report the redacted results instead
+		if stepHasHiddenFiles(steps[commit.Step-1]) {
+			fmt.Fprintf(&report, "<pre>%s</pre>\n", html.EscapeString(summarizeReportCard(signed.Commit.ReportCard)))
+		} else {
+			fmt.Fprintf(&report, "<pre>%s</pre>\n", html.EscapeString(transcript.String()))
+		}
+
+		// note late work
+		if assignment.IsClosed(now) {
+			fmt.Fprintf(&report, "<p><strong>Submitted after the late cutoff; no credit was given.</strong></p>\n")
+		} else if days := assignment.DaysLate(now); days > 0 {
+			fmt.Fprintf(&report, "<p><strong>Submitted %d day(s) late for %.0f%% credit.</strong></p>\n", days, credit*100.0)
+		}
+
+		// summarize the points earned in each category of tests
+		if categories := signed.Commit.ReportCard.CategoryScores(); len(categories) > 0 {
+			fmt.Fprintf(&report, "<h1>Test results</h1>\n<ul>\n")
+			for _, category := range categories {
+				fmt.Fprintf(&report, "<li>%s</li>\n", html.EscapeString(category.String()))
+			}
+			fmt.Fprintf(&report, "</ul>\n")
+		}
+
+		// summarize the resources used
+		if r := signed.Commit.ReportCard.Resources; r != nil {
+			fmt.Fprintf(&report, "<h1>Resource usage</h1>\n<ul>\n")
+			fmt.Fprintf(&report, "<li>Peak memory: %s</li>\n", html.EscapeString(FormatBytes(r.PeakMemory)))
+			fmt.Fprintf(&report, "<li>CPU time: %.2f seconds</li>\n", r.CPUSeconds)
+			fmt.Fprintf(&report, "<li>Wall clock time: %.2f seconds</li>\n", r.WallSeconds)
+			if r.Processes > 0 {
+				fmt.Fprintf(&report, "<li>Processes: %d</li>\n", r.Processes)
+			}
+			fmt.Fprintf(&report, "<li>Written to disk: %s</li>\n", html.EscapeString(FormatBytes(r.BytesWritten)))
+			if r.LimitHit != "" {
+				fmt.Fprintf(&report, "<li><strong>Stopped by the %s limit</strong></li>\n", html.EscapeString(r.LimitHit))
+			}
+			fmt.Fprintf(&report, "</ul>\n")
+		}
 
 		// add all of the student files
 		var names []string
@@ -805,32 +1120,27 @@ func saveCommitBundleCommon(now time.Time, w http.ResponseWriter, tx *sql.Tx, cu
 				html.EscapeString(name), html.EscapeString(contents))
 		}
 
-		// send grade to the LMS in a goroutine
-		// so we can wrap up the transaction and return to the user
-		go func(asst *Assignment, user *User, msg string) {
-			// try up to 10 times before giving up
-			tries := 10
-			minSleepTime := 10 * time.Second
-			maxSleepTime := 5 * time.Minute
-			sleepTime := minSleepTime
-			for i := 0; i < tries; i++ {
-				err := saveGrade(asst, user, msg)
-				if err == nil {
-					return
-				}
-				log.Printf("error posting grade back to LMS (attempt %d/%d): %v", i+1, tries, err)
-				if i+1 < 10 {
-					log.Printf("  will try again in %v", sleepTime)
-					time.Sleep(sleepTime)
-					sleepTime *= 2
-					if sleepTime > maxSleepTime {
-						sleepTime = maxSleepTime
-					}
-				} else {
-					log.Printf("  giving up")
-				}
-			}
-		}(assignment, currentUser, report.String())
+		// queue the grade to be posted to the LMS
+		if err := enqueueGradePost(tx, assignment, report.String(), now); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
+		after := auditGradeSummary(assignment, problem.Unique)
+		after["commitID"] = signed.Commit.ID
+		after["step"] = signed.Commit.Step
+		after["gradePostQueued"] = true
+		if err := audit.record(tx, &AuditEntry{
+			Action:     "assignment.grade",
+			ObjectType: "assignment",
+			ObjectID:   assignment.ID,
+			CourseID:   assignment.CourseID,
+			Target:     fmt.Sprintf("user %d problem %s step %d", assignment.UserID, problem.Unique, signed.Commit.Step),
+			Before:     before,
+			After:      after,
+		}); err != nil {
+			loggedHTTPErrorf(w, http.StatusInternalServerError, "db error: %v", err)
+			return
+		}
 	}
 
 	render.JSON(http.StatusOK, &signed)
@@ -3,8 +3,8 @@ package main
 import (
 	"encoding/xml"
 	"fmt"
-	"io"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -59,33 +59,30 @@ type XUnitDisabled struct {
 	Body    string `xml:",chardata"`
 }
 
-func runAndParseXUnit(n *Nanny, cmd []string, stdin io.Reader, filename string) {
-	// run tests with XML output
-	_, _, _, status, err := n.Exec(cmd, stdin, false)
-	if err != nil {
-		n.ReportCard.LogAndFailf("Error running unit tests: %v", err)
-		return
-	}
-
-	// did it end in a segfault?
-	if status > 127 {
-		n.ReportCard.LogAndFailf("Crashed with exit status %d while running unit tests", status)
-		return
-	}
-	n.ReportCard.Passed = status == 0
-
-	// parse the test results
-	xmlfiles, err := n.GetFiles([]string{filename})
-	if err != nil {
-		n.ReportCard.LogAndFailf("Unit test failed: unable to read results")
-		return
-	}
-
-	parseXUnit(n, xmlfiles[filename])
-}
-
 var testFailureContextGTest = regexp.MustCompile(`^(tests/[^:/]*:\d+)`)
 var testFailureContextPython = regexp.MustCompile(`File "[^"]*/([^/]+)", line (\d+)`)
+var testFailureContextJava = regexp.MustCompile(`at ([\w$.]+)\(([\w$]+\.java):(\d+)\)`)
+
+// javaFrameworkPrefixes are packages whose stack frames are never the student's code
+var javaFrameworkPrefixes = []string{"java.", "javax.", "jdk.", "sun.", "org.junit.", "org.opentest4j."}
+
+// findJavaContext picks the first stack frame that is not in the
+// Java runtime or the JUnit framework.
+func findJavaContext(body string) string {
+	for _, groups := range testFailureContextJava.FindAllStringSubmatch(body, -1) {
+		framework := false
+		for _, prefix := range javaFrameworkPrefixes {
+			if strings.HasPrefix(groups[1], prefix) {
+				framework = true
+				break
+			}
+		}
+		if !framework {
+			return groups[2] + ":" + groups[3]
+		}
+	}
+	return ""
+}
 
 func parseXUnit(n *Nanny, contents string) {
 	results := new(XUnitProgram)
@@ -128,6 +125,8 @@ func parseXUnit(n *Nanny, contents string) {
 					ctx = groups[1]
 				} else if groups := testFailureContextPython.FindStringSubmatch(body); len(groups) > 1 {
 					ctx = groups[1] + ":" + groups[2]
+				} else {
+					ctx = findJavaContext(body)
 				}
 				n.ReportCard.AddFailedResult(name, body, ctx)
 			}
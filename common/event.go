@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 )
@@ -11,10 +12,28 @@ const MaxDetailsLen = 50e3
 
 // ReportCard gives the results of a graded run
 type ReportCard struct {
-	Passed   bool                `json:"passed"`
-	Note     string              `json:"note"`
-	Duration time.Duration       `json:"duration"`
-	Results  []*ReportCardResult `json:"results"`
+	Passed    bool                `json:"passed"`
+	Note      string              `json:"note"`
+	Duration  time.Duration       `json:"duration"`
+	Results   []*ReportCardResult `json:"results"`
+	Resources *ResourceUsage      `json:"resources,omitempty"`
+}
+
+// ResourceUsage summarizes the resources used by student code
+// across all of the commands run for a report card.
+// LimitHit names the first limit that stopped a command, if any:
+//   cpu
+//   memory
+//   fileSize
+//   processes
+//   timeout
+type ResourceUsage struct {
+	PeakMemory   int64   `json:"peakMemory"`
+	CPUSeconds   float64 `json:"cpuSeconds"`
+	WallSeconds  float64 `json:"wallSeconds"`
+	Processes    int64   `json:"processes"`
+	BytesWritten int64   `json:"bytesWritten"`
+	LimitHit     string  `json:"limitHit,omitempty"`
 }
 
 // ReportCardResult Outcomes:
@@ -26,11 +45,15 @@ type ReportCard struct {
 //   be displayed in a monospace font
 // Context:
 //   path/to/file.py:line#
+// Points and Category:
+//   from the problem's test cases, filled in by ApplyTestCases
 type ReportCardResult struct {
-	Name    string `json:"name"`
-	Outcome string `json:"outcome"`
-	Details string `json:"details,omitempty"`
-	Context string `json:"context,omitempty"`
+	Name     string   `json:"name"`
+	Outcome  string   `json:"outcome"`
+	Details  string   `json:"details,omitempty"`
+	Context  string   `json:"context,omitempty"`
+	Points   *float64 `json:"points,omitempty"`
+	Category string   `json:"category,omitempty"`
 }
 
 // EventMessage follows one of these forms:
@@ -43,15 +66,18 @@ type ReportCardResult struct {
 //   error Error
 //   reportcard ReportCard
 //   files Files
+//   queue QueuePosition QueueETA
 type EventMessage struct {
-	Time        time.Time         `json:"time"`
-	Event       string            `json:"event"`
-	ExecCommand []string          `json:"execcommand,omitempty"`
-	ExitStatus  int               `json:"exitstatus,omitempty"`
-	StreamData  string            `json:"streamdata,omitempty"`
-	Error       string            `json:"error,omitempty"`
-	ReportCard  *ReportCard       `json:"reportcard,omitempty"`
-	Files       map[string]string `json:"files,omitempty"`
+	Time          time.Time         `json:"time"`
+	Event         string            `json:"event"`
+	ExecCommand   []string          `json:"execcommand,omitempty"`
+	ExitStatus    int               `json:"exitstatus,omitempty"`
+	StreamData    string            `json:"streamdata,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	ReportCard    *ReportCard       `json:"reportcard,omitempty"`
+	Files         map[string]string `json:"files,omitempty"`
+	QueuePosition int               `json:"queueposition,omitempty"`
+	QueueETA      time.Duration     `json:"queueeta,omitempty"`
 }
 
 func (e *EventMessage) String() string {
@@ -77,6 +103,8 @@ func (e *EventMessage) String() string {
 			names = append(names, name)
 		}
 		return fmt.Sprintf("event: files %s", strings.Join(names, ", "))
+	case "queue":
+		return fmt.Sprintf("event: queue position=%d eta=%v", e.QueuePosition, e.QueueETA)
 	default:
 		return fmt.Sprintf("unknown event: %s", e.Event)
 	}
@@ -98,6 +126,11 @@ func (e *EventMessage) Dump() string {
 		return e.StreamData
 	case "error":
 		return fmt.Sprintf("Error: %s\n", e.Error)
+	case "queue":
+		if e.QueueETA > 0 {
+			return fmt.Sprintf("waiting in line: position %d, about %v to go\n", e.QueuePosition, e.QueueETA)
+		}
+		return fmt.Sprintf("waiting in line: position %d\n", e.QueuePosition)
 	default:
 		return ""
 	}
@@ -155,23 +188,151 @@ func (elt *ReportCard) AddPassedResult(name, details string) *ReportCardResult {
 	return r
 }
 
+// AddResources folds the resources used by one command into the report card.
+func (elt *ReportCard) AddResources(usage *ResourceUsage) {
+	if usage == nil {
+		return
+	}
+	if elt.Resources == nil {
+		elt.Resources = new(ResourceUsage)
+	}
+	r := elt.Resources
+	if usage.PeakMemory > r.PeakMemory {
+		r.PeakMemory = usage.PeakMemory
+	}
+	r.CPUSeconds += usage.CPUSeconds
+	r.WallSeconds += usage.WallSeconds
+	if usage.Processes > r.Processes {
+		r.Processes = usage.Processes
+	}
+	r.BytesWritten += usage.BytesWritten
+	if r.LimitHit == "" {
+		r.LimitHit = usage.LimitHit
+	}
+}
+
+func (r *ResourceUsage) String() string {
+	s := fmt.Sprintf("peak memory %s, %.2fs CPU, %.2fs wall clock", FormatBytes(r.PeakMemory), r.CPUSeconds, r.WallSeconds)
+	if r.Processes > 0 {
+		s += fmt.Sprintf(", %d processes", r.Processes)
+	}
+	s += fmt.Sprintf(", %s written", FormatBytes(r.BytesWritten))
+	if r.LimitHit != "" {
+		s += fmt.Sprintf("; stopped by the %s limit", r.LimitHit)
+	}
+	return s
+}
+
+// FormatBytes gives a human-readable size.
+func FormatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// ApplyTestCases fills in the points and category of each result using the
+// problem's test cases. A result matches a test case with the same name, or
+// one matching the part after the class name (Class -> name).
+func (elt *ReportCard) ApplyTestCases(cases map[string]*ProblemTestCase) {
+	for _, result := range elt.Results {
+		tc := cases[result.Name]
+		if tc == nil {
+			if i := strings.LastIndex(result.Name, " -> "); i >= 0 {
+				tc = cases[result.Name[i+len(" -> "):]]
+			}
+		}
+		points := 1.0
+		result.Category = DefaultTestCategory
+		if tc != nil {
+			points = tc.GetPoints()
+			result.Category = tc.Category
+		}
+		result.Points = &points
+	}
+}
+
+// points gives the weight of a result, treating results from before
+// test cases had points as worth one point each.
+func (result *ReportCardResult) points() float64 {
+	if result.Points == nil {
+		return 1.0
+	}
+	return *result.Points
+}
+
+// ComputeScore gives the score for a report card on a scale of 0.0 to 1.0.
+// A passing report card gets full credit. Otherwise the score is the
+// fraction of points from passed tests, but never full credit.
 func (elt *ReportCard) ComputeScore() float64 {
+	if elt.Passed {
+		return 1.0
+	}
 	if len(elt.Results) == 0 {
 		return 0.0
 	}
-	passed := 0
+	passed, total := 0.0, 0.0
 	for _, result := range elt.Results {
+		total += result.points()
 		if result.Outcome == "passed" {
-			passed++
+			passed += result.points()
 		}
 	}
-	score := float64(passed) / float64(len(elt.Results))
-	if !elt.Passed && score >= 1.0 {
-		score = float64(passed) / float64(len(elt.Results)+1)
+	if total == 0.0 {
+		// every test is worth zero points
+		return 0.0
+	}
+	score := passed / total
+	if score >= 1.0 {
+		// count the failure as one more average test
+		score = passed / (total + total/float64(len(elt.Results)))
 	}
 	return score
 }
 
+// CategoryScore is the points earned and possible for one category of tests.
+type CategoryScore struct {
+	Category string
+	Earned   float64
+	Possible float64
+}
+
+// CategoryScores totals the points in each category, in alphabetical order.
+func (elt *ReportCard) CategoryScores() []*CategoryScore {
+	byName := make(map[string]*CategoryScore)
+	var names []string
+	for _, result := range elt.Results {
+		category := result.Category
+		if category == "" {
+			category = DefaultTestCategory
+		}
+		score := byName[category]
+		if score == nil {
+			score = &CategoryScore{Category: category}
+			byName[category] = score
+			names = append(names, category)
+		}
+		score.Possible += result.points()
+		if result.Outcome == "passed" {
+			score.Earned += result.points()
+		}
+	}
+	sort.Strings(names)
+	var scores []*CategoryScore
+	for _, name := range names {
+		scores = append(scores, byName[name])
+	}
+	return scores
+}
+
+func (s *CategoryScore) String() string {
+	return fmt.Sprintf("%s: %g/%g points", s.Category, s.Earned, s.Possible)
+}
+
 var signals = map[int]string{
 	1:  "SIGHUP",
 	2:  "SIGINT",
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+func pointsPtr(points float64) *float64 {
+	return &points
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestApplyTestCases(t *testing.T) {
+	cases := map[string]*ProblemTestCase{
+		"test_add":   {Points: pointsPtr(3), Category: "arithmetic"},
+		"test_style": {Points: pointsPtr(0), Category: "style"},
+		"testSub":    {Points: nil, Category: "arithmetic"},
+	}
+	card := NewReportCard()
+	card.AddPassedResult("test_add", "")
+	card.AddFailedResult("test_style", "", "")
+	card.AddPassedResult("CalcTest -> testSub", "")
+	card.AddFailedResult("test_other", "", "")
+	card.ApplyTestCases(cases)
+
+	expected := []struct {
+		points   float64
+		category string
+	}{
+		{3, "arithmetic"},
+		{0, "style"},
+		{1, "arithmetic"},
+		{1, DefaultTestCategory},
+	}
+	for i, elt := range expected {
+		result := card.Results[i]
+		if result.Points == nil {
+			t.Errorf("%s: points not set", result.Name)
+			continue
+		}
+		if *result.Points != elt.points || result.Category != elt.category {
+			t.Errorf("%s: got %g points in %q, expected %g points in %q",
+				result.Name, *result.Points, result.Category, elt.points, elt.category)
+		}
+	}
+}
+
+func TestComputeScore(t *testing.T) {
+	card := NewReportCard()
+	if score := card.ComputeScore(); score != 1.0 {
+		t.Errorf("passing report card scored %g, expected 1", score)
+	}
+
+	card.AddPassedResult("a", "").Points = pointsPtr(3)
+	card.AddFailedResult("b", "", "").Points = pointsPtr(1)
+	if score := card.ComputeScore(); !closeTo(score, 0.75) {
+		t.Errorf("weighted score is %g, expected 0.75", score)
+	}
+
+	// a failed zero-point test costs nothing, but the card still failed
+	card = NewReportCard()
+	card.AddPassedResult("a", "").Points = pointsPtr(2)
+	card.AddFailedResult("b", "", "").Points = pointsPtr(0)
+	if score := card.ComputeScore(); score >= 1.0 || !closeTo(score, 2.0/3.0) {
+		t.Errorf("score with a failed zero-point test is %g, expected 2/3", score)
+	}
+
+	// every test worth zero points
+	card = NewReportCard()
+	card.AddPassedResult("a", "").Points = pointsPtr(0)
+	card.AddFailedResult("b", "", "").Points = pointsPtr(0)
+	if score := card.ComputeScore(); score != 0.0 {
+		t.Errorf("score with no points possible is %g, expected 0", score)
+	}
+
+	// results without points are worth one point each
+	card = NewReportCard()
+	card.AddPassedResult("a", "")
+	card.AddFailedResult("b", "", "")
+	if score := card.ComputeScore(); !closeTo(score, 0.5) {
+		t.Errorf("unweighted score is %g, expected 0.5", score)
+	}
+
+	card = NewReportCard()
+	card.Failf("compile error")
+	if score := card.ComputeScore(); score != 0.0 {
+		t.Errorf("failed report card with no results scored %g, expected 0", score)
+	}
+}
+
+func TestCategoryScores(t *testing.T) {
+	card := NewReportCard()
+	card.AddPassedResult("a", "").Points = pointsPtr(2)
+	card.AddFailedResult("b", "", "").Points = pointsPtr(1)
+	card.AddPassedResult("c", "").Points = pointsPtr(0)
+	card.Results[0].Category = "style"
+	card.Results[1].Category = "correctness"
+	card.Results[2].Category = "style"
+	card.AddPassedResult("d", "")
+
+	expected := []CategoryScore{
+		{Category: "correctness", Earned: 1, Possible: 2},
+		{Category: "style", Earned: 2, Possible: 2},
+	}
+	scores := card.CategoryScores()
+	if len(scores) != len(expected) {
+		t.Fatalf("found %d categories, expected %d", len(scores), len(expected))
+	}
+	for i, elt := range expected {
+		if *scores[i] != elt {
+			t.Errorf("category %d is %s, expected %s", i, scores[i], &elt)
+		}
+	}
+}
@@ -48,16 +48,36 @@ type ProblemTypeAction struct {
 }
 
 type Problem struct {
-	ID          int64     `json:"id" meddler:"id,pk"`
-	Unique      string    `json:"unique" meddler:"unique_id"`
-	Note        string    `json:"note" meddler:"note"`
-	ProblemType string    `json:"problemType" meddler:"problem_type"`
-	Tags        []string  `json:"tags" meddler:"tags,json"`
-	Options     []string  `json:"options" meddler:"options,json"`
-	CreatedAt   time.Time `json:"createdAt" meddler:"created_at,localtime"`
-	UpdatedAt   time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+	ID          int64                       `json:"id" meddler:"id,pk"`
+	Unique      string                      `json:"unique" meddler:"unique_id"`
+	Note        string                      `json:"note" meddler:"note"`
+	ProblemType string                      `json:"problemType" meddler:"problem_type"`
+	Tags        []string                    `json:"tags" meddler:"tags,json"`
+	Options     []string                    `json:"options" meddler:"options,json"`
+	TestCases   map[string]*ProblemTestCase `json:"testCases" meddler:"test_cases,json"`
+	CreatedAt   time.Time                   `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt   time.Time                   `json:"updatedAt" meddler:"updated_at,localtime"`
 }
 
+// ProblemTestCase gives the point value and category of a test case,
+// keyed by test name. Tests not listed are worth one point and count
+// toward DefaultTestCategory. Points is a pointer so that a test
+// explicitly worth zero points is different from one that does not say.
+type ProblemTestCase struct {
+	Points   *float64 `json:"points"`
+	Category string   `json:"category"`
+}
+
+// GetPoints gives the points a test is worth, defaulting to one point.
+func (tc *ProblemTestCase) GetPoints() float64 {
+	if tc.Points == nil {
+		return 1.0
+	}
+	return *tc.Points
+}
+
+const DefaultTestCategory = "correctness"
+
 // ProblemStep represents a single step of a problem.
 // Anything in the root directory of Files is added to the working directory,
 // possibly overwriting existing content. The subdirectory contents of Files
@@ -69,6 +89,12 @@ type ProblemStep struct {
 	Instructions string            `json:"instructions" meddler:"instructions"`
 	Weight       float64           `json:"weight" meddler:"weight"`
 	Files        map[string]string `json:"files" meddler:"files,json"`
+
+	// HiddenFiles are added by the daycare when grading, but are never given to students.
+	// When a step is sent to a student, they are replaced by SealedFiles,
+	// which only the daycare can open.
+	HiddenFiles map[string]string `json:"hiddenFiles,omitempty" meddler:"hidden_files,json"`
+	SealedFiles string            `json:"sealedFiles,omitempty" meddler:"-"`
 }
 
 type ProblemSet struct {
@@ -121,6 +147,31 @@ func (problem *Problem) Normalize(now time.Time, steps []*ProblemStep) error {
 	}
 	sort.Strings(problem.Tags)
 
+	// check test cases
+	if problem.TestCases == nil {
+		problem.TestCases = make(map[string]*ProblemTestCase)
+	}
+	for name, tc := range problem.TestCases {
+		if strings.TrimSpace(name) != name || name == "" {
+			return fmt.Errorf("test case name %q cannot be empty or have leading or trailing spaces", name)
+		}
+		if tc == nil {
+			tc = new(ProblemTestCase)
+			problem.TestCases[name] = tc
+		}
+		if tc.Points == nil {
+			points := 1.0
+			tc.Points = &points
+		}
+		if *tc.Points < 0.0 {
+			return fmt.Errorf("test case %s cannot have negative points", name)
+		}
+		tc.Category = strings.TrimSpace(tc.Category)
+		if tc.Category == "" {
+			tc.Category = DefaultTestCategory
+		}
+	}
+
 	// check steps
 	if len(steps) == 0 {
 		return fmt.Errorf("problem must have at least one step")
@@ -182,6 +233,10 @@ func (problem *Problem) ComputeSignature(secret string, steps []*ProblemStep) st
 	v.Add("problemType", problem.ProblemType)
 	v["tags"] = problem.Tags
 	v["options"] = problem.Options
+	for name, tc := range problem.TestCases {
+		v.Add(fmt.Sprintf("testcase-%s-points", name), strconv.FormatFloat(tc.GetPoints(), 'g', -1, 64))
+		v.Add(fmt.Sprintf("testcase-%s-category", name), tc.Category)
+	}
 	v.Add("createdAt", problem.CreatedAt.Round(time.Second).UTC().Format(time.RFC3339))
 	v.Add("updatedAt", problem.UpdatedAt.Round(time.Second).UTC().Format(time.RFC3339))
 	for _, step := range steps {
@@ -190,6 +245,9 @@ func (problem *Problem) ComputeSignature(secret string, steps []*ProblemStep) st
 		for name, contents := range step.Files {
 			v.Add(fmt.Sprintf("step-%d-file-%s", step.Step, name), contents)
 		}
+		for name, contents := range step.HiddenFiles {
+			v.Add(fmt.Sprintf("step-%d-hidden-%s", step.Step, name), contents)
+		}
 	}
 
 	// compute signature
@@ -224,8 +282,14 @@ func (step *ProblemStep) Normalize(n int64) error {
 		// default to 1.0
 		step.Weight = 1.0
 	}
+	step.Files = fixStepFiles(step.Files)
+	step.HiddenFiles = fixStepFiles(step.HiddenFiles)
+	return nil
+}
+
+func fixStepFiles(files map[string]string) map[string]string {
 	clean := make(map[string]string)
-	for name, contents := range step.Files {
+	for name, contents := range files {
 		parts := strings.Split(name, "/")
 		fixed := contents
 		if (len(parts) < 2 || !ProblemStepDirectoryWhitelist[parts[0]]) && utf8.ValidString(contents) {
@@ -241,8 +305,7 @@ func (step *ProblemStep) Normalize(n int64) error {
 		}
 		clean[name] = fixed
 	}
-	step.Files = clean
-	return nil
+	return clean
 }
 
 func (problem *Problem) GetStepWhitelists(steps []*ProblemStep) []map[string]bool {
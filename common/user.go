@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/url"
 	"path/filepath"
 	"sort"
@@ -22,17 +23,20 @@ const (
 	OpenCommitTimeout         = 6 * time.Hour
 	SignedCommitTimeout       = 15 * time.Minute
 	CookieName                = "codegrinder"
+	APITokenPrefix            = "cg_"
 )
 
 // Course represents a single instance of a course as defined by LTI.
 type Course struct {
-	ID        int64     `json:"id" meddler:"id,pk"`
-	Name      string    `json:"name" meddler:"name"`
-	Label     string    `json:"label" meddler:"lti_label"`
-	LtiID     string    `json:"ltiID" meddler:"lti_id"`
-	CanvasID  int64     `json:"canvasID" meddler:"canvas_id"`
-	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
-	UpdatedAt time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+	ID             int64     `json:"id" meddler:"id,pk"`
+	Name           string    `json:"name" meddler:"name"`
+	Label          string    `json:"label" meddler:"lti_label"`
+	LtiID          string    `json:"ltiID" meddler:"lti_id"`
+	CanvasID       int64     `json:"canvasID" meddler:"canvas_id"`
+	PlatformID     int64     `json:"-" meddler:"lti_platform_id,zeroisnull"`
+	MembershipsURL string    `json:"-" meddler:"memberships_url"`
+	CreatedAt      time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt      time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
 }
 
 // User represents a single user as defined by LTI.
@@ -61,7 +65,12 @@ type Assignment struct {
 	Roles              string               `json:"roles" meddler:"roles"`
 	Instructor         bool                 `json:"instructor" meddler:"instructor"`
 	RawScores          map[string][]float64 `json:"raw_scores" meddler:"raw_scores,json"`
+	StepScores         map[string][]float64 `json:"stepScores" meddler:"step_scores,json"`
 	Score              float64              `json:"score" meddler:"score,zeroisnull"`
+	DueAt              time.Time            `json:"dueAt" meddler:"due_at,localtimez"`
+	ExtendedDueAt      time.Time            `json:"extendedDueAt" meddler:"extended_due_at,localtimez"`
+	LatePenalty        float64              `json:"latePenalty" meddler:"late_penalty"`
+	LateCutoff         time.Time            `json:"lateCutoff" meddler:"late_cutoff,localtimez"`
 	GradeID            string               `json:"-" meddler:"grade_id,zeroisnull"`
 	LtiID              string               `json:"-" meddler:"lti_id"`
 	CanvasTitle        string               `json:"canvasTitle" meddler:"canvas_title"`
@@ -72,6 +81,9 @@ type Assignment struct {
 	OutcomeExtAccepted string               `json:"-" meddler:"outcome_ext_accepted"`
 	FinishedURL        string               `json:"finishedURL" meddler:"finished_url"`
 	ConsumerKey        string               `json:"-" meddler:"consumer_key"`
+	PlatformID         int64                `json:"-" meddler:"lti_platform_id,zeroisnull"`
+	PlatformUserID     string               `json:"-" meddler:"platform_user_id"`
+	LineItemURL        string               `json:"-" meddler:"line_item_url"`
 	CreatedAt          time.Time            `json:"createdAt" meddler:"created_at,localtime"`
 	UpdatedAt          time.Time            `json:"updatedAt" meddler:"updated_at,localtime"`
 }
@@ -93,8 +105,12 @@ type Commit struct {
 }
 
 // isInstructorRole returns true if the given LTI Roles field indicates this
-// user is an instructor for a specific course.
+// user is an instructor for a specific course. Some LMSes (including Canvas)
+// report teaching assistants as instructors, too, so they are excluded.
 func (asst *Assignment) IsInstructorRole() bool {
+	if asst.IsTeachingAssistantRole() {
+		return false
+	}
 	for _, role := range strings.Split(asst.Roles, ",") {
 		if role == "Instructor" {
 			return true
@@ -103,6 +119,272 @@ func (asst *Assignment) IsInstructorRole() bool {
 	return false
 }
 
+// IsTeachingAssistantRole returns true if the LMS reported a teaching
+// assistant role for this assignment. Teaching assistants are graders
+// in the course.
+func (asst *Assignment) IsTeachingAssistantRole() bool {
+	return strings.Contains(asst.Roles, "TeachingAssistant")
+}
+
+// LTIConsumer is a consumer key and shared secret that an LMS uses to
+// sign LTI launches, and that the TA uses to sign grades it posts back.
+// The secret is only included in responses when a key is created or rotated.
+type LTIConsumer struct {
+	ID          int64     `json:"id" meddler:"id,pk"`
+	ConsumerKey string    `json:"consumerKey" meddler:"consumer_key"`
+	Secret      string    `json:"secret,omitempty" meddler:"secret"`
+	Institution string    `json:"institution" meddler:"institution"`
+	Enabled     bool      `json:"enabled" meddler:"enabled"`
+	CreatedAt   time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	RotatedAt   time.Time `json:"rotatedAt" meddler:"rotated_at,localtime"`
+	UpdatedAt   time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// Roles a user can hold. Admin and author are global roles; the others
+// are held in a single course. Within a course, instructors can do
+// anything graders can, and graders can do anything students can.
+const (
+	RoleAdmin      = "admin"
+	RoleAuthor     = "author"
+	RoleInstructor = "instructor"
+	RoleGrader     = "grader"
+	RoleStudent    = "student"
+)
+
+// UserRole is a role explicitly granted to a user, either globally
+// (CourseID is zero) or in a single course. Users also hold roles
+// implicitly: the Admin and Author flags grant the global roles, and
+// LTI launches make users instructors or students in a course.
+type UserRole struct {
+	ID        int64     `json:"id" meddler:"id,pk"`
+	UserID    int64     `json:"userID" meddler:"user_id"`
+	Role      string    `json:"role" meddler:"role"`
+	CourseID  int64     `json:"courseID" meddler:"course_id,zeroisnull"`
+	GrantedBy int64     `json:"grantedBy" meddler:"granted_by,zeroisnull"`
+	CreatedAt time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// RoleSummary lists every role a user holds, whether granted explicitly or implied.
+type RoleSummary struct {
+	Global  []string       `json:"global"`
+	Courses []*CourseRoles `json:"courses"`
+}
+
+// CourseRoles lists the roles a user holds in a single course.
+type CourseRoles struct {
+	CourseID int64    `json:"courseID"`
+	Roles    []string `json:"roles"`
+}
+
+// Impersonation lets an administrator see CodeGrinder as another user
+// for support. Requests that carry its ID in the ImpersonationHeader are
+// handled as if the user had made them, and each one is recorded in the
+// audit log. Unless AllowWrites is set, only read-only requests are allowed.
+type Impersonation struct {
+	ID          int64     `json:"id" meddler:"id,pk"`
+	AdminID     int64     `json:"adminID" meddler:"admin_id"`
+	UserID      int64     `json:"userID" meddler:"user_id"`
+	Reason      string    `json:"reason" meddler:"reason"`
+	AllowWrites bool      `json:"allowWrites" meddler:"allow_writes"`
+	ExpiresAt   time.Time `json:"expiresAt" meddler:"expires_at,localtime"`
+	EndedAt     time.Time `json:"endedAt" meddler:"ended_at,localtimez"`
+	CreatedAt   time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+const ImpersonationHeader = "X-CodeGrinder-Impersonation"
+
+// AuditEntry records an action for the audit log. ActorID is the user
+// who took the action; when an administrator is impersonating another
+// user, UserID is the user being impersonated. The object acted on is
+// given by ObjectType and ObjectID (and CourseID when it belongs to a
+// course), and Before and After summarize it around a change.
+type AuditEntry struct {
+	ID              int64       `json:"id" meddler:"id,pk"`
+	ActorID         int64       `json:"actorID" meddler:"actor_id"`
+	UserID          int64       `json:"userID" meddler:"user_id,zeroisnull"`
+	ImpersonationID int64       `json:"impersonationID" meddler:"impersonation_id,zeroisnull"`
+	Action          string      `json:"action" meddler:"action"`
+	ObjectType      string      `json:"objectType" meddler:"object_type,zeroisnull"`
+	ObjectID        int64       `json:"objectID" meddler:"object_id,zeroisnull"`
+	CourseID        int64       `json:"courseID" meddler:"course_id,zeroisnull"`
+	Target          string      `json:"target" meddler:"target"`
+	Before          interface{} `json:"before" meddler:"before,json"`
+	After           interface{} `json:"after" meddler:"after,json"`
+	CreatedAt       time.Time   `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+// APIToken is a credential that lets a program such as grind act on behalf
+// of a user without a browser session. Only a hash of the token is stored,
+// so Token is filled in only when the token is first created.
+type APIToken struct {
+	ID         int64     `json:"id" meddler:"id,pk"`
+	UserID     int64     `json:"userID" meddler:"user_id"`
+	Name       string    `json:"name" meddler:"name"`
+	Token      string    `json:"token,omitempty" meddler:"-"`
+	Prefix     string    `json:"prefix" meddler:"prefix"`
+	TokenHash  string    `json:"-" meddler:"token_hash"`
+	Scopes     []string  `json:"scopes" meddler:"scopes,json"`
+	ExpiresAt  time.Time `json:"expiresAt" meddler:"expires_at,localtimez"`
+	LastUsedAt time.Time `json:"lastUsedAt" meddler:"last_used_at,localtimez"`
+	CreatedAt  time.Time `json:"createdAt" meddler:"created_at,localtime"`
+}
+
+const (
+	// APITokenScopeRead allows GET requests
+	APITokenScopeRead = "read"
+
+	// APITokenScopeWrite allows requests that make changes
+	APITokenScopeWrite = "write"
+)
+
+// DeviceCode is issued when grind starts a device login. The user enters
+// the UserCode at the VerificationURL in a browser where they are signed in,
+// while grind polls using the DeviceCode until the login is approved.
+type DeviceCode struct {
+	DeviceCode      string `json:"deviceCode"`
+	UserCode        string `json:"userCode"`
+	VerificationURL string `json:"verificationURL"`
+	ExpiresIn       int64  `json:"expiresIn"`
+	Interval        int64  `json:"interval"`
+}
+
+// DeviceToken is the result of polling a device login. Token is only
+// present once the login has been approved.
+type DeviceToken struct {
+	Status string    `json:"status"`
+	Token  *APIToken `json:"token,omitempty"`
+}
+
+const (
+	DeviceLoginPending  = "pending"
+	DeviceLoginApproved = "approved"
+	DeviceLoginDenied   = "denied"
+	DeviceLoginExpired  = "expired"
+)
+
+// LTIPlatform is an LMS registered to launch this tool using LTI 1.3.
+// Each registration is identified by the platform's issuer and the
+// client ID it assigned to this tool. LegacyConsumerKey links a platform
+// that replaced an LTI 1.1 consumer key, so its users keep their accounts.
+type LTIPlatform struct {
+	ID                int64     `json:"id" meddler:"id,pk"`
+	Name              string    `json:"name" meddler:"name"`
+	Issuer            string    `json:"issuer" meddler:"issuer"`
+	ClientID          string    `json:"clientID" meddler:"client_id"`
+	DeploymentID      string    `json:"deploymentID" meddler:"deployment_id"`
+	AuthLoginURL      string    `json:"authLoginURL" meddler:"auth_login_url"`
+	AuthTokenURL      string    `json:"authTokenURL" meddler:"auth_token_url"`
+	JWKSURL           string    `json:"jwksURL" meddler:"jwks_url"`
+	LegacyConsumerKey string    `json:"legacyConsumerKey" meddler:"legacy_consumer_key"`
+	Enabled           bool      `json:"enabled" meddler:"enabled"`
+	CreatedAt         time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt         time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+// RosterMember is a member of a course as reported by the LMS.
+// UserID is zero for members who do not have a user record yet.
+type RosterMember struct {
+	UserID int64  `json:"userID"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	LtiID  string `json:"ltiID"`
+	Roles  string `json:"roles"`
+	Status string `json:"status"`
+}
+
+// GradePost is an entry in the outbox of grades waiting to be posted
+// back to the LMS. Posts are written in the same transaction as the
+// score they report and are sent by a background worker.
+type GradePost struct {
+	ID            int64     `json:"id" meddler:"id,pk"`
+	AssignmentID  int64     `json:"assignmentID" meddler:"assignment_id"`
+	Text          string    `json:"-" meddler:"text"`
+	Status        string    `json:"status" meddler:"status"`
+	Attempts      int       `json:"attempts" meddler:"attempts"`
+	LastError     string    `json:"lastError" meddler:"last_error"`
+	NextAttemptAt time.Time `json:"nextAttemptAt" meddler:"next_attempt_at,localtime"`
+	PostedAt      time.Time `json:"postedAt" meddler:"posted_at,localtimez"`
+	CreatedAt     time.Time `json:"createdAt" meddler:"created_at,localtime"`
+	UpdatedAt     time.Time `json:"updatedAt" meddler:"updated_at,localtime"`
+}
+
+const (
+	GradePostPending = "pending"
+	GradePostPosted  = "posted"
+	GradePostFailed  = "failed"
+)
+
+// AssignmentDueDate is the late policy an instructor sets for every
+// student assigned a problem set in a course.
+type AssignmentDueDate struct {
+	DueAt       time.Time `json:"dueAt"`
+	LatePenalty float64   `json:"latePenalty"`
+	LateCutoff  time.Time `json:"lateCutoff"`
+}
+
+// AssignmentExtension is a new due date granted to a single student.
+// A zero ExtendedDueAt removes the extension.
+type AssignmentExtension struct {
+	ExtendedDueAt time.Time `json:"extendedDueAt"`
+}
+
+// EffectiveDueAt returns the due date for this student, taking any
+// extension into account. A zero time means there is no due date.
+func (asst *Assignment) EffectiveDueAt() time.Time {
+	if asst.DueAt.IsZero() || asst.ExtendedDueAt.After(asst.DueAt) {
+		return asst.ExtendedDueAt
+	}
+	return asst.DueAt
+}
+
+// EffectiveCutoff returns the time after which no further credit is
+// given. An extension past the cutoff moves the cutoff with it.
+func (asst *Assignment) EffectiveCutoff() time.Time {
+	if asst.LateCutoff.IsZero() {
+		return asst.LateCutoff
+	}
+	if due := asst.EffectiveDueAt(); due.After(asst.LateCutoff) {
+		return due
+	}
+	return asst.LateCutoff
+}
+
+// IsLate returns true if work graded at the given time is past the
+// due date.
+func (asst *Assignment) IsLate(when time.Time) bool {
+	due := asst.EffectiveDueAt()
+	return !due.IsZero() && when.After(due)
+}
+
+// IsClosed returns true if work graded at the given time is past the
+// cutoff and will not earn any credit.
+func (asst *Assignment) IsClosed(when time.Time) bool {
+	cutoff := asst.EffectiveCutoff()
+	return !cutoff.IsZero() && when.After(cutoff)
+}
+
+// DaysLate returns the number of days (rounded up) that the given time
+// is past the due date.
+func (asst *Assignment) DaysLate(when time.Time) int {
+	if !asst.IsLate(when) {
+		return 0
+	}
+	return int(math.Ceil(when.Sub(asst.EffectiveDueAt()).Hours() / 24.0))
+}
+
+// LateCredit returns the fraction of credit earned by work graded at
+// the given time according to the late policy.
+func (asst *Assignment) LateCredit(when time.Time) float64 {
+	if asst.IsClosed(when) {
+		return 0.0
+	}
+	credit := 1.0 - asst.LatePenalty*float64(asst.DaysLate(when))
+	if credit < 0.0 {
+		return 0.0
+	}
+	return credit
+}
+
 func (commit *Commit) ComputeSignature(secret, problemTypeSignature, problemSignature, daycareHost string, userID int64) string {
 	v := make(url.Values)
 
@@ -132,6 +414,14 @@ func (commit *Commit) ComputeSignature(secret, problemTypeSignature, problemSign
 			if result.Context != "" {
 				v.Add(fmt.Sprintf("reportcard-%d-context", n), result.Context)
 			}
+			if result.Points != nil || result.Category != "" {
+				v.Add(fmt.Sprintf("reportcard-%d-points", n), strconv.FormatFloat(result.points(), 'g', -1, 64))
+				v.Add(fmt.Sprintf("reportcard-%d-category", n), result.Category)
+			}
+		}
+		if r := commit.ReportCard.Resources; r != nil {
+			v.Add("reportcard-resources", fmt.Sprintf("%d %g %g %d %d %s",
+				r.PeakMemory, r.CPUSeconds, r.WallSeconds, r.Processes, r.BytesWritten, r.LimitHit))
 		}
 	}
 	v.Add("score", strconv.FormatFloat(commit.Score, 'g', -1, 64))
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEffectiveDueAtAndCutoff(t *testing.T) {
+	due := time.Date(2026, time.March, 2, 23, 59, 0, 0, time.UTC)
+	cutoff := due.Add(7 * 24 * time.Hour)
+	var zero time.Time
+
+	tests := []struct {
+		name                string
+		dueAt, ext, cutoff  time.Time
+		expectDue, expectCo time.Time
+	}{
+		{"no due date", zero, zero, zero, zero, zero},
+		{"due date only", due, zero, zero, due, zero},
+		{"due date and cutoff", due, zero, cutoff, due, cutoff},
+		{"extension", due, due.Add(48 * time.Hour), cutoff, due.Add(48 * time.Hour), cutoff},
+		{"extension past cutoff", due, cutoff.Add(24 * time.Hour), cutoff, cutoff.Add(24 * time.Hour), cutoff.Add(24 * time.Hour)},
+		{"extension before due date", due, due.Add(-48 * time.Hour), cutoff, due, cutoff},
+		{"extension with no due date", zero, due, zero, due, zero},
+	}
+	for _, elt := range tests {
+		asst := &Assignment{DueAt: elt.dueAt, ExtendedDueAt: elt.ext, LateCutoff: elt.cutoff}
+		if got := asst.EffectiveDueAt(); !got.Equal(elt.expectDue) {
+			t.Errorf("%s: EffectiveDueAt = %v, expected %v", elt.name, got, elt.expectDue)
+		}
+		if got := asst.EffectiveCutoff(); !got.Equal(elt.expectCo) {
+			t.Errorf("%s: EffectiveCutoff = %v, expected %v", elt.name, got, elt.expectCo)
+		}
+	}
+}
+
+func TestLateCredit(t *testing.T) {
+	due := time.Date(2026, time.March, 2, 23, 59, 0, 0, time.UTC)
+	asst := &Assignment{
+		DueAt:       due,
+		LatePenalty: 0.1,
+		LateCutoff:  due.Add(5 * 24 * time.Hour),
+	}
+
+	tests := []struct {
+		name     string
+		when     time.Time
+		late     bool
+		closed   bool
+		daysLate int
+		credit   float64
+	}{
+		{"early", due.Add(-time.Hour), false, false, 0, 1.0},
+		{"exactly on time", due, false, false, 0, 1.0},
+		{"one minute late", due.Add(time.Minute), true, false, 1, 0.9},
+		{"one day late", due.Add(24 * time.Hour), true, false, 1, 0.9},
+		{"just over one day late", due.Add(24*time.Hour + time.Second), true, false, 2, 0.8},
+		{"at the cutoff", due.Add(5 * 24 * time.Hour), true, false, 5, 0.5},
+		{"after the cutoff", due.Add(5*24*time.Hour + time.Second), true, true, 6, 0.0},
+	}
+	for _, elt := range tests {
+		if got := asst.IsLate(elt.when); got != elt.late {
+			t.Errorf("%s: IsLate = %v, expected %v", elt.name, got, elt.late)
+		}
+		if got := asst.IsClosed(elt.when); got != elt.closed {
+			t.Errorf("%s: IsClosed = %v, expected %v", elt.name, got, elt.closed)
+		}
+		if got := asst.DaysLate(elt.when); got != elt.daysLate {
+			t.Errorf("%s: DaysLate = %d, expected %d", elt.name, got, elt.daysLate)
+		}
+		if got := asst.LateCredit(elt.when); !closeTo(got, elt.credit) {
+			t.Errorf("%s: LateCredit = %g, expected %g", elt.name, got, elt.credit)
+		}
+	}
+
+	// the penalty never drives credit below zero
+	asst = &Assignment{DueAt: due, LatePenalty: 0.4}
+	if got := asst.LateCredit(due.Add(3 * 24 * time.Hour)); got != 0.0 {
+		t.Errorf("LateCredit with a large penalty = %g, expected 0", got)
+	}
+
+	// an extension moves the clock for this student only
+	asst = &Assignment{DueAt: due, ExtendedDueAt: due.Add(48 * time.Hour), LatePenalty: 0.1}
+	if asst.IsLate(due.Add(24 * time.Hour)) {
+		t.Errorf("work before the extended due date counted as late")
+	}
+	if got := asst.LateCredit(due.Add(72 * time.Hour)); !closeTo(got, 0.9) {
+		t.Errorf("LateCredit one day past the extension = %g, expected 0.9", got)
+	}
+
+	// no due date means nothing is ever late
+	asst = &Assignment{LatePenalty: 0.5}
+	if asst.IsLate(due) || asst.IsClosed(due) || asst.LateCredit(due) != 1.0 {
+		t.Errorf("assignment with no due date treated as late")
+	}
+}
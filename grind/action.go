@@ -200,7 +200,7 @@ func runInteractiveSession(bundle *CommitBundle, args []string, dir string) {
 			switch reply.Event.Event {
 			case "exec", "stdin", "stdout", "exit", "error":
 				fmt.Printf("%s", cr(reply.Event.Dump()))
-			case "stderr":
+			case "stderr", "queue":
 				fmt.Fprintf(os.Stderr, "%s", cr(reply.Event.Dump()))
 			case "files":
 				if reply.Event.Files != nil {
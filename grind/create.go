@@ -190,6 +190,10 @@ func gatherAuthor(now time.Time, isUpdate bool, action string, startDir string)
 			Note   string
 			Weight float64
 		}
+		Test map[string]*struct {
+			Points   string
+			Category string
+		}
 	}{}
 	configPath := filepath.Join(dir, ProblemConfigName)
 	fmt.Printf("reading %s\n", configPath)
@@ -202,10 +206,23 @@ func gatherAuthor(now time.Time, isUpdate bool, action string, startDir string)
 		ProblemType: cfg.Problem.Type,
 		Tags:        cfg.Problem.Tag,
 		Options:     cfg.Problem.Option,
+		TestCases:   make(map[string]*ProblemTestCase),
 		CreatedAt:   now,
 		UpdatedAt:   now,
 	}
 
+	for name, test := range cfg.Test {
+		tc := &ProblemTestCase{Category: test.Category}
+		if test.Points != "" {
+			points, err := strconv.ParseFloat(test.Points, 64)
+			if err != nil {
+				log.Fatalf("failed to parse points for test %s: %v", name, err)
+			}
+			tc.Points = &points
+		}
+		problem.TestCases[name] = tc
+	}
+
 	// get the problem type
 	problemType := new(ProblemType)
 	mustGetObject(fmt.Sprintf("/problem_types/%s", problem.ProblemType), nil, problemType)
@@ -264,10 +281,11 @@ func gatherAuthor(now time.Time, isUpdate bool, action string, startDir string)
 		log.Printf("gathering step %d", i)
 		s := cfg.Step[strconv.FormatInt(i, 10)]
 		step := &ProblemStep{
-			Step:   i,
-			Note:   s.Note,
-			Weight: s.Weight,
-			Files:  make(map[string]string),
+			Step:        i,
+			Note:        s.Note,
+			Weight:      s.Weight,
+			Files:       make(map[string]string),
+			HiddenFiles: make(map[string]string),
 		}
 		commit := &Commit{
 			Step:      i,
@@ -324,7 +342,9 @@ func gatherAuthor(now time.Time, isUpdate bool, action string, startDir string)
 
 			// pick out solution/starter files
 			reldir, relfile := filepath.Split(relpath)
-			if filepath.ToSlash(reldir) == "_solution/" && relfile != "" {
+			if strings.HasPrefix(filepath.ToSlash(relpath), "_hidden/") {
+				step.HiddenFiles[strings.TrimPrefix(filepath.ToSlash(relpath), "_hidden/")] = string(contents)
+			} else if filepath.ToSlash(reldir) == "_solution/" && relfile != "" {
 				solution[filepath.ToSlash(relfile)] = string(contents)
 			} else if filepath.ToSlash(reldir) == "_starter/" && relfile != "" {
 				starter[filepath.ToSlash(relfile)] = string(contents)
@@ -378,6 +398,9 @@ func gatherAuthor(now time.Time, isUpdate bool, action string, startDir string)
 		unsigned.ProblemSteps = append(unsigned.ProblemSteps, step)
 		unsigned.Commits = append(unsigned.Commits, commit)
 		log.Printf("  found %d problem definition file%s and %d solution file%s", len(step.Files), plural(len(step.Files)), len(commit.Files), plural(len(commit.Files)))
+		if len(step.HiddenFiles) > 0 {
+			log.Printf("  found %d hidden file%s", len(step.HiddenFiles), plural(len(step.HiddenFiles)))
+		}
 	}
 
 	if len(unsigned.ProblemSteps) != len(cfg.Step) {
@@ -451,7 +474,10 @@ func mustConfirmCommitBundle(bundle *CommitBundle, args []string) *CommitBundle
 			return reply.CommitBundle
 
 		case reply.Event != nil:
-			// ignore the streamed data
+			// report our place in line, but ignore the streamed data
+			if reply.Event.Event == "queue" {
+				fmt.Fprintf(os.Stderr, "%s", reply.Event.Dump())
+			}
 
 		default:
 			log.Fatalf("unexpected reply from server")
@@ -69,10 +69,12 @@ func CommandGet(cmd *cobra.Command, args []string) {
 	if assignment.UserID != user.ID {
 		log.Fatalf("you do not have an assignment with number %d", assignment.ID)
 	}
-	getAssignment(assignment, ".")
+	getAssignment(assignment, ".", nil)
 }
 
-func getAssignment(assignment *Assignment, rootDir string) string {
+// getAssignment unpacks an assignment in rootDir, using the most recent commit
+// for each problem. If revision is not nil, it is used instead for its problem.
+func getAssignment(assignment *Assignment, rootDir string, revision *Commit) string {
 	// get the course
 	course := new(Course)
 	mustGetObject(fmt.Sprintf("/courses/%d", assignment.CourseID), nil, course)
@@ -103,7 +105,13 @@ func getAssignment(assignment *Assignment, rootDir string) string {
 			types[problem.ProblemType] = problemType
 		}
 
-		if getObject(fmt.Sprintf("/assignments/%d/problems/%d/commits/last", assignment.ID, problem.ID), nil, commit) {
+		found := false
+		if revision != nil && revision.ProblemID == problem.ID {
+			commit, found = revision, true
+		} else {
+			found = getObject(fmt.Sprintf("/assignments/%d/problems/%d/commits/last", assignment.ID, problem.ID), nil, commit)
+		}
+		if found {
 			info.ID = problem.ID
 			info.Step = commit.Step
 			info.Whitelist = make(map[string]bool)
@@ -71,6 +71,14 @@ func CommandGrade(cmd *cobra.Command, args []string) {
 		log.Printf("  solution for step %d failed", commit.Step)
 		if commit.ReportCard != nil {
 			log.Printf("  ReportCard: %s", commit.ReportCard.Note)
+			if categories := commit.ReportCard.CategoryScores(); len(categories) > 1 {
+				for _, category := range categories {
+					log.Printf("    %s", category)
+				}
+			}
+			if commit.ReportCard.Resources != nil {
+				log.Printf("  Resources: %s", commit.ReportCard.Resources)
+			}
 		}
 
 		// play the transcript
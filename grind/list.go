@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 
 	. "github.com/russross/codegrinder/common"
 	"github.com/spf13/cobra"
@@ -28,6 +29,7 @@ func CommandList(cmd *cobra.Command, args []string) {
 	}
 
 	var course *Course
+	now := time.Now()
 
 	// find the longest assignment ID, name
 	longestID, longestName := 1, 1
@@ -55,7 +57,28 @@ func CommandList(cmd *cobra.Command, args []string) {
 		// fetch the problem
 		problemSet := new(ProblemSet)
 		mustGetObject(fmt.Sprintf("/problem_sets/%d", asst.ProblemSetID), nil, problemSet)
-		fmt.Printf("id:%-*d %-*s %3.0f%% (%s/%s)\n", longestID, asst.ID, longestName, asst.CanvasTitle, asst.Score*100.0, course.Label, problemSet.Unique)
+		fmt.Printf("id:%-*d %-*s %3.0f%% (%s/%s)%s\n", longestID, asst.ID, longestName, asst.CanvasTitle, asst.Score*100.0, course.Label, problemSet.Unique, dueStatus(asst, now))
+	}
+}
+
+// dueStatus describes when an assignment is due and whether it is late.
+func dueStatus(asst *Assignment, now time.Time) string {
+	due := asst.EffectiveDueAt()
+	if due.IsZero() {
+		return ""
+	}
+	when := due.Local().Format("Mon Jan 2 15:04")
+	extended := ""
+	if !asst.ExtendedDueAt.IsZero() && due.Equal(asst.ExtendedDueAt) {
+		extended = " (extended)"
+	}
+	switch {
+	case asst.IsClosed(now):
+		return fmt.Sprintf(" closed, was due %s%s", when, extended)
+	case asst.IsLate(now):
+		return fmt.Sprintf(" LATE, was due %s%s, %.0f%% credit", when, extended, asst.LateCredit(now)*100.0)
+	default:
+		return fmt.Sprintf(" due %s%s", when, extended)
 	}
 }
 
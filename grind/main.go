@@ -11,7 +11,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blang/semver"
 	. "github.com/russross/codegrinder/common"
@@ -26,9 +28,13 @@ const (
 
 var Config struct {
 	Host      string `json:"host"`
-	Cookie    string `json:"cookie"`
+	Token     string `json:"token,omitempty"`
+	Cookie    string `json:"cookie,omitempty"`
 	apiReport bool
 	apiDump   bool
+	as        string
+	asWrite   bool
+	asID      int64
 }
 
 type DotFileInfo struct {
@@ -56,6 +62,8 @@ func main() {
 	if isInstructor {
 		cmdGrind.PersistentFlags().BoolVarP(&Config.apiReport, "api", "", false, "report all API requests")
 		cmdGrind.PersistentFlags().BoolVarP(&Config.apiDump, "api-dump", "", false, "dump API request and response data")
+		cmdGrind.PersistentFlags().StringVarP(&Config.as, "as", "", "", "act as another user, given by ID or email (administrators only)")
+		cmdGrind.PersistentFlags().BoolVarP(&Config.asWrite, "as-write", "", false, "allow changes while acting as another user")
 	}
 
 	cmdVersion := &cobra.Command{
@@ -165,7 +173,20 @@ func main() {
 		cmdStudent.Flags().StringP("name", "n", "", "search by student name")
 		cmdStudent.Flags().StringP("problem", "p", "", "search by problem set name")
 		cmdStudent.Flags().StringP("course", "c", "", "search by course name")
+		cmdStudent.Flags().Int64P("commit", "r", 0, "download the assignment as of the given commit ID")
+		cmdStudent.Flags().BoolP("history", "", false, "list the saved commits instead of downloading")
 		cmdGrind.AddCommand(cmdStudent)
+
+		cmdRepost := &cobra.Command{
+			Use:   "repost",
+			Short: "post all grades for a course to the LMS again (instructors only)",
+			Long: fmt.Sprintf("   Give the numeric ID or the label of the course.\n"+
+				"   Every student's current score will be queued to be posted\n"+
+				"   to the LMS again.\n\n"+
+				"   Example: '%s repost CS-1400'", os.Args[0]),
+			Run: CommandRepost,
+		}
+		cmdGrind.AddCommand(cmdRepost)
 	}
 
 	cmdGrind.Execute()
@@ -177,37 +198,65 @@ func CommandInit(cmd *cobra.Command, args []string) {
 	}
 	hostname := args[0]
 
+	// set up config
+	Config.Host = hostname
+	Config.Token = ""
+	Config.Cookie = ""
+
+	// see if they need an upgrade
+	checkVersion()
+
+	// start a device login
+	code := new(DeviceCode)
+	mustPostObject("/device/code", nil, nil, code)
+
 	fmt.Println(
 		`Please follow these steps:
 
 1.  Use Canvas to load a CodeGrinder window
-2.  Open a new tab in your browser and copy this URL into the address bar:
+2.  Open a new tab in your browser and visit:
 
-    https://` + hostname + `/v2/users/me/cookie
+    ` + code.VerificationURL + `
 
-3.  The browser will display something of the form: ` + CookieName + `=...
-4.  Copy that entire string to the clipboard and paste it below.
+3.  Enter this code and click Connect:
 
-Paste here: `)
+    ` + code.UserCode + `
 
-	var cookie string
-	n, err := fmt.Scanln(&cookie)
-	if err != nil {
-		log.Fatalf("error encountered while reading the cookie you pasted: %v\n", err)
+Waiting for you to connect...`)
+
+	// wait for it to be approved
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
 	}
-	if n != 1 {
-		log.Fatalf("failed to read the cookie you pasted; please try again\n")
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	var token *APIToken
+	for token == nil {
+		if time.Now().After(deadline) {
+			log.Fatalf("the code expired before it was entered; please run '%s init %s' again", os.Args[0], hostname)
+		}
+		time.Sleep(interval)
+		result := new(DeviceToken)
+		mustPostObject("/device/token", nil, &DeviceCode{DeviceCode: code.DeviceCode}, result)
+		switch result.Status {
+		case DeviceLoginPending:
+		case DeviceLoginApproved:
+			if result.Token == nil {
+				log.Fatalf("the server did not return a token")
+			}
+			token = result.Token
+		case DeviceLoginDenied:
+			log.Fatalf("the request was cancelled in the browser")
+		case DeviceLoginExpired:
+			log.Fatalf("the code expired before it was entered; please run '%s init %s' again", os.Args[0], hostname)
+		default:
+			log.Fatalf("unexpected status from server: %q", result.Status)
+		}
 	}
-	if !strings.HasPrefix(cookie, CookieName+"=") {
-		log.Fatalf("the cookie must start with %s=; perhaps you copied the wrong thing?\n", CookieName)
+	if token.Token == "" {
+		log.Fatalf("the server did not return a token")
 	}
-
-	// set up config
-	Config.Cookie = cookie
-	Config.Host = hostname
-
-	// see if they need an upgrade
-	checkVersion()
+	Config.Token = token.Token
 
 	// try it out by fetching a user record
 	user := new(User)
@@ -216,7 +265,7 @@ Paste here: `)
 	// save config for later use
 	mustWriteConfig()
 
-	log.Printf("cookie verified and saved: welcome %s", user.Name)
+	log.Printf("token verified and saved: welcome %s", user.Name)
 }
 
 func mustGetObject(path string, params url.Values, download interface{}) {
@@ -259,7 +308,14 @@ func doRequest(path string, params url.Values, method string, upload interface{}
 
 	// set the headers
 	req.Header["Accept"] = []string{"application/json"}
-	req.Header["Cookie"] = []string{Config.Cookie}
+	if Config.Token != "" {
+		req.Header["Authorization"] = []string{"Bearer " + Config.Token}
+	} else {
+		req.Header["Cookie"] = []string{Config.Cookie}
+	}
+	if Config.asID != 0 {
+		req.Header[ImpersonationHeader] = []string{strconv.FormatInt(Config.asID, 10)}
+	}
 
 	// upload the payload if any
 	if upload != nil && (method == "POST" || method == "PUT") {
@@ -342,6 +398,37 @@ func mustLoadConfig(cmd *cobra.Command) {
 	}
 
 	checkVersion()
+	if Config.as != "" {
+		startImpersonation(cmd)
+	}
+}
+
+// startImpersonation resolves the user named by --as and starts (or
+// resumes) an impersonation so later requests are made as that user.
+func startImpersonation(cmd *cobra.Command) {
+	userID, err := strconv.ParseInt(Config.as, 10, 64)
+	if err != nil {
+		users := []*User{}
+		mustGetObject("/users", url.Values{"email": {Config.as}}, &users)
+		for _, elt := range users {
+			if strings.EqualFold(elt.Email, Config.as) {
+				userID = elt.ID
+				break
+			}
+		}
+		if userID == 0 {
+			log.Fatalf("no user found with email %s", Config.as)
+		}
+	}
+
+	imp := &Impersonation{
+		UserID:      userID,
+		Reason:      "grind " + cmd.Name(),
+		AllowWrites: Config.asWrite,
+	}
+	mustPostObject("/impersonations", nil, imp, imp)
+	Config.asID = imp.ID
+	log.Printf("acting as user %d until %s", userID, imp.ExpiresAt.Format("15:04"))
 }
 
 func mustWriteConfig() {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+
+	. "github.com/russross/codegrinder/common"
+	"github.com/spf13/cobra"
+)
+
+func CommandRepost(cmd *cobra.Command, args []string) {
+	mustLoadConfig(cmd)
+
+	if len(args) != 1 {
+		cmd.Help()
+		os.Exit(1)
+	}
+
+	// find the course by ID or by label
+	course := new(Course)
+	if id, err := strconv.ParseInt(args[0], 10, 64); err == nil && id > 0 {
+		mustGetObject(fmt.Sprintf("/courses/%d", id), nil, course)
+	} else {
+		courses := []*Course{}
+		params := make(url.Values)
+		params.Add("lti_label", args[0])
+		mustGetObject("/courses", params, &courses)
+		if len(courses) == 0 {
+			log.Fatalf("no course found with label %q", args[0])
+		}
+		if len(courses) > 1 {
+			log.Printf("more than one course has the label %q:", args[0])
+			for _, elt := range courses {
+				log.Printf("   id:%d %s", elt.ID, elt.Name)
+			}
+			log.Fatalf("please give the course ID instead")
+		}
+		course = courses[0]
+	}
+
+	posts := []*GradePost{}
+	mustPostObject(fmt.Sprintf("/courses/%d/grade_posts", course.ID), nil, nil, &posts)
+	log.Printf("queued %d grades to be posted for %s", len(posts), course.Name)
+}
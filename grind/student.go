@@ -16,6 +16,20 @@ import (
 func CommandStudent(cmd *cobra.Command, args []string) {
 	mustLoadConfig(cmd)
 
+	history := cmd.Flag("history").Value.String() == "true"
+
+	// special case: user asked for a specific commit
+	if commitID, err := strconv.ParseInt(cmd.Flag("commit").Value.String(), 10, 64); err == nil && commitID > 0 {
+		if len(args) > 0 {
+			log.Fatalf("give a commit ID or search terms, but not both")
+		}
+		revision := new(Commit)
+		mustGetObject(fmt.Sprintf("/commits/%d", commitID), nil, revision)
+		log.Printf("using commit %d from %s", revision.ID, revision.UpdatedAt.Local().Format("Jan 2 15:04:05"))
+		downloadStudentAssignment(revision.AssignmentID, nil, revision)
+		return
+	}
+
 	// parse parameters
 	if len(args) == 0 {
 		log.Printf("you must specify the assignment to download")
@@ -28,7 +42,11 @@ func CommandStudent(cmd *cobra.Command, args []string) {
 
 	// special case: user gave us an assignment number
 	if id, err := strconv.Atoi(args[0]); len(args) == 1 && err == nil && id > 0 {
-		downloadStudentAssignment(int64(id), nil)
+		if history {
+			listStudentHistory(int64(id), nil)
+		} else {
+			downloadStudentAssignment(int64(id), nil, nil)
+		}
 		return
 	}
 
@@ -84,7 +102,11 @@ func CommandStudent(cmd *cobra.Command, args []string) {
 
 	if len(users) == 1 {
 		mostRecent := assignments[len(assignments)-1]
-		downloadStudentAssignment(mostRecent.ID, mostRecent)
+		if history {
+			listStudentHistory(mostRecent.ID, mostRecent)
+		} else {
+			downloadStudentAssignment(mostRecent.ID, mostRecent, nil)
+		}
 	} else {
 		log.Printf("the search found assignments for more than one user")
 		log.Printf("   either pick the correct assignment id from the list")
@@ -105,7 +127,33 @@ func (a ByUserUpdatedAt) Less(i, j int) bool {
 	return a[i].UpdatedAt.Before(a[j].UpdatedAt)
 }
 
-func downloadStudentAssignment(id int64, assignment *Assignment) {
+// listStudentHistory prints every commit saved for each problem in an assignment.
+func listStudentHistory(id int64, assignment *Assignment) {
+	if assignment == nil {
+		assignment = new(Assignment)
+		mustGetObject(fmt.Sprintf("/assignments/%d", id), nil, assignment)
+	}
+	problemSetProblems := []*ProblemSetProblem{}
+	mustGetObject(fmt.Sprintf("/problem_sets/%d/problems", assignment.ProblemSetID), nil, &problemSetProblems)
+	for _, elt := range problemSetProblems {
+		problem := new(Problem)
+		mustGetObject(fmt.Sprintf("/problems/%d", elt.ProblemID), nil, problem)
+		commits := []*Commit{}
+		mustGetObject(fmt.Sprintf("/assignments/%d/problems/%d/commits", assignment.ID, problem.ID), nil, &commits)
+		fmt.Printf("%s: %d commit%s\n", problem.Unique, len(commits), plural(len(commits)))
+		for _, commit := range commits {
+			action := commit.Action
+			if action == "" {
+				action = "save"
+			}
+			fmt.Printf("    id:%d step %d %-8s %3.0f%% %s\n", commit.ID, commit.Step, action, commit.Score*100.0,
+				commit.UpdatedAt.Local().Format("Jan 2 15:04:05"))
+		}
+	}
+	log.Printf("run '%s student --commit [id]' to download a commit", os.Args[0])
+}
+
+func downloadStudentAssignment(id int64, assignment *Assignment, revision *Commit) {
 	// look it up by ID
 	if assignment == nil {
 		assignment = new(Assignment)
@@ -123,7 +171,7 @@ func downloadStudentAssignment(id int64, assignment *Assignment) {
 		log.Printf("deleting %s", rootDir)
 		os.RemoveAll(rootDir)
 	}()
-	changeTo := getAssignment(assignment, rootDir)
+	changeTo := getAssignment(assignment, rootDir, revision)
 	shell := os.Getenv("SHELL")
 	if shell == "" {
 		shell = "/bin/bash"
@@ -0,0 +1,479 @@
+// Command mockplatform is a minimal LTI 1.3 platform for trying out
+// CodeGrinder's LTI 1.3 support without a real LMS.
+//
+// It launches a single user into a single problem set, answers the
+// OpenID Connect login flow, publishes its signing key, hands out
+// access tokens to the tool, logs any scores posted back through
+// Assignment and Grade Services, and serves a small course roster
+// through Names and Role Provisioning Services. It can also start a
+// deep linking request so an instructor can choose a problem set,
+// and shows the links the tool returns.
+//
+// Start it, register it with CodeGrinder using the JSON it prints
+// (POST /v2/lti_platforms as an administrator), and then visit the
+// page it serves to launch the problem set.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v1"
+)
+
+var (
+	addr         = flag.String("addr", ":8090", "address to listen on")
+	issuer       = flag.String("issuer", "http://localhost:8090", "issuer URL of this platform (its own base URL)")
+	tool         = flag.String("tool", "https://localhost", "base URL of the CodeGrinder TA")
+	clientID     = flag.String("client-id", "mock-client", "client ID assigned to the tool")
+	deploymentID = flag.String("deployment-id", "mock-deployment", "deployment ID of the tool")
+	problemSet   = flag.String("problem-set", "", "unique ID of the problem set to launch")
+	role         = flag.String("role", "Learner", "course role of the launching user (Learner or Instructor)")
+	userID       = flag.String("user-id", "mock-user-1", "LTI user ID of the launching user")
+	name         = flag.String("name", "Mock Student", "name of the launching user")
+	email        = flag.String("email", "student@example.com", "email address of the launching user")
+	insecure     = flag.Bool("insecure", false, "do not check the tool's TLS certificate")
+)
+
+const (
+	membershipRole = "http://purl.imsglobal.org/vocab/lis/v2/membership#"
+	contextID      = "mock-context-1"
+	resourceLinkID = "mock-resource-link-1"
+	deepLinkHint   = "deep-link"
+)
+
+var (
+	platformKey *jose.JsonWebKey
+	client      = http.DefaultClient
+
+	mutex        sync.Mutex
+	accessTokens = make(map[string]time.Time)
+	scores       []string
+	links        []string
+)
+
+func main() {
+	log.SetFlags(log.Ltime)
+	flag.Parse()
+	if *problemSet == "" {
+		log.Fatalf("you must give the problem set to launch with -problem-set")
+	}
+	if *insecure {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+
+	// generate a signing key for this run
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("error generating key: %v", err)
+	}
+	platformKey = &jose.JsonWebKey{Key: key, Algorithm: string(jose.RS256), Use: "sig"}
+	thumbprint, err := platformKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		log.Fatalf("error computing key ID: %v", err)
+	}
+	platformKey.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+
+	// print the registration for the tool
+	registration := map[string]interface{}{
+		"name":         "Mock platform",
+		"issuer":       *issuer,
+		"clientID":     *clientID,
+		"deploymentID": *deploymentID,
+		"authLoginURL": *issuer + "/auth",
+		"authTokenURL": *issuer + "/token",
+		"jwksURL":      *issuer + "/jwks",
+		"enabled":      true,
+	}
+	raw, _ := json.MarshalIndent(registration, "", "    ")
+	fmt.Printf("register this platform by posting the following to %s/v2/lti_platforms:\n%s\n", *tool, raw)
+	fmt.Printf("then visit %s/ to launch problem set %s\n", *issuer, *problemSet)
+
+	http.HandleFunc("/", handleIndex)
+	http.HandleFunc("/launch", handleLaunch)
+	http.HandleFunc("/deeplink", handleLaunch)
+	http.HandleFunc("/deeplink/return", handleDeepLinkReturn)
+	http.HandleFunc("/auth", handleAuth)
+	http.HandleFunc("/jwks", handleJWKS)
+	http.HandleFunc("/token", handleToken)
+	http.HandleFunc("/lineitems/1/scores", handleScores)
+	http.HandleFunc("/memberships", handleMemberships)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>Mock LTI platform</title></head><body>
+<h1>Mock LTI platform</h1>
+<p><a href="/launch">Launch {{.ProblemSet}} as {{.Name}} ({{.Role}})</a></p>
+<p><a href="/deeplink">Choose a problem set as {{.Name}} ({{.Role}})</a></p>
+<h2>Scores received</h2>
+<ul>{{range .Scores}}<li><code>{{.}}</code></li>{{else}}<li>none yet</li>{{end}}</ul>
+<h2>Links received</h2>
+<ul>{{range .Links}}<li><code>{{.}}</code></li>{{else}}<li>none yet</li>{{end}}</ul>
+</body></html>
+`))
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	mutex.Lock()
+	data := map[string]interface{}{
+		"ProblemSet": *problemSet,
+		"Name":       *name,
+		"Role":       *role,
+		"Scores":     append([]string{}, scores...),
+		"Links":      append([]string{}, links...),
+	}
+	mutex.Unlock()
+	indexTemplate.Execute(w, data)
+}
+
+// handleLaunch starts a third-party initiated login with the tool,
+// either for the problem set or for a deep linking request.
+func handleLaunch(w http.ResponseWriter, r *http.Request) {
+	q := url.Values{}
+	q.Set("iss", *issuer)
+	q.Set("login_hint", *userID)
+	q.Set("target_link_uri", *tool+"/v2/lti/problem_sets/"+*problemSet)
+	q.Set("client_id", *clientID)
+	if r.URL.Path == "/deeplink" {
+		q.Set("lti_message_hint", deepLinkHint)
+	} else {
+		q.Set("lti_message_hint", resourceLinkID)
+	}
+	http.Redirect(w, r, *tool+"/v2/lti13/login?"+q.Encode(), http.StatusFound)
+}
+
+var autoPostTemplate = template.Must(template.New("post").Parse(`<!DOCTYPE html>
+<html><body onload="document.forms[0].submit()">
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="id_token" value="{{.IDToken}}">
+<input type="hidden" name="state" value="{{.State}}">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body></html>
+`))
+
+// handleAuth is the authorization endpoint. It signs an id_token for the
+// launching user and posts it back to the tool.
+func handleAuth(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	redirectURI := r.Form.Get("redirect_uri")
+	if r.Form.Get("client_id") != *clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("login_hint") != *userID {
+		http.Error(w, "unknown login_hint", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("response_type") != "id_token" || r.Form.Get("response_mode") != "form_post" {
+		http.Error(w, "unsupported response_type or response_mode", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(redirectURI, *tool+"/") {
+		http.Error(w, "redirect_uri does not belong to the tool", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   *issuer,
+		"sub":   *userID,
+		"aud":   *clientID,
+		"azp":   *clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": r.Form.Get("nonce"),
+		"name":  *name,
+		"email": *email,
+		"https://purl.imsglobal.org/spec/lti/claim/message_type":    "LtiResourceLinkRequest",
+		"https://purl.imsglobal.org/spec/lti/claim/version":         "1.3.0",
+		"https://purl.imsglobal.org/spec/lti/claim/deployment_id":   *deploymentID,
+		"https://purl.imsglobal.org/spec/lti/claim/target_link_uri": *tool + "/v2/lti/problem_sets/" + *problemSet,
+		"https://purl.imsglobal.org/spec/lti/claim/roles":           []string{membershipRole + *role},
+		"https://purl.imsglobal.org/spec/lti/claim/context": map[string]string{
+			"id":    contextID,
+			"label": "MOCK-101",
+			"title": "Mock Course",
+		},
+		"https://purl.imsglobal.org/spec/lti/claim/resource_link": map[string]string{
+			"id":    resourceLinkID,
+			"title": "Mock assignment: " + *problemSet,
+		},
+		"https://purl.imsglobal.org/spec/lti/claim/launch_presentation": map[string]string{
+			"document_target": "iframe",
+			"return_url":      *issuer + "/",
+		},
+		"https://purl.imsglobal.org/spec/lti/claim/tool_platform": map[string]string{
+			"guid":                "mock-platform",
+			"name":                "Mock platform",
+			"product_family_code": "mock",
+		},
+		"https://purl.imsglobal.org/spec/lti-ags/claim/endpoint": map[string]interface{}{
+			"scope":     []string{"https://purl.imsglobal.org/spec/lti-ags/scope/score"},
+			"lineitems": *issuer + "/lineitems",
+			"lineitem":  *issuer + "/lineitems/1",
+		},
+		"https://purl.imsglobal.org/spec/lti-nrps/claim/namesroleservice": map[string]interface{}{
+			"context_memberships_url": *issuer + "/memberships",
+			"service_versions":        []string{"2.0"},
+		},
+	}
+	if r.Form.Get("lti_message_hint") == deepLinkHint {
+		claims["https://purl.imsglobal.org/spec/lti/claim/message_type"] = "LtiDeepLinkingRequest"
+		delete(claims, "https://purl.imsglobal.org/spec/lti/claim/resource_link")
+		claims["https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings"] = map[string]interface{}{
+			"deep_link_return_url": *issuer + "/deeplink/return",
+			"accept_types":         []string{"ltiResourceLink"},
+			"accept_multiple":      false,
+			"data":                 randomString(),
+		}
+	}
+	token, err := sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("launching %s with %s", *userID, claims["https://purl.imsglobal.org/spec/lti/claim/message_type"])
+	autoPostTemplate.Execute(w, map[string]string{
+		"Action":  redirectURI,
+		"IDToken": token,
+		"State":   r.Form.Get("state"),
+	})
+}
+
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	public := jose.JsonWebKey{
+		Key:       &platformKey.Key.(*rsa.PrivateKey).PublicKey,
+		KeyID:     platformKey.KeyID,
+		Algorithm: platformKey.Algorithm,
+		Use:       platformKey.Use,
+	}
+	writeJSON(w, &jose.JsonWebKeySet{Keys: []jose.JsonWebKey{public}})
+}
+
+// handleToken issues access tokens in exchange for client assertions
+// signed with the tool's key.
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("grant_type") != "client_credentials" {
+		http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+		return
+	}
+	if err := checkAssertion(r.Form.Get("client_assertion")); err != nil {
+		log.Printf("rejecting token request: %v", err)
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	token := randomString()
+	mutex.Lock()
+	accessTokens[token] = time.Now().Add(time.Hour)
+	mutex.Unlock()
+	log.Printf("issued access token for scope %q", r.Form.Get("scope"))
+	writeJSON(w, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"scope":        r.Form.Get("scope"),
+	})
+}
+
+// verifyToolToken checks the signature on a JWT against the tool's
+// published key and returns the payload.
+func verifyToolToken(token string) ([]byte, error) {
+	obj, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(obj.Signatures) != 1 {
+		return nil, fmt.Errorf("expected one signature")
+	}
+	resp, err := client.Get(*tool + "/v2/lti13/jwks")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	set := new(jose.JsonWebKeySet)
+	if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+		return nil, err
+	}
+	keys := set.Key(obj.Signatures[0].Header.KeyID)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("tool key %q not found", obj.Signatures[0].Header.KeyID)
+	}
+	return obj.Verify(&keys[0])
+}
+
+// checkAssertion verifies a client assertion against the tool's published key.
+func checkAssertion(assertion string) error {
+	payload, err := verifyToolToken(assertion)
+	if err != nil {
+		return err
+	}
+	var claims struct {
+		Issuer   string `json:"iss"`
+		Audience string `json:"aud"`
+		Expires  int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+	if claims.Issuer != *clientID {
+		return fmt.Errorf("assertion issuer is %q", claims.Issuer)
+	}
+	if claims.Audience != *issuer+"/token" {
+		return fmt.Errorf("assertion audience is %q", claims.Audience)
+	}
+	if time.Now().After(time.Unix(claims.Expires, 0)) {
+		return fmt.Errorf("assertion has expired")
+	}
+	return nil
+}
+
+// handleDeepLinkReturn receives the problem set chosen in a deep linking request.
+func handleDeepLinkReturn(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	payload, err := verifyToolToken(r.Form.Get("JWT"))
+	if err != nil {
+		log.Printf("rejecting deep linking response: %v", err)
+		http.Error(w, "bad deep linking response", http.StatusBadRequest)
+		return
+	}
+	var response struct {
+		Issuer       string          `json:"iss"`
+		Audience     string          `json:"aud"`
+		MessageType  string          `json:"https://purl.imsglobal.org/spec/lti/claim/message_type"`
+		ContentItems json.RawMessage `json:"https://purl.imsglobal.org/spec/lti-dl/claim/content_items"`
+	}
+	if err := json.Unmarshal(payload, &response); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if response.Issuer != *clientID || response.Audience != *issuer || response.MessageType != "LtiDeepLinkingResponse" {
+		http.Error(w, "unexpected deep linking response", http.StatusBadRequest)
+		return
+	}
+	log.Printf("deep link received: %s", response.ContentItems)
+	mutex.Lock()
+	links = append(links, string(response.ContentItems))
+	mutex.Unlock()
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func checkBearer(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	mutex.Lock()
+	defer mutex.Unlock()
+	expires, present := accessTokens[token]
+	return present && time.Now().Before(expires)
+}
+
+func handleScores(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkBearer(r) {
+		http.Error(w, "bad access token", http.StatusUnauthorized)
+		return
+	}
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var score map[string]interface{}
+	if err := json.Unmarshal(raw, &score); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("score received: %s", raw)
+	mutex.Lock()
+	scores = append(scores, string(raw))
+	mutex.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleMemberships(w http.ResponseWriter, r *http.Request) {
+	if !checkBearer(r) {
+		http.Error(w, "bad access token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.ims.lti-nrps.v2.membershipcontainer+json")
+	writeJSON(w, map[string]interface{}{
+		"id": *issuer + "/memberships",
+		"context": map[string]string{
+			"id":    contextID,
+			"label": "MOCK-101",
+			"title": "Mock Course",
+		},
+		"members": []map[string]interface{}{
+			{
+				"status":  "Active",
+				"name":    *name,
+				"email":   *email,
+				"user_id": *userID,
+				"roles":   []string{membershipRole + *role},
+			},
+			{
+				"status":  "Active",
+				"name":    "Mock Instructor",
+				"email":   "instructor@example.com",
+				"user_id": "mock-instructor-1",
+				"roles":   []string{membershipRole + "Instructor"},
+			},
+		},
+	})
+}
+
+func sign(claims interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(jose.RS256, platformKey)
+	if err != nil {
+		return "", err
+	}
+	signer.SetEmbedJwk(false)
+	obj, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+func randomString() string {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		log.Fatalf("error generating random string: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func writeJSON(w http.ResponseWriter, elt interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := json.NewEncoder(w).Encode(elt); err != nil {
+		log.Printf("error writing JSON response: %v", err)
+	}
+}
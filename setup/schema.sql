@@ -30,6 +30,7 @@ CREATE TABLE problems (
     problem_type            text NOT NULL,
     tags                    jsonb NOT NULL,
     options                 jsonb NOT NULL,
+    test_cases              jsonb NOT NULL,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
 
@@ -45,6 +46,7 @@ CREATE TABLE problem_steps (
     instructions            text NOT NULL,
     weight                  double precision NOT NULL,
     files                   json NOT NULL,
+    hidden_files            json NOT NULL,
 
     PRIMARY KEY (problem_id, step),
     FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE
@@ -72,16 +74,49 @@ CREATE TABLE problem_set_problems (
     FOREIGN KEY (problem_id) REFERENCES problems (id) ON DELETE CASCADE
 );
 
+CREATE TABLE lti_platforms (
+    id                      bigserial NOT NULL,
+    name                    text NOT NULL,
+    issuer                  text NOT NULL,
+    client_id               text NOT NULL,
+    deployment_id           text NOT NULL,
+    auth_login_url          text NOT NULL,
+    auth_token_url          text NOT NULL,
+    jwks_url                text NOT NULL,
+    legacy_consumer_key     text NOT NULL,
+    enabled                 boolean NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX lti_platforms_issuer_client_id ON lti_platforms (issuer, client_id);
+
+CREATE TABLE lti_launch_states (
+    state                   text NOT NULL,
+    nonce                   text NOT NULL,
+    lti_platform_id         bigint NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    expires_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (state),
+    FOREIGN KEY (lti_platform_id) REFERENCES lti_platforms (id) ON DELETE CASCADE
+);
+CREATE INDEX lti_launch_states_expires_at ON lti_launch_states (expires_at);
+
 CREATE TABLE courses (
     id                      bigserial NOT NULL,
     name                    text NOT NULL,
     lti_label               text NOT NULL,
     lti_id                  text NOT NULL,
     canvas_id               bigint NOT NULL,
+    lti_platform_id         bigint,
+    memberships_url         text NOT NULL,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
 
-    PRIMARY KEY (id)
+    PRIMARY KEY (id),
+    FOREIGN KEY (lti_platform_id) REFERENCES lti_platforms (id) ON DELETE SET NULL
 );
 CREATE UNIQUE INDEX courses_lti_label ON courses (lti_label);
 CREATE UNIQUE INDEX courses_lti_id ON courses (lti_id);
@@ -107,6 +142,102 @@ CREATE UNIQUE INDEX users_lti_id ON users (lti_id);
 CREATE UNIQUE INDEX users_canvas_login ON users (canvas_login);
 CREATE UNIQUE INDEX users_canvas_id ON users (canvas_id);
 
+CREATE TABLE user_roles (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    role                    text NOT NULL,
+    course_id               bigint,
+    granted_by              bigint,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users (id) ON DELETE SET NULL
+);
+CREATE UNIQUE INDEX user_roles_user_id_role_course_id ON user_roles (user_id, role, COALESCE(course_id, 0));
+CREATE INDEX user_roles_course_id ON user_roles (course_id);
+
+CREATE TABLE impersonations (
+    id                      bigserial NOT NULL,
+    admin_id                bigint NOT NULL,
+    user_id                 bigint NOT NULL,
+    reason                  text NOT NULL,
+    allow_writes            boolean NOT NULL,
+    expires_at              timestamp with time zone NOT NULL,
+    ended_at                timestamp with time zone,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (admin_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX impersonations_admin_id ON impersonations (admin_id);
+
+CREATE TABLE audit_log (
+    id                      bigserial NOT NULL,
+    actor_id                bigint NOT NULL,
+    user_id                 bigint,
+    impersonation_id        bigint,
+    action                  text NOT NULL,
+    object_type             text,
+    object_id               bigint,
+    course_id               bigint,
+    target                  text NOT NULL,
+    before                  text NOT NULL,
+    after                   text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE INDEX audit_log_actor_id ON audit_log (actor_id);
+CREATE INDEX audit_log_user_id ON audit_log (user_id);
+CREATE INDEX audit_log_object ON audit_log (object_type, object_id);
+CREATE INDEX audit_log_course_id ON audit_log (course_id);
+CREATE INDEX audit_log_created_at ON audit_log (created_at);
+
+-- the audit log is append-only
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+
+CREATE TABLE api_tokens (
+    id                      bigserial NOT NULL,
+    user_id                 bigint NOT NULL,
+    name                    text NOT NULL,
+    prefix                  text NOT NULL,
+    token_hash              text NOT NULL,
+    scopes                  text NOT NULL,
+    expires_at              timestamp with time zone,
+    last_used_at            timestamp with time zone,
+    created_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX api_tokens_token_hash ON api_tokens (token_hash);
+CREATE INDEX api_tokens_user_id ON api_tokens (user_id);
+
+CREATE TABLE device_logins (
+    id                      bigserial NOT NULL,
+    device_code_hash        text NOT NULL,
+    user_code               text NOT NULL,
+    status                  text NOT NULL,
+    user_id                 bigint,
+    expires_at              timestamp with time zone NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX device_logins_device_code_hash ON device_logins (device_code_hash);
+CREATE UNIQUE INDEX device_logins_user_code ON device_logins (user_code);
+
 CREATE TABLE assignments (
     id                      bigserial NOT NULL,
     course_id               bigint NOT NULL,
@@ -115,7 +246,12 @@ CREATE TABLE assignments (
     roles                   text NOT NULL,
     instructor              boolean NOT NULL,
     raw_scores              jsonb NOT NULL,
+    step_scores             jsonb NOT NULL,
     score                   double precision,
+    due_at                  timestamp with time zone,
+    extended_due_at         timestamp with time zone,
+    late_penalty            double precision NOT NULL,
+    late_cutoff             timestamp with time zone,
     grade_id                text,
     lti_id                  text NOT NULL,
     canvas_title            text NOT NULL,
@@ -126,10 +262,14 @@ CREATE TABLE assignments (
     outcome_ext_accepted    text NOT NULL,
     finished_url            text NOT NULL,
     consumer_key            text NOT NULL,
+    lti_platform_id         bigint,
+    platform_user_id        text NOT NULL,
+    line_item_url           text NOT NULL,
     created_at              timestamp with time zone NOT NULL,
     updated_at              timestamp with time zone NOT NULL,
 
     PRIMARY KEY (id),
+    FOREIGN KEY (lti_platform_id) REFERENCES lti_platforms (id) ON DELETE SET NULL,
     FOREIGN KEY (course_id) REFERENCES courses (id) ON DELETE CASCADE,
     FOREIGN KEY (problem_set_id) REFERENCES problem_sets (id) ON DELETE CASCADE,
     FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
@@ -137,6 +277,48 @@ CREATE TABLE assignments (
 CREATE UNIQUE INDEX assignments_unique_user ON assignments (user_id, lti_id);
 CREATE UNIQUE INDEX assignments_grade_id ON assignments (grade_id);
 
+CREATE TABLE grade_posts (
+    id                      bigserial NOT NULL,
+    assignment_id           bigint NOT NULL,
+    text                    text NOT NULL,
+    status                  text NOT NULL,
+    attempts                integer NOT NULL,
+    last_error              text NOT NULL,
+    next_attempt_at         timestamp with time zone NOT NULL,
+    posted_at               timestamp with time zone,
+    created_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id),
+    FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE
+);
+CREATE INDEX grade_posts_status_next_attempt_at ON grade_posts (status, next_attempt_at);
+CREATE INDEX grade_posts_assignment_id ON grade_posts (assignment_id);
+
+CREATE TABLE lti_consumers (
+    id                      bigserial NOT NULL,
+    consumer_key            text NOT NULL,
+    secret                  text NOT NULL,
+    institution             text NOT NULL,
+    enabled                 boolean NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    rotated_at              timestamp with time zone NOT NULL,
+    updated_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX lti_consumers_consumer_key ON lti_consumers (consumer_key);
+
+CREATE TABLE oauth_nonces (
+    consumer_key            text NOT NULL,
+    nonce                   text NOT NULL,
+    created_at              timestamp with time zone NOT NULL,
+    expires_at              timestamp with time zone NOT NULL,
+
+    PRIMARY KEY (consumer_key, nonce)
+);
+CREATE INDEX oauth_nonces_expires_at ON oauth_nonces (expires_at);
+
 CREATE TABLE commits (
     id                      bigserial NOT NULL,
     assignment_id           bigint NOT NULL,
@@ -155,47 +337,38 @@ CREATE TABLE commits (
     FOREIGN KEY (assignment_id) REFERENCES assignments (id) ON DELETE CASCADE,
     FOREIGN KEY (problem_id, step) REFERENCES problem_steps (problem_id, step) ON DELETE CASCADE
 );
-CREATE UNIQUE INDEX commits_unique_assignment_problem_step ON commits (assignment_id, problem_id, step);
+CREATE INDEX commits_assignment_problem_step ON commits (assignment_id, problem_id, step, id);
+
+CREATE VIEW course_staff AS
+    (SELECT DISTINCT user_id, course_id FROM assignments WHERE instructor OR roles LIKE '%TeachingAssistant%')
+    UNION
+    (SELECT user_id, course_id FROM user_roles WHERE course_id IS NOT NULL AND role IN ('instructor', 'grader'));
 
 CREATE VIEW user_problem_sets AS
     (SELECT DISTINCT assignments.user_id, problem_sets.id AS problem_set_id FROM
     assignments JOIN problem_sets ON assignments.problem_set_id = problem_sets.id)
     UNION
-    (SELECT DISTINCT instructors.id AS user_id, assignments.problem_set_id AS problem_set_id FROM
-    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
-    JOIN courses ON instructors_assignments.course_id = courses.id
-    JOIN assignments ON courses.id = assignments.course_id
-    WHERE instructors_assignments.instructor);
+    (SELECT DISTINCT course_staff.user_id, assignments.problem_set_id AS problem_set_id FROM
+    course_staff JOIN assignments ON course_staff.course_id = assignments.course_id);
 
 CREATE VIEW user_problems AS
     (SELECT DISTINCT assignments.user_id, problem_set_problems.problem_id FROM
     assignments JOIN problem_sets ON assignments.problem_set_id = problem_sets.id
     JOIN problem_set_problems ON problem_sets.id = problem_set_problems.problem_set_id)
     UNION
-    (SELECT DISTINCT instructors.id AS user_id, problem_set_problems.problem_id FROM
-    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
-    JOIN courses ON instructors_assignments.course_id = courses.id
-    JOIN assignments ON courses.id = assignments.course_id
-    JOIN problem_sets ON assignments.problem_set_id = problem_sets.id
-    JOIN problem_set_problems ON problem_sets.id = problem_set_problems.problem_id
-    WHERE instructors_assignments.instructor);
+    (SELECT DISTINCT course_staff.user_id, problem_set_problems.problem_id FROM
+    course_staff JOIN assignments ON course_staff.course_id = assignments.course_id
+    JOIN problem_set_problems ON assignments.problem_set_id = problem_set_problems.problem_set_id);
 
 CREATE VIEW user_users AS
-    (SELECT DISTINCT instructors.id AS user_id, users.id AS other_user_id FROM
-    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
-    JOIN courses ON instructors_assignments.course_id = courses.id
-    JOIN assignments ON courses.id = assignments.course_id
-    JOIN users ON assignments.user_id = users.id
-    WHERE instructors_assignments.instructor)
+    (SELECT DISTINCT course_staff.user_id, assignments.user_id AS other_user_id FROM
+    course_staff JOIN assignments ON course_staff.course_id = assignments.course_id)
     UNION
     (SELECT id as user_id, id AS other_user_id FROM users);
 
 CREATE VIEW user_assignments AS
-    (SELECT DISTINCT instructors.id AS user_id, assignments.id AS assignment_id FROM
-    users AS instructors JOIN assignments AS instructors_assignments ON instructors.id = instructors_assignments.user_id
-    JOIN courses ON instructors_assignments.course_id = courses.id
-    JOIN assignments ON courses.id = assignments.course_id
-    WHERE instructors_assignments.instructor)
+    (SELECT DISTINCT course_staff.user_id, assignments.id AS assignment_id FROM
+    course_staff JOIN assignments ON course_staff.course_id = assignments.course_id)
     UNION
     (SELECT user_id, id as assignment_id FROM assignments);
 
@@ -208,29 +381,3 @@ CREATE VIEW assignment_search_fields AS
     FROM assignments JOIN courses ON assignments.course_id = courses.id
     JOIN users ON assignments.user_id = users.id
     JOIN problem_sets ON assignments.problem_set_id = problem_sets.id);
-
-INSERT INTO problem_types (name, image) VALUES ('armv6asm', 'codegrinder/armv6asm');
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('armv6asm', 'grade', 'Grade', 'Grading‥', false, 60, 120, 120, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('armv6asm', 'test', 'Test', 'Testing‥', false, 60, 120, 120, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('armv6asm', 'debug', 'Debug', 'Running gdb‥', true, 60, 1800, 300, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('armv6asm', 'run', 'Run', 'Running‥', true, 60, 1800, 300, 100, 10, 128, 20);
-
-INSERT INTO problem_types (name, image) VALUES ('prologunittest', 'codegrinder/prolog');
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('prologunittest', 'test', 'Test', 'Testing‥', false, 10, 20, 20, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('prologunittest', 'grade', 'Grade', 'Grading‥', false, 10, 20, 20, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('prologunittest', 'run', 'Run', 'Running‥', true, 10, 1800, 300, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('prologunittest', 'shell', 'Shell', 'Running Prolog shell‥', true, 10, 1800, 300, 100, 10, 128, 20);
-
-INSERT INTO problem_types (name, image) VALUES ('python34unittest', 'codegrinder/python');
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('python34unittest', 'grade', 'Grade', 'Grading‥', false, 60, 120, 120, 10, 10, 64, 30);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('python34unittest', 'test', 'Test', 'Testing‥', false, 60, 120, 120, 10, 10, 64, 30);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('python34unittest', 'run', 'Run', 'Running‥', true, 60, 1800, 300, 10, 10, 64, 30);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('python34unittest', 'debug', 'Debug', 'Running debugger‥', true, 60, 1800, 300, 10, 10, 64, 30);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('python34unittest', 'shell', 'Shell', 'Running Python shell‥', true, 60, 1800, 300, 10, 10, 64, 30);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('python34unittest', 'stylecheck', 'Style check', 'Checking pep8 style‥', false, 60, 120, 120, 10, 10, 64, 30);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('python34unittest', 'stylefix', 'Style fix', 'Fixing pep8 style‥', false, 60, 120, 120, 10, 10, 64, 30);
-
-INSERT INTO problem_types (name, image) VALUES ('standardmlunittest', 'codegrinder/standardml');
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('standardmlunittest', 'grade', 'Grade', 'Grading‥', false, 10, 20, 20, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('standardmlunittest', 'run', 'Run', 'Running‥', true, 10, 1800, 300, 100, 10, 128, 20);
-INSERT INTO problem_type_actions (problem_type, action, button, message, interactive, max_cpu, max_session, max_timeout, max_fd, max_file_size, max_memory, max_threads) VALUES ('standardmlunittest', 'shell', 'Shell', 'Running PolyML shell‥', true, 10, 1800, 300, 100, 10, 128, 20);